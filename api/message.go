@@ -0,0 +1,186 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package api // import "jw4.us/mqd/api"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"jw4.us/mqd/dispatcher"
+)
+
+// Message is the JSON description of a message submitted to the API.
+type Message struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	Cc   []string `json:"cc,omitempty"`
+	// Bcc recipients are in the envelope only.
+	Bcc         []string     `json:"bcc,omitempty"`
+	ReplyTo     string       `json:"reply_to,omitempty"`
+	Subject     string       `json:"subject"`
+	Text        string       `json:"text,omitempty"`
+	HTML        string       `json:"html,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is a file attached to a Message.
+type Attachment struct {
+	Filename string `json:"filename"`
+	// ContentType defaults to the type of the Filename extension.
+	ContentType string `json:"content_type,omitempty"`
+	// Content is base64 encoded in JSON.
+	Content []byte `json:"content"`
+}
+
+// part is a MIME entity.
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// compose builds the RFC 5322 message described by m, and its
+// envelope.
+func (m Message) compose(now time.Time) (*dispatcher.Envelope, []byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, nil, fmt.Errorf("from: %v", err)
+	}
+	env := &dispatcher.Envelope{Sender: from.Address}
+	header := &bytes.Buffer{}
+	fmt.Fprintf(header, "From: %s\r\n", from)
+
+	for _, field := range []struct {
+		name      string
+		addresses []string
+	}{{"To", m.To}, {"Cc", m.Cc}, {"Bcc", m.Bcc}} {
+		var list []string
+		for _, entry := range field.addresses {
+			addr, err := mail.ParseAddress(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", strings.ToLower(field.name), err)
+			}
+			env.Recipients = append(env.Recipients, addr.Address)
+			list = append(list, addr.String())
+		}
+		if len(list) > 0 && field.name != "Bcc" {
+			fmt.Fprintf(header, "%s: %s\r\n", field.name, strings.Join(list, ", "))
+		}
+	}
+	if len(env.Recipients) == 0 {
+		return nil, nil, errors.New("no recipients")
+	}
+	if m.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(m.ReplyTo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reply_to: %v", err)
+		}
+		fmt.Fprintf(header, "Reply-To: %s\r\n", replyTo)
+	}
+	fmt.Fprintf(header, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(header, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	header.WriteString("MIME-Version: 1.0\r\n")
+
+	var body part
+	switch {
+	case m.HTML == "":
+		body = textPart("text/plain", m.Text)
+	case m.Text == "":
+		body = textPart("text/html", m.HTML)
+	default:
+		body = multipartOf("alternative", textPart("text/plain", m.Text), textPart("text/html", m.HTML))
+	}
+	if len(m.Attachments) > 0 {
+		parts := []part{body}
+		for ix, a := range m.Attachments {
+			if a.Filename == "" {
+				return nil, nil, fmt.Errorf("attachment %d has no filename", ix)
+			}
+			parts = append(parts, attachmentPart(a))
+		}
+		body = multipartOf("mixed", parts...)
+	}
+
+	writeHeader(header, body.header)
+	header.WriteString("\r\n")
+	return env, append(header.Bytes(), body.body...), nil
+}
+
+func textPart(contentType, text string) part {
+	buf := &bytes.Buffer{}
+	w := quotedprintable.NewWriter(buf)
+	_, _ = w.Write([]byte(text))
+	_ = w.Close()
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: buf.Bytes(),
+	}
+}
+
+func attachmentPart(a Attachment) part {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	encoded := base64.StdEncoding.EncodeToString(a.Content)
+	buf := &bytes.Buffer{}
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return part{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		body: buf.Bytes(),
+	}
+}
+
+func multipartOf(subtype string, parts ...part) part {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	for _, p := range parts {
+		pw, _ := w.CreatePart(p.header)
+		_, _ = pw.Write(p.body)
+	}
+	_ = w.Close()
+	return part{
+		header: textproto.MIMEHeader{"Content-Type": {"multipart/" + subtype + "; boundary=" + w.Boundary()}},
+		body:   buf.Bytes(),
+	}
+}
+
+// writeHeader writes the fields of h in a stable order.
+func writeHeader(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package api provides an HTTP API for submitting messages to the
+// mailqueue folder and following them until they are sent. Messages
+// go through the same folders as those left in the pickup folder.
+package api // import "jw4.us/mqd/api"
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/journal"
+	"jw4.us/mqd/logging"
+)
+
+// authFailures counts failed authentication attempts.
+var authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "mqd",
+	Subsystem: "api",
+	Name:      "auth_failures_total",
+	Help:      "Requests refused for a missing or invalid token.",
+})
+
+func init() {
+	prometheus.MustRegister(authFailures)
+}
+
+// Server is the HTTP API server.
+type Server struct {
+	settings  mqd.APISettings
+	mailqueue string
+	queue     dispatcher.MailQueueDispatcher
+	// journal is the path of the delivery journal, if there is one.
+	journal string
+	tls     *tls.Config
+	log     *slog.Logger
+	mux     *http.ServeMux
+	http    *http.Server
+}
+
+// NewServer returns a Server for the API settings of s, which works
+// on the queue folders of s and logs to log, or the default logger when
+// it is nil.
+func NewServer(s *mqd.Settings, log *slog.Logger) (*Server, error) {
+	if s.API == nil {
+		return nil, errors.New("no api settings")
+	}
+	log = logging.Or(log).With("listener", "api")
+	var duplicates *dispatcher.Duplicates
+	if s.Duplicates != nil {
+		duplicates = &dispatcher.Duplicates{Folder: s.Duplicates.Folder}
+	}
+	srv := &Server{
+		settings:  *s.API,
+		mailqueue: s.MailQueue,
+		queue:     dispatcher.NewPickupFolderQueue(s.MailQueue, s.BadMail, s.SentMail, dispatcher.QueueOptions{Duplicates: duplicates, Log: log}),
+		log:       log,
+		mux:       http.NewServeMux(),
+	}
+	if srv.settings.MaxSize == 0 {
+		srv.settings.MaxSize = mqd.DefaultMaxSize
+	}
+	if s.Journal != nil {
+		srv.journal = s.Path(s.Journal.Path)
+	}
+	if srv.settings.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(s.Path(srv.settings.Certificate), s.Path(srv.settings.Key))
+		if err != nil {
+			return nil, err
+		}
+		srv.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	srv.mux.HandleFunc("/messages", srv.authorized(srv.submit))
+	srv.mux.HandleFunc("/messages/", srv.authorized(srv.status))
+	srv.mux.HandleFunc("/journal", srv.authorized(srv.records))
+	srv.http = &http.Server{Handler: srv.mux, ReadHeaderTimeout: 30 * time.Second}
+	return srv, nil
+}
+
+// ServeHTTP fulfills the http.Handler interface
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the configured address and serves
+// clients until Close is called.
+func (srv *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", srv.settings.Listen)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve serves clients connecting to l until Close is called.
+func (srv *Server) Serve(l net.Listener) error {
+	if srv.tls != nil {
+		l = tls.NewListener(l, srv.tls)
+	}
+	srv.log.Info("listening", "addr", l.Addr().String())
+	if err := srv.http.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the Server, dropping open connections.
+func (srv *Server) Close() error {
+	return srv.http.Close()
+}
+
+// authorized wraps handlers that require a bearer token.
+func (srv *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+			given := []byte(header[len(prefix):])
+			for _, token := range srv.settings.Tokens {
+				if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+					handler(w, r)
+					return
+				}
+			}
+		}
+		authFailures.Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mqd"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+	}
+}
+
+// submitted is the response to a submitted message.
+type submitted struct {
+	ID     string           `json:"id"`
+	Status dispatcher.State `json:"status"`
+}
+
+// submit handles POST /messages. The body is either a JSON Message,
+// or a raw RFC 5322 message with the envelope in optional from and to
+// query parameters.
+func (srv *Server) submit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, srv.settings.MaxSize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	var (
+		env     *dispatcher.Envelope
+		message []byte
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var m Message
+		if err = json.Unmarshal(body, &m); err == nil {
+			env, message, err = m.compose(time.Now())
+		}
+	} else {
+		env, message, err = raw(body, r.URL.Query())
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, err := dispatcher.Enqueue(srv.mailqueue, env, message)
+	if err != nil {
+		srv.log.Error("queueing message", logging.Sender, env.Sender, logging.Recipients, len(env.Recipients),
+			logging.Remote, r.RemoteAddr, logging.Err(err))
+		writeError(w, http.StatusInternalServerError, errors.New("could not queue message"))
+		return
+	}
+	srv.log.Info("queued", logging.File, id, logging.Sender, env.Sender, logging.Recipients, len(env.Recipients),
+		logging.Remote, r.RemoteAddr)
+	w.Header().Set("Location", "/messages/"+id)
+	writeJSON(w, http.StatusAccepted, submitted{ID: id, Status: dispatcher.StateQueued})
+}
+
+// raw checks a raw message, and takes its envelope from the from and
+// to query parameters, if given. Line endings are converted to CRLF.
+func raw(body []byte, query map[string][]string) (*dispatcher.Envelope, []byte, error) {
+	if _, err := mail.ReadMessage(bytes.NewReader(body)); err != nil {
+		return nil, nil, fmt.Errorf("invalid message: %v", err)
+	}
+	env := &dispatcher.Envelope{}
+	if from := query["from"]; len(from) > 0 {
+		env.Sender = from[0]
+	}
+	for _, to := range query["to"] {
+		for _, rcpt := range strings.Split(to, ",") {
+			if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+				env.Recipients = append(env.Recipients, rcpt)
+			}
+		}
+	}
+	if env.Sender != "" && len(env.Recipients) == 0 {
+		return nil, nil, errors.New("from given without to")
+	}
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	return env, bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")), nil
+}
+
+// status handles GET /messages/<id>.
+func (srv *Server) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	status, err := srv.queue.Status(strings.TrimPrefix(r.URL.Path, "/messages/"))
+	switch {
+	case os.IsNotExist(err):
+		writeError(w, http.StatusNotFound, errors.New("message not found"))
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// records handles GET /journal, returning the journal records that
+// match the query parameters, as read by journal.ParseQuery.
+func (srv *Server) records(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if srv.journal == "" {
+		writeError(w, http.StatusNotFound, errors.New("no journal configured"))
+		return
+	}
+	q, err := journal.ParseQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	records, err := journal.Read(srv.journal, q)
+	if err != nil {
+		srv.log.Error("reading journal", logging.File, srv.journal, logging.Err(err))
+		writeError(w, http.StatusInternalServerError, errors.New("could not read journal"))
+		return
+	}
+	if records == nil {
+		records = []journal.Record{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		// the responses are plain structs; this can't happen
+		code, raw = http.StatusInternalServerError, []byte(`{"error": "internal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(raw, '\n'))
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,240 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/journal"
+)
+
+func testServer(t *testing.T) (*Server, *mqd.Settings, func()) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mqd.NewSettings(filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail"))
+	s.SentMail = filepath.Join(dir, "sentmail")
+	for _, folder := range []string{s.MailQueue, s.BadMail, s.SentMail} {
+		if err = os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.API = &mqd.APISettings{Listen: "127.0.0.1:0", Tokens: []string{"t0ken"}}
+	srv, err := NewServer(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, s, func() { _ = os.RemoveAll(dir) }
+}
+
+func do(srv http.Handler, method, target, token, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w
+}
+
+func TestSubmitAndStatus(t *testing.T) {
+	srv, s, cleanup := testServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		target      string
+		token       string
+		contentType string
+		body        string
+		code        int
+		sender      string
+		recipients  string
+		contains    []string
+	}{{
+		target: "/messages", token: "wrong", contentType: "message/rfc822",
+		body: "Subject: hi\r\n\r\nhello\r\n",
+		code: http.StatusUnauthorized,
+	}, {
+		target: "/messages?from=app@example.com&to=a@example.com,b@example.com", token: "t0ken", contentType: "message/rfc822",
+		body:       "Subject: hi\n\nhello\n",
+		code:       http.StatusAccepted,
+		sender:     "app@example.com",
+		recipients: "a@example.com,b@example.com",
+		contains:   []string{"Subject: hi\r\n\r\nhello\r\n"},
+	}, {
+		target: "/messages", token: "t0ken", contentType: "message/rfc822",
+		body: "not a message",
+		code: http.StatusBadRequest,
+	}, {
+		target: "/messages", token: "t0ken", contentType: "application/json",
+		body: `{"from": "App <app@example.com>", "to": ["a@example.com"], "bcc": ["b@example.com"],
+			"subject": "Grüße", "text": "hello", "html": "<p>hello</p>",
+			"attachments": [{"filename": "a.txt", "content": "aGVsbG8="}]}`,
+		code:       http.StatusAccepted,
+		sender:     "app@example.com",
+		recipients: "a@example.com,b@example.com",
+		contains:   []string{"From: \"App\" <app@example.com>\r\n", "To: <a@example.com>\r\n", "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n"},
+	}, {
+		target: "/messages", token: "t0ken", contentType: "application/json",
+		body: `{"from": "app@example.com", "subject": "hi", "text": "hello"}`,
+		code: http.StatusBadRequest,
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		w := do(srv, http.MethodPost, test.target, test.token, test.contentType, test.body)
+		if w.Code != test.code {
+			t.Errorf("expected %d, got %d: %s", test.code, w.Code, w.Body)
+			continue
+		}
+		if test.code != http.StatusAccepted {
+			continue
+		}
+		var got submitted
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(s.MailQueue, got.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range test.contains {
+			if !strings.Contains(string(raw), expected) {
+				t.Errorf("expected message to contain %q, got %q", expected, raw)
+			}
+		}
+		if strings.Contains(string(raw), "b@example.com") && test.contentType == "application/json" {
+			t.Errorf("expected bcc recipient to be left out of the message, got %q", raw)
+		}
+		var env dispatcher.Envelope
+		raw, err = ioutil.ReadFile(filepath.Join(s.MailQueue, got.ID+dispatcher.EnvelopeSuffix))
+		if err == nil {
+			err = json.Unmarshal(raw, &env)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Sender != test.sender || strings.Join(env.Recipients, ",") != test.recipients {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+
+		w = do(srv, http.MethodGet, "/messages/"+got.ID, "t0ken", "", "")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status": "queued"`) {
+			t.Errorf("expected queued status, got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	if w := do(srv, http.MethodGet, "/messages/missing.eml", "t0ken", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	m := Message{
+		From:        "app@example.com",
+		To:          []string{"a@example.com"},
+		Subject:     "hi",
+		Text:        "hello",
+		HTML:        "<p>hello</p>",
+		Attachments: []Attachment{{Filename: "data.bin", Content: []byte{0, 1, 2}}},
+	}
+	_, raw, err := m.compose(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %q %v", mediaType, err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		types = append(types, strings.SplitN(p.Header.Get("Content-Type"), ";", 2)[0])
+		if p.FileName() != "" && p.FileName() != "data.bin" {
+			t.Errorf("unexpected filename %q", p.FileName())
+		}
+	}
+	if strings.Join(types, ",") != "multipart/alternative,application/octet-stream" {
+		t.Errorf("unexpected parts %v", types)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	srv, s, cleanup := testServer(t)
+	defer cleanup()
+
+	if w := do(srv, http.MethodGet, "/journal", "t0ken", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a journal, got %d: %s", w.Code, w.Body)
+	}
+
+	s.Journal = &mqd.JournalSettings{Path: filepath.Join(filepath.Dir(s.MailQueue), "journal.jsonl")}
+	records := `{"time":"2017-01-02T15:04:05Z","id":"a.eml","recipients":["bob@x.com"],"result":"sent","attempt":1,"final":true}
+{"time":"2017-01-02T15:04:06Z","id":"b.eml","recipients":["carol@x.com"],"result":"deferred","attempt":1}
+`
+	if err := ioutil.WriteFile(s.Journal.Path, []byte(records), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ix, test := range []struct {
+		target   string
+		code     int
+		expected string
+	}{
+		{"/journal", http.StatusOK, "a.eml b.eml"},
+		{"/journal?recipient=bob&result=sent", http.StatusOK, "a.eml"},
+		{"/journal?since=2017-01-03", http.StatusOK, ""},
+		{"/journal?since=soon", http.StatusBadRequest, ""},
+	} {
+		t.Logf("Test %d", ix)
+		w := do(srv, http.MethodGet, test.target, "t0ken", "", "")
+		if w.Code != test.code {
+			t.Errorf("expected %d, got %d: %s", test.code, w.Code, w.Body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var got []journal.Record
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, r := range got {
+			ids = append(ids, r.ID)
+		}
+		if strings.Join(ids, " ") != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, ids)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/journal"
+)
+
+// showJournal runs the journal subcommand, which prints the records
+// of the delivery journal of the settings file at path that match
+// the options.
+func showJournal(w io.Writer, path string, args []string) error {
+	settings, err := mqd.ReadSettings(path)
+	if err != nil {
+		return err
+	}
+	if settings.Journal == nil {
+		return errors.New("no journal configured")
+	}
+
+	flags := flag.NewFlagSet("journal", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	values := url.Values{}
+	for _, option := range []struct{ name, usage string }{
+		{"id", "the queue ID of the message"},
+		{"message_id", "the Message-ID of the message"},
+		{"sender", "include senders containing this"},
+		{"recipient", "include recipients containing this"},
+		{"connection", "include connections containing this"},
+		{"subject", "include subjects containing this"},
+		{"result", "sent, deferred or failed; for the recipient, if given"},
+		{"since", "include records from this time: 2006-01-02, 2006-01-02 15:04, RFC 3339, or a duration ago, e.g. 24h"},
+		{"until", "include records before this time"},
+	} {
+		name := option.name
+		flags.Func(name, option.usage, func(v string) error { values.Set(name, v); return nil })
+	}
+	final := flags.Bool("final", false, "include only the last record of each message")
+	if err = flags.Parse(args); err != nil {
+		return err
+	}
+	if *final {
+		values.Set("final", strconv.FormatBool(*final))
+	}
+	q, err := journal.ParseQuery(values, time.Now())
+	if err != nil {
+		return err
+	}
+
+	records, err := journal.Read(settings.Path(settings.Journal.Path), q)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(w, records)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tID\tRESULT\tATTEMPT\tCONNECTION\tSENDER\tRECIPIENTS\tSUBJECT")
+	for _, r := range records {
+		recipients := make([]string, len(r.Recipients))
+		for ix, rcpt := range r.Recipients {
+			recipients[ix] = rcpt
+			if d := r.Outcome(rcpt); d.Result != r.Result {
+				recipients[ix] += " (" + d.Result + ")"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Time.Format("2006-01-02 15:04:05"), r.ID, r.Result,
+			r.Attempt, r.Connection, r.Sender, strings.Join(recipients, ", "), r.Subject)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,69 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/logging"
+)
+
+// logFile is the log written in the program folder unless the
+// settings name another output.
+const logFile = "smtp-dispatcher.log"
+
+var (
+	logger    = slog.Default()
+	logOutput io.Closer
+)
+
+// openLog sets up logger from the log settings in the settings file
+// at path. When the settings can't be read, or name no output, it logs
+// to a rotated file in folder. Changes to the log settings take effect
+// when the program is restarted.
+func openLog(path string, folder string) {
+	cfg := mqd.LogSettings{}
+	settings, err := mqd.ReadSettings(path)
+	if err == nil && settings.Log != nil {
+		cfg = *settings.Log
+	}
+	switch cfg.Output {
+	case "":
+		cfg.Output = filepath.Join(folder, logFile)
+	case mqd.LogStderr:
+	default:
+		cfg.Output = settings.Path(cfg.Output)
+	}
+	w, err := logging.Open(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't open log %q, logging to stderr: %v\n", cfg.Output, err)
+		cfg.Output = mqd.LogStderr
+		w, _ = logging.Open(cfg)
+	}
+	logger, logOutput = logging.New(cfg, w), w
+	slog.SetDefault(logger)
+}
+
+// closeLog flushes and closes the log output.
+func closeLog() {
+	if logOutput != nil {
+		_ = logOutput.Close()
+	}
+}
+
+// fatal logs and prints the message, and exits with code.
+func fatal(code int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logger.Error(message)
+	fmt.Fprintln(os.Stderr, message)
+	closeLog()
+	os.Exit(code)
+}
@@ -23,6 +23,20 @@ Simple usage:
     smtp-dispatcher [ start | stop | pause | continue ]
       to control the service
 
+    smtp-dispatcher [ -w ] migrate
+      to show (or with -w write) the changes needed to upgrade the
+      settings file to the current version
+
+    smtp-dispatcher queue [ list | show <id> | stats ] [ -json ]
+      to inspect the messages in the queue folders
+
+    smtp-dispatcher journal [ -recipient <addr> ] [ -since <time> ] [ -json ] ...
+      to search the delivery journal
+
+    smtp-dispatcher probe [ -json ]
+      to check the settings and folders, and that every connection
+      answers, without sending mail
+
 */
 package main
 
@@ -33,7 +47,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/golang/glog"
 	"golang.org/x/sys/windows/svc"
 
 	"jw4.us/mqd"
@@ -50,30 +63,31 @@ const (
 var (
 	settingsfile     = ".smtp-dispatcher.settings"
 	generateSettings = false
+	writeMigration   = false
 )
 
 func init() {
 	flag.BoolVar(&generateSettings, "generate", generateSettings, "generate settings file")
 	flag.BoolVar(&generateSettings, "g", generateSettings, "generate settings file (short version)")
+	flag.BoolVar(&writeMigration, "w", writeMigration, "rewrite the settings file when migrating, keeping a backup")
 }
 
 func main() {
 	pwd, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
-		glog.Fatalf("couldn't find program folder %q\n", err)
-		os.Exit(1)
+		fatal(1, "couldn't find program folder %q", err)
 	}
 	settingsfile = filepath.Join(pwd, settingsfile)
-	_ = flag.Set("log_dir", pwd)
 	flag.Parse()
+	openLog(settingsfile, pwd)
+	defer closeLog()
 
 	interactive, err := svc.IsAnInteractiveSession()
 	if err != nil {
-		glog.Fatalf("couldn't tell if we're in an interactive session: %v", err)
-		os.Exit(2)
+		fatal(2, "couldn't tell if we're in an interactive session: %v", err)
 	}
 
-	glog.Infof("starting up... interactive? %t", interactive)
+	logger.Info("starting up", "interactive", interactive)
 	if !interactive {
 		runService(svcName, false)
 		return
@@ -105,12 +119,19 @@ func main() {
 		err = controlService(svcName, svc.Pause, svc.Paused)
 	case "continue":
 		err = controlService(svcName, svc.Continue, svc.Running)
+	case "migrate":
+		err = migrate(os.Stdout, settingsfile, writeMigration)
+	case "queue":
+		err = queue(os.Stdout, settingsfile, flag.Args()[1:])
+	case "journal":
+		err = showJournal(os.Stdout, settingsfile, flag.Args()[1:])
+	case "probe":
+		err = probe(os.Stdout, settingsfile, flag.Args()[1:])
 	default:
 		usage(fmt.Sprintf("invalid command %s", cmd))
 	}
 	if err != nil {
-		glog.Fatalf("failed to %s %s: %v", cmd, svcName, err)
-		os.Exit(3)
+		fatal(3, "failed to %s %s: %v", cmd, svcName, err)
 	}
 	return
 }
@@ -119,7 +140,7 @@ func usage(message string) {
 	fmt.Fprintf(os.Stderr, "\n%s\n\n"+
 		"usage: %s <command>\n"+
 		"    where <command> is one of\n"+
-		"    install, remove, debug, start, stop, pause, or continue.\n\n"+
+		"    install, remove, debug, start, stop, pause, continue, migrate, queue, journal, or probe.\n\n"+
 		" or %s -g to generate the settings file.\n\n",
 		message, os.Args[0], os.Args[0])
 	os.Exit(8)
@@ -127,7 +148,8 @@ func usage(message string) {
 
 func generate() {
 	buf := `{
-    "interval": 47,
+    "version": 2,
+    "interval": "47s",
     "mailqueue": "c:\\mailqueue",
     "badmail": "c:\\badmail",
     "sentmail": "c:\\sentmail",
@@ -151,13 +173,12 @@ func generate() {
     }}`
 	settings, err := mqd.UnmarshalSettings([]byte(buf))
 	if err != nil {
-		glog.Fatalf("couldn't read settings %q\n", err)
-		os.Exit(9)
+		fatal(9, "couldn't read settings %q", err)
 	}
 
 	if err := mqd.WriteSettings(settingsfile, settings); err != nil {
-		glog.Fatalf("couldn't write settings %q\n", err)
-		os.Exit(10)
+		fatal(10, "couldn't write settings %q", err)
 	}
+	closeLog()
 	os.Exit(0)
 }
@@ -0,0 +1,109 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+// +build windows
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"jw4.us/mqd"
+)
+
+// migrate upgrades the settings file to the current schema version,
+// printing the changes as a diff. The file is only rewritten (after
+// taking a backup) when write is true.
+func migrate(w io.Writer, path string, write bool) error {
+	before, after, err := mqd.MigrateSettingsFile(path, write)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(before, after) {
+		fmt.Fprintf(w, "%s is up to date (version %d)\n", path, mqd.SettingsVersion)
+		return nil
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s (version %d)\n", path, path, mqd.SettingsVersion)
+	writeDiff(w, splitLines(before), splitLines(after))
+	if write {
+		fmt.Fprintf(w, "\n%s rewritten, the original was kept as a backup\n", path)
+	} else {
+		fmt.Fprintf(w, "\nrun again with -w to rewrite %s\n", path)
+	}
+	return nil
+}
+
+func splitLines(raw []byte) []string {
+	text := strings.Replace(string(raw), "\r\n", "\n", -1)
+	return strings.Split(strings.TrimRight(text, "\n"), "\n")
+}
+
+// writeDiff prints a line oriented diff of a and b in the unified
+// style, with diffContext lines of context around each change.
+func writeDiff(w io.Writer, a, b []string) {
+	const diffContext = 3
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	lines := []line{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	show := make([]bool, len(lines))
+	for ix, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for k := ix - diffContext; k <= ix+diffContext; k++ {
+			if k >= 0 && k < len(lines) {
+				show[k] = true
+			}
+		}
+	}
+	for ix, l := range lines {
+		if !show[ix] {
+			continue
+		}
+		if ix > 0 && !show[ix-1] {
+			fmt.Fprintln(w, "@@")
+		}
+		fmt.Fprintf(w, "%c%s\n", l.op, l.text)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/health"
+)
+
+// probe runs the readiness checks of the service against the settings
+// file at path, probing every connection, and prints the results.
+func probe(w io.Writer, path string, args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	checker := health.NewChecker(func() (*mqd.Settings, error) { return mqd.ReadSettings(path) }, false, logger)
+	checks := checker.Ready(true, 0)
+	if *asJSON {
+		if err := writeJSON(w, checks); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CHECK\tRESULT\tERROR")
+		for _, c := range checks {
+			outcome := "ok"
+			switch {
+			case c.Skipped:
+				outcome = "skipped"
+			case !c.OK:
+				outcome = "failed"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, outcome, c.Error)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if !health.OK(checks) {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+)
+
+// queue runs the queue list, show and stats subcommands, which
+// inspect the queue folders of the settings file at path.
+func queue(w io.Writer, path string, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: queue list|show|stats [options]")
+	}
+	settings, err := mqd.ReadSettings(path)
+	if err != nil {
+		return err
+	}
+	q := dispatcher.NewPickupFolderQueue(settings.MailQueue, settings.BadMail, settings.SentMail, dispatcher.QueueOptions{Duplicates: duplicates(settings), Log: logger})
+
+	flags := flag.NewFlagSet("queue "+args[0], flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print JSON")
+	var (
+		filter dispatcher.Filter
+		states string
+	)
+	if args[0] != "show" {
+		flags.StringVar(&states, "status", "", "comma separated states to include: queued, deferred, bad, sent, duplicate")
+		flags.StringVar(&filter.Sender, "sender", "", "include senders containing this")
+		flags.StringVar(&filter.Recipient, "recipient", "", "include recipients containing this")
+		flags.DurationVar(&filter.OlderThan, "older", 0, "include messages at least this old, e.g. 1h")
+	}
+	if err = flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	for _, state := range strings.Split(states, ",") {
+		if state = strings.TrimSpace(state); state != "" {
+			filter.States = append(filter.States, dispatcher.State(strings.ToLower(state)))
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := q.List(filter)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(w, entries)
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tAGE\tSIZE\tATTEMPTS\tSENDER\tRECIPIENTS\tSUBJECT")
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", e.ID, e.State, age(e.Age), e.Size, e.Attempts,
+				e.Sender, strings.Join(e.Recipients, ", "), e.Subject)
+		}
+		return tw.Flush()
+	case "show":
+		if flags.NArg() != 1 {
+			return errors.New("usage: queue show [-json] <id>")
+		}
+		e, err := q.Show(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return writeJSON(w, e)
+		}
+		fmt.Fprintf(w, "ID:         %s\nStatus:     %s\nPath:       %s\nAge:        %s\nSize:       %d\n",
+			e.ID, e.State, e.Path, age(e.Age), e.Size)
+		fmt.Fprintf(w, "Sender:     %s\nRecipients: %s\nSubject:    %s\nMessage-ID: %s\n",
+			e.Sender, strings.Join(e.Recipients, ", "), e.Subject, e.MessageID)
+		if e.Report != "" {
+			fmt.Fprintf(w, "\n%s", strings.Replace(e.Report, "\r\n", "\n", -1))
+		} else if e.Error != "" {
+			fmt.Fprintf(w, "Error:      %s\n", e.Error)
+		}
+		return nil
+	case "stats":
+		entries, err := q.List(filter)
+		if err != nil {
+			return err
+		}
+		stats := dispatcher.Summarize(entries)
+		if *asJSON {
+			return writeJSON(w, stats)
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATUS\tCOUNT\tSIZE\tOLDEST")
+		for _, s := range stats {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", s.State, s.Count, s.Size, age(s.Oldest))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown queue command %q", args[0])
+}
+
+// duplicates returns the duplicate suppression of settings, if any.
+func duplicates(settings *mqd.Settings) *dispatcher.Duplicates {
+	if settings.Duplicates == nil {
+		return nil
+	}
+	return &dispatcher.Duplicates{Folder: settings.Duplicates.Folder, Window: time.Duration(settings.Duplicates.Window)}
+}
+
+// retry returns the limits on retrying deferred messages of settings.
+func retry(settings *mqd.Settings) *dispatcher.Retry {
+	r := &dispatcher.Retry{MaxAge: dispatcher.DefaultRetryMaxAge}
+	if settings.Retry != nil {
+		r.MaxAttempts = settings.Retry.MaxAttempts
+		if settings.Retry.MaxAge > 0 {
+			r.MaxAge = time.Duration(settings.Retry.MaxAge)
+		}
+	}
+	return r
+}
+
+func age(seconds int64) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -9,23 +9,33 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"time"
 
-	"github.com/golang/glog"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
 
 	"jw4.us/mqd"
+	"jw4.us/mqd/api"
 	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/health"
+	"jw4.us/mqd/journal"
+	"jw4.us/mqd/logging"
 	"jw4.us/mqd/mailer"
+	"jw4.us/mqd/metrics"
+	"jw4.us/mqd/submission"
 )
 
 var elog debug.Log
 
 type service struct {
 	settingsfile string
+	// mailer is kept across passes, so that what it caches lasts
+	// until the settings change.
+	mailer   mailer.Mailer
+	settings *mqd.Settings
 }
 
 // Execute fulfills the Handler interface from winsvc.svc
@@ -36,7 +46,11 @@ func (s *service) Execute(args []string, r <-chan svc.ChangeRequest, changes cha
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
 	changes <- svc.Status{State: svc.StartPending}
 	settings := s.readSettings()
-	tick := time.NewTicker(time.Duration(settings.Interval) * time.Second)
+	tick := time.NewTicker(time.Duration(settings.Interval))
+	for _, srv := range s.startServers(settings) {
+		defer func(srv server) { _ = srv.Close() }(srv)
+	}
+	defer s.startPruner()()
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 loop:
 	for {
@@ -56,7 +70,7 @@ loop:
 				changes <- svc.Status{State: svc.Paused, Accepts: cmdsAccepted}
 			case svc.Continue:
 				settings := s.readSettings()
-				tick = time.NewTicker(time.Duration(settings.Interval) * time.Second)
+				tick = time.NewTicker(time.Duration(settings.Interval))
 				changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 			default:
 				_ = elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
@@ -69,24 +83,140 @@ loop:
 
 func (s *service) runDispatch() {
 	settings := s.readSettings()
-	q := dispatcher.NewPickupFolderQueue(settings.MailQueue, settings.BadMail, settings.SentMail)
-	m := mailer.NewMailer(settings)
-	if err := q.Process(m.ConvertAndSend); err != nil {
-		glog.Errorf("error running ConvertAndSend: %v", err)
+	var j dispatcher.Journal
+	if settings.Journal != nil {
+		cfg := *settings.Journal
+		cfg.Path = settings.Path(cfg.Path)
+		opened, err := journal.Open(cfg)
+		if err != nil {
+			// delivering without a record beats not delivering
+			logger.Error("opening journal", logging.File, cfg.Path, logging.Err(err))
+		} else {
+			defer func() { _ = opened.Close() }()
+			j = opened
+		}
+	}
+	q := dispatcher.NewPickupFolderQueue(settings.MailQueue, settings.BadMail, settings.SentMail, dispatcher.QueueOptions{
+		Duplicates: duplicates(settings),
+		Retry:      retry(settings),
+		Journal:    j,
+		Log:        logger,
+		Preamble:   settings.PickupPreamble,
+	})
+	if err := q.Process(s.mailerFor(settings).ConvertAndSend); err != nil {
+		logger.Error("scanning mailqueue", logging.File, settings.MailQueue, logging.Err(err))
 	}
-	glog.Flush()
 }
 
-func (s *service) readSettings() *mqd.Settings {
-	var settings *mqd.Settings
-	r, err := os.Open(settingsfile)
-	if err == nil {
-		settings, err = mqd.ReadSettingsFrom(r)
-		defer func() { _ = r.Close() }()
+// mailerFor returns the mailer of the service, loading settings into
+// it when they differ from the ones it has.
+func (s *service) mailerFor(settings *mqd.Settings) mailer.Mailer {
+	switch {
+	case s.mailer == nil:
+		s.mailer = mailer.NewMailer(settings, logger)
+	case reflect.DeepEqual(settings, s.settings):
+		return s.mailer
+	default:
+		if err := s.mailer.LoadSettings(settings); err != nil {
+			logger.Error("loading settings", logging.File, s.settingsfile, logging.Err(err))
+			return s.mailer
+		}
+	}
+	s.settings = settings
+	return s.mailer
+}
+
+// server is a listener run alongside the service.
+type server interface {
+	ListenAndServe() error
+	Close() error
+}
+
+// startServers starts the submission, API and metrics servers that
+// are configured. They run until the service stops, even while
+// dispatching is paused.
+func (s *service) startServers(settings *mqd.Settings) []server {
+	var servers []server
+	start := func(name string, srv server, err error) {
+		if err != nil {
+			_ = elog.Error(1, fmt.Sprintf("couldn't start %s server: %v", name, err))
+			return
+		}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				_ = elog.Error(1, fmt.Sprintf("%s server failed: %v", name, err))
+			}
+		}()
+		servers = append(servers, srv)
+	}
+	if settings.Submission != nil {
+		srv, err := submission.NewServer(settings, logger)
+		start("submission", srv, err)
 	}
+	if settings.API != nil {
+		srv, err := api.NewServer(settings, logger)
+		start("api", srv, err)
+	}
+	if settings.Metrics != nil {
+		checker := health.NewChecker(func() (*mqd.Settings, error) { return mqd.ReadSettings(s.settingsfile) }, true, logger)
+		srv, err := metrics.NewServer(settings, checker, logger)
+		start("metrics", srv, err)
+	}
+	return servers
+}
+
+// startPruner applies the retention policy to the sentmail folder in
+// the background, so pruning never holds up dispatching, until the
+// returned function is called.
+func (s *service) startPruner() (stop func()) {
+	done, finished := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			interval := mqd.DefaultPruneInterval
+			// errors reading the settings are logged by the dispatch loop
+			if settings, err := mqd.ReadSettings(s.settingsfile); err == nil && settings.Retention != nil {
+				pruneSentMail(settings)
+				if settings.Retention.Interval > 0 {
+					interval = settings.Retention.Interval
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Duration(interval)):
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+func pruneSentMail(settings *mqd.Settings) {
+	r := settings.Retention
+	result, err := dispatcher.PruneSent(settings.SentMail, dispatcher.Retention{
+		MaxAge:        time.Duration(r.MaxAge),
+		MaxSize:       r.MaxSize,
+		Compress:      r.Compress,
+		CompressAfter: time.Duration(r.CompressAfter),
+	}, time.Now())
+	if err != nil {
+		logger.Error("pruning sentmail", logging.File, settings.SentMail, logging.Err(err))
+	}
+	logger.Info("pruned sentmail", logging.File, settings.SentMail, "removed", result.Removed,
+		"compressed", result.Compressed, "kept", result.Kept, "size", result.Size)
+}
+
+func (s *service) readSettings() *mqd.Settings {
+	settings, err := mqd.ReadSettings(s.settingsfile)
 	if err != nil {
-		glog.Errorf("couldn't read settings: %v", err)
+		logger.Error("couldn't read settings", logging.File, s.settingsfile, logging.Err(err))
 		settings = mqd.NewSettings("", "")
+	} else if settings.MigratedFrom() < mqd.SettingsVersion {
+		logger.Warn("settings file is out of date, run migrate to upgrade it", logging.File, s.settingsfile,
+			"version", settings.MigratedFrom(), "current", mqd.SettingsVersion)
 	}
 	return settings
 }
@@ -98,8 +228,7 @@ func runService(name string, isDebug bool) {
 	} else {
 		elog, err = eventlog.Open(name)
 		if err != nil {
-			glog.Fatalf("couldn't open eventlog: %v", err)
-			return
+			fatal(4, "couldn't open eventlog: %v", err)
 		}
 	}
 	defer func() { _ = elog.Close() }()
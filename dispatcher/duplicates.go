@@ -0,0 +1,200 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"jw4.us/mqd/logging"
+)
+
+// SeenFile is the name of the file, in the duplicates folder, that
+// holds the keys of the messages that were sent.
+const SeenFile = ".seen"
+
+// DefaultDuplicateWindow is how long sent messages are remembered
+// unless configured otherwise.
+const DefaultDuplicateWindow = 24 * time.Hour
+
+// Duplicates describes how messages that were already sent are
+// recognized. A message is a duplicate when one with the same
+// Message-ID, or the same content if it has none, was sent to the same
+// envelope recipients within the Window. Duplicates are moved to the
+// Folder with a report naming the original, rather than sent again.
+type Duplicates struct {
+	Folder string
+	Window time.Duration
+}
+
+// sent is a message remembered in the seen file.
+type sent struct {
+	at time.Time
+	id string
+}
+
+// seenStore holds the keys of the messages sent within the window. Each
+// key is appended to the seen file, and synced, before the message is
+// moved out of the mailqueue, so that a crash in between can't cause
+// it to be sent again.
+type seenStore struct {
+	path string
+	keys map[string]sent
+}
+
+// loadSeen reads the seen file at path, forgetting keys older than
+// window. The file is rewritten without them when they make up most
+// of it.
+func loadSeen(path string, window time.Duration, now time.Time) (*seenStore, error) {
+	s := &seenStore{path: path, keys: map[string]sent{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	expired := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the id comes last, as it may hold spaces
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		unix, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		at := time.Unix(unix, 0)
+		if now.Sub(at) > window {
+			expired++
+			continue
+		}
+		s.keys[fields[1]] = sent{at: at, id: fields[2]}
+	}
+	err = scanner.Err()
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if expired > len(s.keys) {
+		if err = s.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// compact rewrites the seen file with only the keys remembered.
+func (s *seenStore) compact() error {
+	buf := &bytes.Buffer{}
+	for key, m := range s.keys {
+		fmt.Fprintf(buf, "%d %s %s\n", m.at.Unix(), key, m.id)
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// add remembers that the message id with key was sent at.
+func (s *seenStore) add(key string, id string, at time.Time) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %s %s\n", at.Unix(), key, id)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	s.keys[key] = sent{at: at, id: id}
+	return nil
+}
+
+// duplicateKey identifies a message for duplicate suppression: by its
+// Message-ID, or else its content, and its envelope recipients.
+func duplicateKey(raw []byte, env *Envelope) string {
+	h := sha256.New()
+	var messageID string
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		messageID = strings.TrimSpace(msg.Header.Get("Message-ID"))
+	}
+	if messageID != "" {
+		fmt.Fprintf(h, "id:%s\n", messageID)
+	} else {
+		fmt.Fprintf(h, "content:%x\n", sha256.Sum256(raw))
+	}
+	if env != nil && len(env.Recipients) > 0 {
+		recipients := make([]string, len(env.Recipients))
+		for ix, rcpt := range env.Recipients {
+			recipients[ix] = strings.ToLower(strings.TrimSpace(rcpt))
+		}
+		sort.Strings(recipients)
+		fmt.Fprintf(h, "to:%s\n", strings.Join(recipients, ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadDuplicates loads the seen file for a pass over the mailqueue.
+// Without it duplicates aren't suppressed, but mail still flows.
+func (q *folderQueue) loadDuplicates() {
+	q.seen = nil
+	if q.duplicates == nil {
+		return
+	}
+	window := q.duplicates.Window
+	if window <= 0 {
+		window = DefaultDuplicateWindow
+	}
+	err := os.MkdirAll(q.duplicates.Folder, 0755)
+	var seen *seenStore
+	if err == nil {
+		seen, err = loadSeen(filepath.Join(q.duplicates.Folder, SeenFile), window, time.Now())
+	}
+	if err != nil {
+		q.log.Error("loading sent message keys, not suppressing duplicates", logging.File, q.duplicates.Folder, logging.Err(err))
+		return
+	}
+	q.seen = seen
+}
+
+// markDuplicate moves a message that was already sent to the
+// duplicates folder, with a report naming the original.
+func (q *folderQueue) markDuplicate(path string, info os.FileInfo, original sent) {
+	report := Report{
+		Result: Duplicate,
+		Error:  fmt.Sprintf("duplicate of %s, sent %s", original.id, original.at.Format(time.RFC3339)),
+	}
+	q.log.Warn("moving duplicate", logging.File, path, "original", original.id)
+	target := filepath.Join(q.duplicates.Folder, info.Name())
+	if err := os.Rename(path, target); err != nil {
+		q.log.Error("moving message", logging.File, path, "target", target, logging.Err(err))
+		return
+	}
+	q.moveEnvelope(path, target)
+	q.removeReport(path)
+	if err := writeReport(target+ReportSuffix, report); err != nil {
+		q.log.Error("writing report", logging.File, target, logging.Err(err))
+	}
+}
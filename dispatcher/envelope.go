@@ -0,0 +1,202 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// EnvelopeSuffix is appended to the name of a message file to name
+// its optional envelope companion file. Producers must write the
+// envelope file before the message, since the message is picked up
+// as soon as it appears. Files ending in EnvelopeSuffix or
+// ReportSuffix are never taken for messages, and are removed once
+// they are OrphanAge old without their message.
+const EnvelopeSuffix = ".env"
+
+// Envelope carries delivery instructions for a message that take
+// precedence over what would be inferred from its headers. It is read
+// from a JSON companion file, e.g.
+//
+//     {"sender": "app@example.com", "recipients": ["bob@example.com"],
+//      "connection": "bulk@example.com", "priority": 1}
+//
+// or, when the queue reads them, from an IIS style preamble of
+// "x-sender:" and "x-receiver:" lines at the very top of the message
+// file.
+type Envelope struct {
+	// Sender is the MAIL FROM address, where bounces go, and picks
+	// the connection unless Connection is given. "<>" is the null
+	// reverse path. Without it the connection's account is used.
+	Sender string `json:"sender,omitempty"`
+	// Recipients are the RCPT TO addresses. When empty the
+	// recipients are taken from the message headers.
+	Recipients []string `json:"recipients,omitempty"`
+	// Connection is the key of the connection to use, overriding the
+	// one found for Sender.
+	Connection string `json:"connection,omitempty"`
+	// Priority uses the X-Priority scale: 1 is the highest and 5 the
+	// lowest. Zero means normal.
+	Priority int `json:"priority,omitempty"`
+	// MessageID is the Message-ID generated for a message without
+	// one on its first attempt. The dispatcher sets it from the
+	// report of a deferred message so that retries keep the ID.
+	MessageID string `json:"message_id,omitempty"`
+	// Preamble holds the x-sender and x-receiver lines of an IIS style
+	// pickup preamble, which the mailer reads as the X-Sender and
+	// X-Receiver headers they were: they pick the connection and add
+	// recipients, but don't change the MAIL FROM address.
+	Preamble mail.Header `json:"preamble,omitempty"`
+}
+
+// Empty reports whether the Envelope carries no instructions.
+func (e *Envelope) Empty() bool {
+	return e == nil || (e.Sender == "" && len(e.Recipients) == 0 && e.Connection == "" && e.Priority == 0 && e.MessageID == "" && len(e.Preamble) == 0)
+}
+
+// merge fills the fields of e that are unset from other.
+func (e *Envelope) merge(other *Envelope) {
+	if other == nil {
+		return
+	}
+	if e.Sender == "" {
+		e.Sender = other.Sender
+	}
+	if len(e.Recipients) == 0 {
+		e.Recipients = other.Recipients
+	}
+	if e.Connection == "" {
+		e.Connection = other.Connection
+	}
+	if e.Priority == 0 {
+		e.Priority = other.Priority
+	}
+	if e.MessageID == "" {
+		e.MessageID = other.MessageID
+	}
+	if len(e.Preamble) == 0 {
+		e.Preamble = other.Preamble
+	}
+}
+
+// narrow returns a copy of e, which may be nil, for just the given
+// recipients.
+func (e *Envelope) narrow(recipients []string) *Envelope {
+	n := &Envelope{}
+	if e != nil {
+		*n = *e
+	}
+	n.Recipients = recipients
+	return n
+}
+
+func writeEnvelope(path string, env *Envelope) error {
+	raw, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, raw, 0644)
+}
+
+func readEnvelope(path string) (*Envelope, error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{}
+	if err = json.Unmarshal(raw, env); err != nil {
+		return nil, fmt.Errorf("envelope %q: %v", path, err)
+	}
+	if env.Priority < 0 || env.Priority > 5 {
+		return nil, fmt.Errorf("envelope %q: priority %d out of range 1-5", path, env.Priority)
+	}
+	return env, nil
+}
+
+// ParsePreamble reads an IIS style pickup preamble of "x-sender:" and
+// "x-receiver:" lines from the top of message, returning an envelope
+// holding them as its Preamble and the message with the preamble
+// removed. Messages without a preamble are returned unchanged with a
+// nil Envelope.
+func ParsePreamble(message []byte) (*Envelope, []byte) {
+	var env *Envelope
+	rest := message
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			break
+		}
+		line := strings.TrimRight(string(rest[:end]), "\r")
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			break
+		}
+		key := textproto.CanonicalMIMEHeaderKey(line[:colon])
+		if key != "X-Sender" && key != "X-Receiver" {
+			break
+		}
+		if env == nil {
+			env = &Envelope{Preamble: mail.Header{}}
+		}
+		env.Preamble[key] = append(env.Preamble[key], strings.TrimSpace(line[colon+1:]))
+		rest = rest[end+1:]
+	}
+	return env, rest
+}
+
+// incoming is the folder, inside the mailqueue, that Enqueue writes
+// files in before moving them into place. The dispatcher doesn't look
+// in folders of the mailqueue.
+const incoming = ".incoming"
+
+// queueCount keeps the names of enqueued messages unique within the
+// process.
+var queueCount int64
+
+// Enqueue writes message, and env if it is not empty, into the
+// mailqueue folder, returning the name of the new message file. Both
+// files are written elsewhere first and then moved into place, the
+// envelope first, so the dispatcher never sees a partial message.
+func Enqueue(mailqueue string, env *Envelope, message []byte) (string, error) {
+	tmp := filepath.Join(mailqueue, incoming)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%d-%d.eml", time.Now().UTC().Format("20060102T150405"), os.Getpid(), atomic.AddInt64(&queueCount, 1))
+
+	place := func(name string, content []byte) error {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), content, 0644); err != nil {
+			return err
+		}
+		return os.Rename(filepath.Join(tmp, name), filepath.Join(mailqueue, name))
+	}
+	if !env.Empty() {
+		raw, err := json.Marshal(env)
+		if err != nil {
+			return "", err
+		}
+		if err = place(name+EnvelopeSuffix, raw); err != nil {
+			return "", err
+		}
+	}
+	if err := place(name, message); err != nil {
+		_ = os.Remove(filepath.Join(mailqueue, name+EnvelopeSuffix))
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,280 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a message in one of the queue folders.
+type Entry struct {
+	// ID is the name of the message in the mailqueue; the name of
+	// its file in the badmail folder.
+	ID    string `json:"id"`
+	State State  `json:"status"`
+	Path  string `json:"path"`
+	// Sender and Recipients come from the envelope, or else the
+	// headers of the message.
+	Sender     string   `json:"sender,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	MessageID  string   `json:"message_id,omitempty"`
+	Size       int64    `json:"size"`
+	// Time is when the message got into its folder, and Age how long
+	// ago that was, in whole seconds.
+	Time time.Time `json:"time"`
+	Age  int64     `json:"age"`
+	// Attempts and Error come from the Report of the last attempt.
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Report is only filled in by Show.
+	Report string `json:"report,omitempty"`
+}
+
+// Filter selects queue entries. Its zero value selects them all.
+type Filter struct {
+	// States lists the states to include.
+	States []State
+	// Sender and Recipient match substrings, ignoring case.
+	Sender    string
+	Recipient string
+	// OlderThan selects entries that have been in their folder at
+	// least that long.
+	OlderThan time.Duration
+}
+
+// Match reports whether the entry passes the filter.
+func (f Filter) Match(e Entry) bool {
+	if len(f.States) > 0 {
+		found := false
+		for _, state := range f.States {
+			found = found || state == e.State
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Sender != "" && !strings.Contains(strings.ToLower(e.Sender), strings.ToLower(f.Sender)) {
+		return false
+	}
+	if f.Recipient != "" {
+		found := false
+		for _, rcpt := range e.Recipients {
+			found = found || strings.Contains(strings.ToLower(rcpt), strings.ToLower(f.Recipient))
+		}
+		if !found {
+			return false
+		}
+	}
+	return time.Duration(e.Age)*time.Second >= f.OlderThan
+}
+
+// List implements the MailQueueDispatcher interface
+func (q *folderQueue) List(filter Filter) ([]Entry, error) {
+	now := time.Now()
+	var entries []Entry
+	for _, folder := range []struct {
+		path  string
+		state State
+	}{{q.mailqueue, StateQueued}, {q.badmail, StateBad}, {q.sentmail, StateSent}, {q.duplicatesFolder(), StateDuplicate}} {
+		if folder.path == "" {
+			continue
+		}
+		if folder.state == StateSent {
+			err := walkSent(folder.path, func(path string, info os.FileInfo) {
+				if e := inspect(path, info, StateSent, now, false); filter.Match(e) {
+					entries = append(entries, e)
+				}
+			})
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		paths := []string{folder.path}
+		if folder.state == StateQueued {
+			paths = append(paths, filepath.Join(folder.path, HighFolder), filepath.Join(folder.path, LowFolder))
+		}
+		for ix, path := range paths {
+			infos, err := ioutil.ReadDir(path)
+			if ix > 0 && os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range infos {
+				name := info.Name()
+				if info.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, EnvelopeSuffix) || strings.HasSuffix(name, ReportSuffix) {
+					continue
+				}
+				e := inspect(filepath.Join(path, name), info, folder.state, now, false)
+				if filter.Match(e) {
+					entries = append(entries, e)
+				}
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, nil
+}
+
+// Show implements the MailQueueDispatcher interface
+func (q *folderQueue) Show(id string) (*Entry, error) {
+	path, state, err := q.locate(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	e := inspect(path, info, state, time.Now(), true)
+	return &e, nil
+}
+
+// inspect reads the Entry for the message file at path, which is in
+// the folder of the given state. Problems reading the message are
+// reported in the Error of the Entry.
+func inspect(path string, info os.FileInfo, state State, now time.Time, withReport bool) Entry {
+	e := Entry{
+		ID:    info.Name(),
+		State: state,
+		Path:  path,
+		Size:  info.Size(),
+		Time:  info.ModTime(),
+		Age:   int64(now.Sub(info.ModTime()) / time.Second),
+	}
+	if state == StateSent {
+		e.ID = sentID(e.ID)
+	}
+
+	if raw, err := ioutil.ReadFile(sentBase(path) + ReportSuffix); err == nil {
+		report := parseReport(raw)
+		e.Attempts, e.Error, e.MessageID = report.Attempts, report.Error, report.MessageID
+		if state == StateQueued {
+			e.State = StateDeferred
+		}
+		if withReport {
+			e.Report = string(raw)
+		}
+	}
+
+	env, err := readEnvelope(sentBase(path) + EnvelopeSuffix)
+	if err != nil && e.Error == "" {
+		e.Error = err.Error()
+	}
+	header, err := readHeader(path)
+	if err != nil && e.Error == "" {
+		e.Error = err.Error()
+	}
+	if env == nil {
+		env = &Envelope{}
+	}
+	if header != nil {
+		// IIS style preambles read as header fields
+		env.merge(&Envelope{Sender: header.Get("X-Sender"), Recipients: header["X-Receiver"]})
+		env.merge(&Envelope{Sender: firstAddress(header.Get("From"))})
+		var recipients []string
+		for _, key := range []string{"To", "Cc", "Bcc"} {
+			recipients = append(recipients, addresses(header.Get(key))...)
+		}
+		env.merge(&Envelope{Recipients: recipients})
+
+		e.Subject = decodeSubject(header)
+		if e.MessageID == "" {
+			e.MessageID = header.Get("Message-ID")
+		}
+	}
+	e.Sender, e.Recipients = env.Sender, env.Recipients
+	return e
+}
+
+// decodeSubject returns the Subject of header, with encoded words
+// decoded when they can be.
+func decodeSubject(header mail.Header) string {
+	dec := &mime.WordDecoder{}
+	subject, err := dec.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		return header.Get("Subject")
+	}
+	return subject
+}
+
+// readHeader reads the header of the message file at path.
+func readHeader(path string) (mail.Header, error) {
+	f, err := openMessage(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	msg, err := mail.ReadMessage(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+func firstAddress(value string) string {
+	if list := addresses(value); len(list) > 0 {
+		return list[0]
+	}
+	return ""
+}
+
+// addresses returns the addresses in a header value, or the value
+// itself when it doesn't parse.
+func addresses(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []string{value}
+	}
+	result := make([]string, len(list))
+	for ix, addr := range list {
+		result[ix] = addr.Address
+	}
+	return result
+}
+
+// Stats summarizes the entries in one state.
+type Stats struct {
+	State State `json:"status"`
+	Count int   `json:"count"`
+	Size  int64 `json:"size"`
+	// Oldest is the Age of the oldest entry.
+	Oldest int64 `json:"oldest"`
+}
+
+// Summarize returns the Stats of entries for each state, in the
+// order queued, deferred, bad, sent, duplicate.
+func Summarize(entries []Entry) []Stats {
+	stats := []Stats{{State: StateQueued}, {State: StateDeferred}, {State: StateBad}, {State: StateSent}, {State: StateDuplicate}}
+	for _, e := range entries {
+		for ix := range stats {
+			s := &stats[ix]
+			if s.State != e.State {
+				continue
+			}
+			s.Count++
+			s.Size += e.Size
+			if e.Age > s.Oldest {
+				s.Oldest = e.Age
+			}
+		}
+	}
+	return stats
+}
@@ -4,13 +4,223 @@
 
 package dispatcher // import "jw4.us/mqd/dispatcher"
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Result tells the dispatcher what to do with a message once the
+// MailQueueCallbackFn has handled it.
+type Result int
+
+// Results
+const (
+	// Failed messages are moved to the badmail folder.
+	Failed Result = iota
+	// Sent messages are removed, or moved to the sentmail folder.
+	Sent
+	// Deferred messages are left in the mailqueue to be tried again
+	// on a later pass.
+	Deferred
+	// Duplicate messages were sent before, and are moved to the
+	// duplicates folder without being sent again.
+	Duplicate
+)
+
+// String fulfills the fmt.Stringer interface
+func (r Result) String() string {
+	switch r {
+	case Failed:
+		return "failed"
+	case Sent:
+		return "sent"
+	case Deferred:
+		return "deferred"
+	case Duplicate:
+		return "duplicate"
+	}
+	return fmt.Sprintf("Result(%d)", int(r))
+}
+
+// Report describes what happened to a message. Reports for failed
+// messages are saved next to them in the badmail folder.
+type Report struct {
+	Result Result
+	// MessageID is the Message-ID the message was, or would have
+	// been, sent with.
+	MessageID  string
+	Sender     string
+	Recipients []string
+	// Connection is the key of the connection the message was handed
+	// to, if it got that far.
+	Connection string
+	// Dropped lists recipient entries that could not be parsed and
+	// were left out.
+	Dropped []string
+	// Deliveries holds the outcome for each recipient when they
+	// differ. Recipients that Failed are bounced to the badmail folder
+	// and Deferred ones are tried again, without sending the message
+	// again to the ones it was Sent to.
+	Deliveries []Delivery
+	// Error explains why the message failed or was deferred.
+	Error string
+	// Attempts counts the passes that tried to send the message,
+	// this one included.
+	Attempts int
+	// Held is set when the message was Deferred without trying to
+	// send it, for quiet hours, a send window or a rate limit. Such
+	// passes are not attempts. It is not saved with the report.
+	Held bool
+}
+
+// Delivery is the outcome of a message for one recipient.
+type Delivery struct {
+	Recipient string
+	Result    Result
+	Error     string
+}
+
+// String fulfills the fmt.Stringer interface
+func (d Delivery) String() string {
+	if d.Error == "" {
+		return fmt.Sprintf("%s %s", d.Recipient, d.Result)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Recipient, d.Result, d.Error)
+}
+
+// recipients returns the recipients of the Deliveries with result r.
+func (r Report) recipients(result Result) []string {
+	var list []string
+	for _, d := range r.Deliveries {
+		if d.Result == result {
+			list = append(list, d.Recipient)
+		}
+	}
+	return list
+}
+
+// only returns a copy of the Report narrowed to the recipients with
+// the given result.
+func (r Report) only(result Result) Report {
+	r.Result = result
+	r.Recipients = r.recipients(result)
+	var deliveries []Delivery
+	for _, d := range r.Deliveries {
+		if d.Result == result {
+			deliveries = append(deliveries, d)
+		}
+	}
+	r.Deliveries = deliveries
+	return r
+}
+
+// Fail marks the Report as Failed because of err, and returns it.
+func (r Report) Fail(err error) Report {
+	r.Result = Failed
+	r.Error = err.Error()
+	return r
+}
+
+// Defer marks the Report as Deferred because of err, and returns it.
+func (r Report) Defer(err error) Report {
+	r.Result = Deferred
+	r.Error = err.Error()
+	return r
+}
+
+// WriteTo fulfills the io.WriterTo interface, writing the Report as
+// header style "Name: value" lines.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Result: %s\r\n", r.Result)
+	if r.MessageID != "" {
+		fmt.Fprintf(buf, "Message-ID: %s\r\n", r.MessageID)
+	}
+	if r.Sender != "" {
+		fmt.Fprintf(buf, "Sender: %s\r\n", r.Sender)
+	}
+	if r.Connection != "" {
+		fmt.Fprintf(buf, "Connection: %s\r\n", r.Connection)
+	}
+	if len(r.Recipients) > 0 {
+		fmt.Fprintf(buf, "Recipients: %s\r\n", strings.Join(r.Recipients, ", "))
+	}
+	if len(r.Dropped) > 0 {
+		fmt.Fprintf(buf, "Dropped: %s\r\n", strings.Join(r.Dropped, ", "))
+	}
+	for _, d := range r.Deliveries {
+		fmt.Fprintf(buf, "Delivery: %s\r\n", d)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(buf, "Error: %s\r\n", r.Error)
+	}
+	if r.Attempts > 0 {
+		fmt.Fprintf(buf, "Attempts: %d\r\n", r.Attempts)
+	}
+	return buf.WriteTo(w)
+}
+
+// parseReport reads back the fields of a Report written by WriteTo
+// that describe the message as a whole; Deliveries are left out.
+func parseReport(raw []byte) Report {
+	var r Report
+	for _, line := range strings.Split(string(raw), "\n") {
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimRight(line[colon+2:], "\r")
+		switch line[:colon] {
+		case "Result":
+			for _, result := range []Result{Failed, Sent, Deferred, Duplicate} {
+				if value == result.String() {
+					r.Result = result
+				}
+			}
+		case "Message-ID":
+			r.MessageID = value
+		case "Sender":
+			r.Sender = value
+		case "Connection":
+			r.Connection = value
+		case "Recipients":
+			r.Recipients = strings.Split(value, ", ")
+		case "Dropped":
+			r.Dropped = strings.Split(value, ", ")
+		case "Error":
+			r.Error = value
+		case "Attempts":
+			r.Attempts, _ = strconv.Atoi(value)
+		}
+	}
+	return r
+}
+
 // MailQueueCallbackFn describes the callback mechanism the dispatcher
 // uses to transmit raw bytes representing an email to the mailer to
-// actually send.
-type MailQueueCallbackFn func([]byte) bool
+// actually send, along with its Envelope if it has one.
+type MailQueueCallbackFn func([]byte, *Envelope) Report
+
+// Journal records every attempt to process a message: id is the name
+// of its file in the mailqueue, and the Report is the outcome of the
+// attempt, with its Result what became of the message.
+type Journal interface {
+	Record(id string, subject string, report Report) error
+}
 
 // MailQueueDispatcher describes the interface a dispatcher must
 // fulfill in order to use the MailQueueCallbackFn
 type MailQueueDispatcher interface {
 	Process(MailQueueCallbackFn) error
+	// Status looks up a message by the name of its file in the
+	// mailqueue.
+	Status(name string) (*MessageStatus, error)
+	// List returns the messages in the queue folders that match
+	// filter, oldest first.
+	List(filter Filter) ([]Entry, error)
+	// Show returns the message with the given ID, with its Report.
+	Show(id string) (*Entry, error)
 }
@@ -9,40 +9,105 @@
 package dispatcher // import "jw4.us/mqd/dispatcher"
 
 import (
+	"bytes"
 	"io/ioutil"
+	"log/slog"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"jw4.us/mqd/logging"
 )
 
+// ReportSuffix is appended to the name of a message in the badmail
+// folder to name the file holding its Report. Deferred messages keep
+// their latest Report next to them in the mailqueue.
+const ReportSuffix = ".report"
+
 type folderQueue struct {
-	mailqueue string
-	badmail   string
-	sentmail  string
+	mailqueue  string
+	badmail    string
+	sentmail   string
+	duplicates *Duplicates
+	retry      *Retry
+	journal    Journal
+	log        *slog.Logger
+	preamble   bool
+	// seen is loaded at the start of each pass.
+	seen *seenStore
+}
+
+// QueueOptions are the optional parts of a folder queue.
+type QueueOptions struct {
+	// Duplicates, if set, sets aside messages that were sent before
+	// instead of sending them again.
+	Duplicates *Duplicates
+	// Retry, if set, bounces deferred messages once they were tried
+	// too often or for too long.
+	Retry *Retry
+	// Journal, if set, records every attempt.
+	Journal Journal
+	// Log is where progress is logged. Defaults to the default
+	// logger.
+	Log *slog.Logger
+	// Preamble reads IIS style pickup preambles at the top of the
+	// messages, see ParsePreamble. Otherwise their lines are left
+	// as headers.
+	Preamble bool
 }
 
 // NewPickupFolderQueue returns an implementation of MailQueueDispatcher
 // that watches a mailqueue folder and consumes messages that are left
 // there and if it fails to consume the message, moves the message to a
 // badmail folder. If sentmail is a valid folder, successful emails will
-// be moved there after sending.
-func NewPickupFolderQueue(mailqueue string, badmail string, sentmail string) MailQueueDispatcher {
-	return &folderQueue{mailqueue: mailqueue, badmail: badmail, sentmail: sentmail}
+// be moved there after sending. The rest is adjusted by opts.
+func NewPickupFolderQueue(mailqueue string, badmail string, sentmail string, opts QueueOptions) MailQueueDispatcher {
+	return &folderQueue{
+		mailqueue:  mailqueue,
+		badmail:    badmail,
+		sentmail:   sentmail,
+		duplicates: opts.Duplicates,
+		retry:      opts.Retry,
+		journal:    opts.Journal,
+		log:        logging.Or(opts.Log),
+		preamble:   opts.Preamble,
+	}
 }
 
-// Process implements the MailQueueDispatcher interface, and walks the
-// mailqueue folder and sends the found messages to the callbackFn.
+func (q *folderQueue) duplicatesFolder() string {
+	if q.duplicates == nil {
+		return ""
+	}
+	return q.duplicates.Folder
+}
+
+// Process implements the MailQueueDispatcher interface, and sends the
+// messages in the mailqueue folder and its priority folders to the
+// callbackFn, high priority first and then oldest first.
 func (q *folderQueue) Process(callbackFn MailQueueCallbackFn) error {
-	return filepath.Walk(q.mailqueue, q.processItem(callbackFn))
+	q.loadDuplicates()
+	q.removeOrphans(time.Now())
+	// as when the mailqueue was walked, a folder that can't be read
+	// is logged and the scan still counts as complete
+	items, err := pending(q.mailqueue)
+	if err != nil {
+		q.log.Warn("reading mailqueue", logging.File, q.mailqueue, logging.Err(err))
+	}
+	process := q.processItem(callbackFn)
+	for _, item := range items {
+		_ = process(item.path, item.info, nil)
+	}
+	observeScan(nil)
+	return nil
 }
 
 func (q *folderQueue) processItem(fn MailQueueCallbackFn) filepath.WalkFunc {
 	return func(path string, info os.FileInfo, err2 error) error {
-		glog.V(2).Infof("processing %q", path)
+		q.log.Debug("processing", logging.File, path)
 		if info == nil {
-			glog.Warningf("path not found for %q", path)
+			q.log.Warn("path not found", logging.File, path, logging.Err(err2))
 			return nil
 		}
 		if info.IsDir() {
@@ -51,37 +116,296 @@ func (q *folderQueue) processItem(fn MailQueueCallbackFn) filepath.WalkFunc {
 			}
 			return filepath.SkipDir
 		}
+		if strings.HasSuffix(path, EnvelopeSuffix) || strings.HasSuffix(path, ReportSuffix) {
+			return nil
+		}
 
 		raw, err := ioutil.ReadFile(path)
 		if err != nil {
-			q.markBad(path, info)
+			q.markBad(path, info, Report{Error: err.Error()})
 			return nil
 		}
+		env, err := readEnvelope(path + EnvelopeSuffix)
+		if err != nil {
+			q.markBad(path, info, Report{Error: err.Error()})
+			return nil
+		}
+		if q.preamble {
+			var preamble *Envelope
+			if preamble, raw = ParsePreamble(raw); env == nil {
+				env = preamble
+			} else {
+				env.merge(preamble)
+			}
+		}
 
-		if fn(raw) {
-			q.markComplete(path, info)
-		} else {
-			q.markBad(path, info)
+		key := duplicateKey(raw, env)
+		if q.seen != nil {
+			if original, ok := q.seen.keys[key]; ok {
+				q.record(info.Name(), raw, Report{Result: Duplicate, Attempts: previousReport(path).Attempts,
+					Error: "duplicate of " + original.id})
+				processedTotal.WithLabelValues(Duplicate.String()).Inc()
+				q.markDuplicate(path, info, original)
+				return nil
+			}
+		}
+
+		previous := previousReport(path)
+		if previous.MessageID != "" {
+			if env == nil {
+				env = &Envelope{}
+			}
+			if env.MessageID == "" {
+				env.MessageID = previous.MessageID
+			}
+		}
+		// the folder priority goes with the message, so that it's held
+		// the same way it was ordered
+		if priority := q.folderPriority(path); priority != 0 {
+			if env == nil {
+				env = &Envelope{}
+			}
+			if env.Priority == 0 {
+				env.Priority = priority
+			}
+		}
+		report := fn(raw, env)
+		if report.Held {
+			q.hold(path, previous, report)
+			return nil
+		}
+		report.Attempts = previous.Attempts + 1
+		attempt := report
+		if len(report.Deliveries) > 0 {
+			report = q.splitDeliveries(path, info, raw, env, report)
+		}
+		if report.Result == Deferred {
+			if reason := q.retry.expired(report.Attempts, info.ModTime(), time.Now()); reason != "" {
+				report = report.giveUp(reason)
+				attempt = attempt.giveUp(reason)
+			}
+		}
+		attempt.Result = report.Result
+		q.record(info.Name(), raw, attempt)
+		processedTotal.WithLabelValues(report.Result.String()).Inc()
+		switch report.Result {
+		case Sent:
+			if q.seen != nil {
+				if err := q.seen.add(key, info.Name(), time.Now()); err != nil {
+					q.log.Error("remembering sent message", logging.File, path, logging.Err(err))
+				}
+			}
+			q.markComplete(path, info, report)
+		case Deferred:
+			q.log.Info("deferred", logging.File, path, logging.MessageID, report.MessageID,
+				"attempts", report.Attempts, logging.Error, report.Error)
+			if err := writeReport(path+ReportSuffix, report); err != nil {
+				q.log.Error("writing report", logging.File, path, logging.Err(err))
+			}
+		default:
+			q.markBad(path, info, report)
 		}
 		return nil
 	}
 }
 
-func (q *folderQueue) markBad(path string, info os.FileInfo) {
-	glog.Errorf("processing %q was unsuccessful", path)
+// hold leaves a message that was not tried in the mailqueue. Its
+// report keeps the attempts, and Message-ID, of the previous one.
+func (q *folderQueue) hold(path string, previous, report Report) {
+	report.Result, report.Attempts = Deferred, previous.Attempts
+	if previous.MessageID != "" {
+		report.MessageID = previous.MessageID
+	}
+	processedTotal.WithLabelValues(Deferred.String()).Inc()
+	q.log.Debug("held", logging.File, path, logging.MessageID, report.MessageID, logging.Error, report.Error)
+	if err := writeReport(path+ReportSuffix, report); err != nil {
+		q.log.Error("writing report", logging.File, path, logging.Err(err))
+	}
+}
+
+// record adds the attempt to the journal.
+func (q *folderQueue) record(id string, raw []byte, report Report) {
+	if q.journal == nil {
+		return
+	}
+	var subject string
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		subject = decodeSubject(msg.Header)
+	}
+	if err := q.journal.Record(id, subject, report); err != nil {
+		q.log.Error("writing journal", logging.File, id, logging.MessageID, report.MessageID, logging.Err(err))
+	}
+}
+
+func (q *folderQueue) markBad(path string, info os.FileInfo, report Report) {
+	q.log.Error("moving to badmail", logging.File, path, logging.MessageID, report.MessageID,
+		logging.Error, report.Error)
 	target := filepath.Join(q.badmail, info.Name())
 	if err := os.Rename(path, target); err != nil {
-		glog.Errorf("moving %q to %q: %q", path, target, err)
+		q.log.Error("moving message", logging.File, path, "target", target, logging.Err(err))
+		return
+	}
+	q.moveEnvelope(path, target)
+	q.removeReport(path)
+	report.Result = Failed
+	if err := writeReport(target+ReportSuffix, report); err != nil {
+		q.log.Error("writing report", logging.File, target, logging.Err(err))
 	}
 }
 
-func (q *folderQueue) markComplete(path string, info os.FileInfo) {
+// splitDeliveries handles a message whose recipients had different
+// outcomes. Failed recipients are bounced with a copy of the message
+// in the badmail folder, and while some are Deferred the message stays
+// in the mailqueue with its envelope narrowed to them. It returns the
+// Report for what is left to do with the message itself.
+func (q *folderQueue) splitDeliveries(path string, info os.FileInfo, raw []byte, env *Envelope, report Report) Report {
+	failed, deferred := report.recipients(Failed), report.recipients(Deferred)
+	if len(failed) == len(report.Deliveries) {
+		return report.only(Failed)
+	}
+	if len(failed) > 0 {
+		q.bounce(info, raw, env.narrow(failed), report.only(Failed))
+	}
+	if len(deferred) > 0 {
+		if err := writeEnvelope(path+EnvelopeSuffix, env.narrow(deferred)); err != nil {
+			// retrying without the narrowed envelope would send the
+			// message again to everyone
+			q.log.Error("narrowing envelope", logging.File, path, logging.MessageID, report.MessageID, logging.Err(err))
+			return report.only(Deferred).Fail(err)
+		}
+		q.log.Info("retrying recipients later", logging.File, path, logging.MessageID, report.MessageID,
+			logging.Recipients, len(deferred))
+		return report.only(Deferred)
+	}
+	return report.only(Sent)
+}
+
+// bounce saves a copy of a message in the badmail folder for the
+// recipients in env, with the report saying why they failed.
+func (q *folderQueue) bounce(info os.FileInfo, raw []byte, env *Envelope, report Report) {
+	target := filepath.Join(q.badmail, time.Now().Format(timestampPrefix)+info.Name())
+	q.log.Error("bouncing recipients", logging.File, target, logging.MessageID, report.MessageID,
+		logging.Recipients, len(env.Recipients))
+	if err := writeEnvelope(target+EnvelopeSuffix, env); err != nil {
+		q.log.Error("writing envelope", logging.File, target, logging.Err(err))
+	}
+	if err := ioutil.WriteFile(target, raw, 0644); err != nil {
+		q.log.Error("writing message", logging.File, target, logging.Err(err))
+		return
+	}
+	if err := writeReport(target+ReportSuffix, report); err != nil {
+		q.log.Error("writing report", logging.File, target, logging.Err(err))
+	}
+}
+
+func writeReport(path string, report Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = report.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// markComplete moves a sent message to the sentmail folder, or removes
+// it. Its report is kept next to it when recipient entries were
+// dropped, so that they are not forgotten.
+func (q *folderQueue) markComplete(path string, info os.FileInfo, report Report) {
 	if sm, err := os.Stat(q.sentmail); err == nil && sm.IsDir() {
-		target := filepath.Join(q.sentmail, time.Now().Format("2006-01-02_150405-")+info.Name()+".sent")
+		now := time.Now()
+		folder := sentFolder(q.sentmail, now)
+		if err = os.MkdirAll(folder, 0755); err != nil {
+			q.log.Error("creating sentmail folder", logging.File, folder, logging.Err(err))
+			return
+		}
+		target := filepath.Join(folder, now.Format(timestampPrefix)+info.Name()+SentSuffix)
 		if err = os.Rename(path, target); err != nil {
-			glog.Errorf("moving %q to %q: %q", path, target, err)
+			q.log.Error("moving message", logging.File, path, "target", target, logging.Err(err))
+			return
+		}
+		q.moveEnvelope(path, target)
+		q.removeReport(path)
+		if len(report.Dropped) > 0 {
+			if err = writeReport(target+ReportSuffix, report); err != nil {
+				q.log.Error("writing report", logging.File, target, logging.Err(err))
+			}
 		}
-	} else if err := os.Remove(path); err != nil {
-		glog.Errorf("removing file %q: %q", path, err)
+		return
+	}
+	q.removeReport(path)
+	if err := os.Remove(path); err != nil {
+		q.log.Error("removing message", logging.File, path, logging.Err(err))
+		return
+	}
+	if err := os.Remove(path + EnvelopeSuffix); err != nil && !os.IsNotExist(err) {
+		q.log.Error("removing envelope", logging.File, path+EnvelopeSuffix, logging.Err(err))
+	}
+}
+
+// moveEnvelope keeps the envelope file of a message with it when the
+// message is moved from path to target.
+func (q *folderQueue) moveEnvelope(path string, target string) {
+	err := os.Rename(path+EnvelopeSuffix, target+EnvelopeSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		q.log.Error("moving envelope", logging.File, path+EnvelopeSuffix, "target", target+EnvelopeSuffix, logging.Err(err))
+	}
+}
+
+// previousReport returns the report of a deferred message, which
+// records its attempts and Message-ID.
+func previousReport(path string) Report {
+	raw, err := ioutil.ReadFile(path + ReportSuffix)
+	if err != nil {
+		return Report{}
+	}
+	return parseReport(raw)
+}
+
+// OrphanAge is how old an envelope or report in the mailqueue must be
+// before it is removed for lack of a message. It is longer than the
+// longest scan interval, so producers have written the message that
+// goes with an envelope well before then.
+const OrphanAge = time.Hour
+
+// removeOrphans removes the envelopes and reports in the mailqueue and
+// its priority folders whose message is gone, such as the envelope of
+// a message that a producer failed to write, once they are older than
+// OrphanAge.
+func (q *folderQueue) removeOrphans(now time.Time) {
+	for _, folder := range queueFolders(q.mailqueue) {
+		infos, err := ioutil.ReadDir(folder.path)
+		if err != nil {
+			continue
+		}
+		names := map[string]bool{}
+		for _, info := range infos {
+			names[info.Name()] = true
+		}
+		for _, info := range infos {
+			name := info.Name()
+			message := strings.TrimSuffix(name, EnvelopeSuffix)
+			if message == name {
+				message = strings.TrimSuffix(name, ReportSuffix)
+			}
+			if info.IsDir() || message == name || names[message] || now.Sub(info.ModTime()) < OrphanAge {
+				continue
+			}
+			path := filepath.Join(folder.path, name)
+			q.log.Warn("removing orphaned sidecar", logging.File, path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				q.log.Error("removing orphaned sidecar", logging.File, path, logging.Err(err))
+			}
+		}
+	}
+}
+
+// removeReport removes the report left next to a message in the
+// mailqueue when it was deferred.
+func (q *folderQueue) removeReport(path string) {
+	if err := os.Remove(path + ReportSuffix); err != nil && !os.IsNotExist(err) {
+		q.log.Error("removing report", logging.File, path+ReportSuffix, logging.Err(err))
 	}
 }
@@ -5,9 +5,14 @@
 package dispatcher_test
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"jw4.us/mqd/dispatcher"
 )
@@ -22,17 +27,731 @@ func TestProcess(t *testing.T) {
 		t.Fatal("temp mailqueue folder not created")
 	}
 
-	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "")
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
 	err := q.Process(testCallback(t))
 	if err != nil {
 		t.Fatalf("Process call failed: %q", err)
 	}
 }
 
+func TestProcessDeferred(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+	var ids []string
+	deferred := func(_ []byte, env *dispatcher.Envelope) dispatcher.Report {
+		id := "<first@bar.com>"
+		if env != nil && env.MessageID != "" {
+			id = env.MessageID
+		}
+		ids = append(ids, id)
+		return dispatcher.Report{Result: dispatcher.Deferred, MessageID: id}
+	}
+	for ix := 0; ix < 2; ix++ {
+		if err := q.Process(deferred); err != nil {
+			t.Fatalf("Process call failed: %q", err)
+		}
+	}
+	if len(ids) != 2 || ids[1] != "<first@bar.com>" {
+		t.Errorf("expected the Message-ID of the first attempt to be kept, got %q", ids)
+	}
+
+	// the message and the report of the deferred attempt
+	for folder, expected := range map[string]int{tc.mailqueue: 2, tc.badmail: 0} {
+		infos, err := ioutil.ReadDir(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != expected {
+			t.Errorf("expected %d files in %q, found %d", expected, folder, len(infos))
+		}
+	}
+}
+
+func TestProcessRetry(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	tried := tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+	old := tc.addFile(t, "From: foo@bar.com\r\nTo: qux@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+	queued := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(filepath.Join(tc.mailqueue, old), queued, queued); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := &dispatcher.Retry{MaxAttempts: 2, MaxAge: 2 * time.Hour}
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{Retry: retry})
+	deferred := func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{Result: dispatcher.Deferred, Error: "421 try later"}
+	}
+	tests := []struct {
+		bad       map[string]string
+		mailqueue int
+	}{
+		{map[string]string{old: "Error: giving up after 3h0m0s in the mailqueue: 421 try later"}, 2},
+		{map[string]string{tried: "Error: giving up after 2 attempts: 421 try later"}, 0},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if err := q.Process(deferred); err != nil {
+			t.Fatalf("Process call failed: %q", err)
+		}
+		for name, expected := range test.bad {
+			report, err := ioutil.ReadFile(filepath.Join(tc.badmail, name+dispatcher.ReportSuffix))
+			if err != nil {
+				t.Fatalf("reading report: %v", err)
+			}
+			if !strings.Contains(string(report), "Result: failed\r\n") || !strings.Contains(string(report), expected) {
+				t.Errorf("expected a failed report with %q, got %q", expected, report)
+			}
+		}
+		infos, err := ioutil.ReadDir(tc.mailqueue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != test.mailqueue {
+			t.Errorf("expected %d files in the mailqueue, found %d", test.mailqueue, len(infos))
+		}
+	}
+}
+
+func TestProcessHeld(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	name := tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+
+	j := &testJournal{}
+	retry := &dispatcher.Retry{MaxAttempts: 2}
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{Retry: retry, Journal: j})
+	held := func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{Result: dispatcher.Deferred, Error: "quiet hours", Held: true}
+	}
+	for ix := 0; ix < 3; ix++ {
+		if err := q.Process(held); err != nil {
+			t.Fatalf("Process call failed: %q", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tc.mailqueue, name)); err != nil {
+		t.Errorf("expected the held message to stay in the mailqueue: %v", err)
+	}
+	report, err := ioutil.ReadFile(filepath.Join(tc.mailqueue, name+dispatcher.ReportSuffix))
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	if strings.Contains(string(report), "Attempts: ") || !strings.Contains(string(report), "Error: quiet hours\r\n") {
+		t.Errorf("expected no attempts, got report %q", report)
+	}
+	if len(j.reports) != 0 {
+		t.Errorf("expected no journal entries for held passes, got %d", len(j.reports))
+	}
+}
+
+func TestProcessOrphans(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	name := tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+	old := time.Now().Add(-2 * dispatcher.OrphanAge)
+	files := map[string]bool{
+		name + dispatcher.EnvelopeSuffix:       true,
+		"gone.eml" + dispatcher.EnvelopeSuffix: false,
+		"gone.eml" + dispatcher.ReportSuffix:   false,
+	}
+	for file := range files {
+		path := filepath.Join(tc.mailqueue, file)
+		if err := ioutil.WriteFile(path, []byte(`{"recipients": ["x@y.z"]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh := "new.eml" + dispatcher.EnvelopeSuffix
+	if err := ioutil.WriteFile(filepath.Join(tc.mailqueue, fresh), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files[fresh] = true
+
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+	deferred := func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{Result: dispatcher.Deferred}
+	}
+	if err := q.Process(deferred); err != nil {
+		t.Fatalf("Process call failed: %q", err)
+	}
+	for file, kept := range files {
+		_, err := os.Stat(filepath.Join(tc.mailqueue, file))
+		if exists := err == nil; exists != kept {
+			t.Errorf("expected %s to be kept %v, exists %v", file, kept, exists)
+		}
+	}
+}
+
+func TestProcessFailedReport(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	name := tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+	failed := func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{MessageID: "<1234@bar.com>", Sender: "foo@bar.com"}.Fail(errors.New("no route"))
+	}
+	if err := q.Process(failed); err != nil {
+		t.Fatalf("Process call failed: %q", err)
+	}
+
+	report, err := ioutil.ReadFile(filepath.Join(tc.badmail, name+dispatcher.ReportSuffix))
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	expected := "Result: failed\r\nMessage-ID: <1234@bar.com>\r\nSender: foo@bar.com\r\nError: no route\r\nAttempts: 1\r\n"
+	if string(report) != expected {
+		t.Errorf("expected report %q, got %q", expected, report)
+	}
+}
+
+func TestProcessEnvelope(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	name := tc.addFile(t, "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: Hello\r\n\r\nMessage body here\r\n")
+	sidecar := filepath.Join(tc.mailqueue, name+dispatcher.EnvelopeSuffix)
+	if err := ioutil.WriteFile(sidecar, []byte(`{"sender": "app@bar.com", "recipients": ["x@y.z"], "connection": "bulk", "priority": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*dispatcher.Envelope
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+	err := q.Process(func(data []byte, env *dispatcher.Envelope) dispatcher.Report {
+		got = append(got, env)
+		return dispatcher.Report{Result: dispatcher.Failed}
+	})
+	if err != nil {
+		t.Fatalf("Process call failed: %q", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected one message, got %d", len(got))
+	}
+	env := got[0]
+	if env == nil || env.Sender != "app@bar.com" || len(env.Recipients) != 1 || env.Connection != "bulk" || env.Priority != 1 {
+		t.Errorf("unexpected envelope %+v", env)
+	}
+	for _, path := range []string{filepath.Join(tc.badmail, name), filepath.Join(tc.badmail, name+dispatcher.EnvelopeSuffix)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %q in badmail: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+		t.Errorf("envelope left in mailqueue")
+	}
+}
+
+func TestProcessPriority(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	start := time.Now().Add(-time.Hour)
+	for ix, test := range []struct {
+		name, headers, envelope string
+	}{
+		{name: "a.eml"},
+		{name: "b.eml", headers: "X-Priority: 5 (Lowest)\r\n"},
+		{name: "d.eml", headers: "Importance: High\r\n"},
+		{name: "low/e.eml", envelope: `{"priority": 2}`},
+		{name: "high/c.eml"},
+		{name: "low/f.eml", headers: "X-Priority: 1\r\n"},
+	} {
+		path := filepath.Join(tc.mailqueue, filepath.FromSlash(test.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		message := "From: foo@bar.com\r\nTo: baz@bar.com\r\nSubject: " + filepath.Base(path) + "\r\n" + test.headers + "\r\nbody\r\n"
+		if err := ioutil.WriteFile(path, []byte(message), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.envelope != "" {
+			if err := ioutil.WriteFile(path+dispatcher.EnvelopeSuffix, []byte(test.envelope), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		at := start.Add(time.Duration(ix) * time.Minute)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+	if status, err := q.Status("c.eml"); err != nil || status.State != dispatcher.StateQueued {
+		t.Errorf("expected c.eml to be queued, got %+v (%v)", status, err)
+	}
+	entries, err := q.List(dispatcher.Filter{})
+	if err != nil || len(entries) != 6 {
+		t.Errorf("expected 6 entries, got %d (%v)", len(entries), err)
+	}
+
+	var order []string
+	err = q.Process(func(data []byte, env *dispatcher.Envelope) dispatcher.Report {
+		subject := data[strings.Index(string(data), "Subject: ")+9:]
+		priority := 0
+		if env != nil {
+			priority = env.Priority
+		}
+		order = append(order, fmt.Sprintf("%s %d", subject[:strings.Index(string(subject), "\r")], priority))
+		return dispatcher.Report{Result: dispatcher.Failed}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the envelope wins over the folder, which wins over the headers,
+	// and the folder priority is passed on in the envelope
+	expected := "d.eml 0, e.eml 2, c.eml 1, a.eml 0, b.eml 0, f.eml 5"
+	if got := strings.Join(order, ", "); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+	if _, err := os.Stat(filepath.Join(tc.badmail, "c.eml")); err != nil {
+		t.Errorf("expected c.eml in badmail: %v", err)
+	}
+}
+
+func TestProcessPartial(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	name := tc.addFile(t, "x-sender: app@bar.com\r\nx-receiver: a@x.com\r\nx-receiver: b@x.com\r\nx-receiver: c@x.com\r\nSubject: Hello\r\n\r\nbody\r\n")
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{Preamble: true})
+
+	var got []*dispatcher.Envelope
+	results := []dispatcher.Report{{
+		Result:     dispatcher.Deferred,
+		Recipients: []string{"a@x.com", "b@x.com", "c@x.com"},
+		Deliveries: []dispatcher.Delivery{
+			{Recipient: "a@x.com", Result: dispatcher.Sent},
+			{Recipient: "b@x.com", Result: dispatcher.Failed, Error: "550 no such user"},
+			{Recipient: "c@x.com", Result: dispatcher.Deferred, Error: "450 try later"},
+		},
+	}, {
+		Result: dispatcher.Sent,
+	}}
+	callback := func(data []byte, env *dispatcher.Envelope) dispatcher.Report {
+		got = append(got, env)
+		return results[len(got)-1]
+	}
+
+	if err := q.Process(callback); err != nil {
+		t.Fatalf("Process call failed: %q", err)
+	}
+	if _, err := os.Stat(filepath.Join(tc.mailqueue, name)); err != nil {
+		t.Fatalf("expected message to stay in mailqueue: %v", err)
+	}
+
+	bounced, _ := filepath.Glob(filepath.Join(tc.badmail, "*"+name))
+	if len(bounced) != 1 {
+		t.Fatalf("expected one bounced copy, got %v", bounced)
+	}
+	raw, err := ioutil.ReadFile(bounced[0] + dispatcher.ReportSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "Recipients: b@x.com\r\n") || !strings.Contains(string(raw), "Delivery: b@x.com failed: 550 no such user") {
+		t.Errorf("unexpected report %q", raw)
+	}
+	raw, err = ioutil.ReadFile(bounced[0] + dispatcher.EnvelopeSuffix)
+	if err != nil || !strings.Contains(string(raw), `"recipients":["b@x.com"]`) {
+		t.Errorf("unexpected bounce envelope %q: %v", raw, err)
+	}
+
+	if err := q.Process(callback); err != nil {
+		t.Fatalf("Process call failed: %q", err)
+	}
+	if len(got) != 2 || got[1].Preamble.Get("X-Sender") != "app@bar.com" || strings.Join(got[1].Recipients, " ") != "c@x.com" {
+		t.Fatalf("expected retry for c@x.com only, got %+v", got[len(got)-1])
+	}
+	if _, err := os.Stat(filepath.Join(tc.mailqueue, name)); !os.IsNotExist(err) {
+		t.Errorf("expected message to leave the mailqueue")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+	sentmail := filepath.Join(tc.badmail, "sent")
+	if err := os.Mkdir(sentmail, 0755); err != nil {
+		t.Fatal(err)
+	}
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, sentmail, dispatcher.QueueOptions{})
+
+	env := &dispatcher.Envelope{Sender: "app@bar.com", Recipients: []string{"baz@bar.com"}}
+	name, err := dispatcher.Enqueue(tc.mailqueue, env, []byte("Subject: Hello\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []dispatcher.Report{
+		{Result: dispatcher.Deferred, Error: "try later"},
+		{Result: dispatcher.Sent},
+	}
+	expected := []dispatcher.State{dispatcher.StateQueued, dispatcher.StateDeferred, dispatcher.StateSent}
+	for ix, state := range expected {
+		t.Logf("Test %d", ix)
+		status, err := q.Status(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != state {
+			t.Errorf("expected %s, got %s", state, status.State)
+		}
+		if state == dispatcher.StateDeferred && !strings.Contains(status.Report, "Error: try later") {
+			t.Errorf("expected report of the deferral, got %q", status.Report)
+		}
+		if ix < len(results) {
+			err = q.Process(func(_ []byte, got *dispatcher.Envelope) dispatcher.Report {
+				if got.Sender != env.Sender {
+					t.Errorf("expected envelope %+v, got %+v", env, got)
+				}
+				return results[ix]
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	name, err = dispatcher.Enqueue(tc.mailqueue, env, []byte("Subject: Hello\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Process(func([]byte, *dispatcher.Envelope) dispatcher.Report { return dispatcher.Report{Error: "no"} }); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := q.Status(name); err != nil || status.State != dispatcher.StateBad || !strings.Contains(status.Report, "Error: no") {
+		t.Errorf("expected bad message, got %+v, %v", status, err)
+	}
+
+	if _, err = q.Status("missing.eml"); !os.IsNotExist(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, err = q.Status("../" + name); err == nil || os.IsNotExist(err) {
+		t.Errorf("expected invalid name, got %v", err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{})
+
+	env := &dispatcher.Envelope{Sender: "app@bar.com", Recipients: []string{"baz@bar.com"}}
+	enqueued, err := dispatcher.Enqueue(tc.mailqueue, env, []byte("Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\nbody\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ix := 0; ix < 2; ix++ {
+		err = q.Process(func([]byte, *dispatcher.Envelope) dispatcher.Report {
+			return dispatcher.Report{Result: dispatcher.Deferred, Error: "busy"}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	added := tc.addFile(t, "From: Foo <foo@bar.com>\r\nTo: a@x.com, B <b@x.com>\r\nSubject: Hello\r\n\r\nbody\r\n")
+
+	entries, err := q.List(dispatcher.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	for _, e := range entries {
+		switch e.ID {
+		case enqueued:
+			if e.State != dispatcher.StateDeferred || e.Attempts != 2 || e.Error != "busy" ||
+				e.Sender != "app@bar.com" || e.Subject != "Grüße" {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		case added:
+			if e.State != dispatcher.StateQueued || e.Sender != "foo@bar.com" ||
+				strings.Join(e.Recipients, ",") != "a@x.com,b@x.com" || e.Subject != "Hello" || e.Size == 0 {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		default:
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+
+	filters := []struct {
+		filter   dispatcher.Filter
+		expected int
+	}{
+		{dispatcher.Filter{States: []dispatcher.State{dispatcher.StateDeferred}}, 1},
+		{dispatcher.Filter{States: []dispatcher.State{dispatcher.StateBad, dispatcher.StateSent}}, 0},
+		{dispatcher.Filter{Recipient: "B@X"}, 1},
+		{dispatcher.Filter{Sender: "bar.com"}, 2},
+		{dispatcher.Filter{OlderThan: time.Hour}, 0},
+	}
+	for ix, test := range filters {
+		t.Logf("Test %d", ix)
+		entries, err := q.List(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != test.expected {
+			t.Errorf("expected %d entries, got %d", test.expected, len(entries))
+		}
+	}
+
+	e, err := q.Show(enqueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(e.Report, "Attempts: 2") {
+		t.Errorf("expected the report, got %q", e.Report)
+	}
+
+	stats := dispatcher.Summarize(entries)
+	for _, s := range stats {
+		if (s.State == dispatcher.StateQueued || s.State == dispatcher.StateDeferred) != (s.Count == 1) {
+			t.Errorf("unexpected stats %+v", s)
+		}
+	}
+}
+
+func TestPruneSent(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+	sentmail := filepath.Join(tc.badmail, "sent")
+	if err := os.Mkdir(sentmail, 0755); err != nil {
+		t.Fatal(err)
+	}
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, sentmail, dispatcher.QueueOptions{})
+
+	now := time.Now()
+	var ids []string
+	for ix, age := range []time.Duration{10 * 24 * time.Hour, 2 * 24 * time.Hour, 0} {
+		env := &dispatcher.Envelope{Sender: "app@bar.com", Recipients: []string{"baz@bar.com"}}
+		id, err := dispatcher.Enqueue(tc.mailqueue, env, []byte(fmt.Sprintf("Subject: Hello %d\r\n\r\nbody\r\n", ix)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = q.Process(testCallback(t)); err != nil {
+			t.Fatal(err)
+		}
+		e, err := q.Show(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if folder := filepath.Join(sentmail, now.Format("2006/01/02")); filepath.Dir(e.Path) != filepath.FromSlash(folder) {
+			t.Errorf("expected %q in the date folder %q", e.Path, folder)
+		}
+		if err = os.Chtimes(e.Path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	result, err := dispatcher.PruneSent(sentmail, dispatcher.Retention{
+		MaxAge: 7 * 24 * time.Hour, Compress: dispatcher.Gzip, CompressAfter: 24 * time.Hour,
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 || result.Compressed != 1 || result.Kept != 2 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if _, err = q.Status(ids[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest message to be removed, got %v", err)
+	}
+	e, err := q.Show(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(e.Path, ".sent"+dispatcher.GzipSuffix) || e.Subject != "Hello 1" || e.Sender != "app@bar.com" ||
+		e.Age < 2*24*60*60 {
+		t.Errorf("expected a compressed message of the same age, got %+v", e)
+	}
+
+	// a size limit removes the oldest first
+	result, err = dispatcher.PruneSent(sentmail, dispatcher.Retention{MaxSize: 40, Compress: dispatcher.Zstd}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed != 1 || result.Kept != 1 || result.Compressed != 1 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	entries, err := q.List(dispatcher.Filter{States: []dispatcher.State{dispatcher.StateSent}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != ids[2] || entries[0].Subject != "Hello 2" {
+		t.Errorf("expected only the newest message, got %+v", entries)
+	}
+}
+
+func TestProcessDropped(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+	sentmail := filepath.Join(tc.badmail, "sentmail")
+	if err := os.Mkdir(sentmail, 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := tc.addFile(t, "To: bob@x.com, not an address\r\n\r\nbody\r\n")
+
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, sentmail, dispatcher.QueueOptions{})
+	err := q.Process(func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{Result: dispatcher.Sent, Recipients: []string{"bob@x.com"}, Dropped: []string{"not an address"}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := q.Status(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != dispatcher.StateSent || !strings.Contains(status.Report, "Dropped: not an address") {
+		t.Errorf("expected the sent message to keep its report, got %+v", status)
+	}
+}
+
+func TestProcessDuplicates(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+	duplicates := &dispatcher.Duplicates{Folder: filepath.Join(tc.badmail, "duplicates")}
+	q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{Duplicates: duplicates})
+
+	sent := 0
+	send := func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		sent++
+		return dispatcher.Report{Result: dispatcher.Sent}
+	}
+	message := []byte("Message-ID: <1@bar.com>\r\nSubject: Hello\r\n\r\nbody\r\n")
+	bob := &dispatcher.Envelope{Sender: "app@bar.com", Recipients: []string{"bob@x.com"}}
+
+	tests := []struct {
+		q        dispatcher.MailQueueDispatcher
+		env      *dispatcher.Envelope
+		message  []byte
+		expected dispatcher.State
+	}{
+		{q, bob, message, dispatcher.StateSent},
+		{q, bob, message, dispatcher.StateDuplicate},
+		{q, &dispatcher.Envelope{Sender: "app@bar.com", Recipients: []string{"carol@x.com"}}, message, dispatcher.StateSent},
+		// without a Message-ID the content is compared
+		{q, nil, []byte("To: bob@x.com\r\n\r\nbody\r\n"), dispatcher.StateSent},
+		{q, nil, []byte("To: bob@x.com\r\n\r\nbody\r\n"), dispatcher.StateDuplicate},
+		{q, nil, []byte("To: bob@x.com\r\n\r\nother body\r\n"), dispatcher.StateSent},
+		// outside the window messages are sent again
+		{dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{
+			Duplicates: &dispatcher.Duplicates{Folder: duplicates.Folder, Window: time.Nanosecond},
+		}), bob, message, dispatcher.StateSent},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		before := sent
+		name, err := dispatcher.Enqueue(tc.mailqueue, test.env, test.message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = test.q.Process(send); err != nil {
+			t.Fatal(err)
+		}
+		if test.expected == dispatcher.StateSent {
+			if sent != before+1 {
+				t.Errorf("expected the message to be sent")
+			}
+			continue
+		}
+		if sent != before {
+			t.Errorf("expected the duplicate not to be sent")
+		}
+		status, err := test.q.Status(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != test.expected || !strings.Contains(status.Report, "Result: duplicate") {
+			t.Errorf("expected a duplicate, got %+v", status)
+		}
+	}
+}
+
+func TestParsePreamble(t *testing.T) {
+	tests := []struct {
+		message   string
+		sender    string
+		receivers []string
+		rest      string
+	}{{
+		message: "From: foo@bar.com\r\n\r\nbody\r\n",
+		rest:    "From: foo@bar.com\r\n\r\nbody\r\n",
+	}, {
+		message:   "x-sender: app@bar.com\r\nx-receiver: a@x.com\r\nX-Receiver: b@x.com\r\nFrom: foo@bar.com\r\n\r\nbody\r\n",
+		sender:    "app@bar.com",
+		receivers: []string{"a@x.com", "b@x.com"},
+		rest:      "From: foo@bar.com\r\n\r\nbody\r\n",
+	}, {
+		message: "X-Sender: app@bar.com\nSubject: hi\nX-Receiver: late@x.com\n\nbody\n",
+		sender:  "app@bar.com",
+		rest:    "Subject: hi\nX-Receiver: late@x.com\n\nbody\n",
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		env, rest := dispatcher.ParsePreamble([]byte(test.message))
+		if string(rest) != test.rest {
+			t.Errorf("expected remaining message %q, got %q", test.rest, rest)
+		}
+		if test.sender == "" {
+			if env != nil {
+				t.Errorf("expected no envelope, got %+v", env)
+			}
+			continue
+		}
+		if env == nil || env.Sender != "" || len(env.Recipients) != 0 ||
+			env.Preamble.Get("X-Sender") != test.sender || strings.Join(env.Preamble["X-Receiver"], " ") != strings.Join(test.receivers, " ") {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+	}
+}
+
+func TestProcessPreambleOptIn(t *testing.T) {
+	tc := testContext{}
+	defer initializeAndTearDown(t, &tc)()
+
+	message := "X-Receiver: a@x.com\r\nTo: b@y.com\r\nSubject: Hello\r\n\r\nbody\r\n"
+	for ix, preamble := range []bool{false, true} {
+		t.Logf("Test %d", ix)
+		tc.addFile(t, message)
+		var gotData []byte
+		var gotEnv *dispatcher.Envelope
+		q := dispatcher.NewPickupFolderQueue(tc.mailqueue, tc.badmail, "", dispatcher.QueueOptions{Preamble: preamble})
+		err := q.Process(func(data []byte, env *dispatcher.Envelope) dispatcher.Report {
+			gotData, gotEnv = data, env
+			return dispatcher.Report{Result: dispatcher.Sent}
+		})
+		if err != nil {
+			t.Fatalf("Process call failed: %q", err)
+		}
+		if !preamble {
+			if string(gotData) != message || gotEnv != nil {
+				t.Errorf("expected the message untouched, got %q and %+v", gotData, gotEnv)
+			}
+			continue
+		}
+		if strings.HasPrefix(string(gotData), "X-Receiver") || gotEnv == nil || len(gotEnv.Recipients) != 0 || gotEnv.Preamble.Get("X-Receiver") != "a@x.com" {
+			t.Errorf("expected the preamble in the envelope, got %q and %+v", gotData, gotEnv)
+		}
+	}
+}
+
 func testCallback(t *testing.T) dispatcher.MailQueueCallbackFn {
-	return func(data []byte) bool {
+	return func(data []byte, env *dispatcher.Envelope) dispatcher.Report {
 		t.Logf("got data: %q", string(data))
-		return true
+		return dispatcher.Report{Result: dispatcher.Sent}
 	}
 }
 
@@ -66,7 +785,7 @@ type testContext struct {
 	badmail   string
 }
 
-func (tc *testContext) addFile(t *testing.T, contents string) {
+func (tc *testContext) addFile(t *testing.T, contents string) string {
 	f, err := ioutil.TempFile(tc.mailqueue, "test_file")
 	if err != nil {
 		t.Fatalf("problem creating temp file: %q", err)
@@ -77,4 +796,15 @@ func (tc *testContext) addFile(t *testing.T, contents string) {
 	if err != nil {
 		t.Fatalf("problem writing temp file: %q", err)
 	}
+	return filepath.Base(f.Name())
+}
+
+// testJournal keeps the reports recorded in it.
+type testJournal struct {
+	reports []dispatcher.Report
+}
+
+func (j *testJournal) Record(id string, subject string, report dispatcher.Report) error {
+	j.reports = append(j.reports, report)
+	return nil
 }
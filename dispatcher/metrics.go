@@ -0,0 +1,144 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	processedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "dispatcher",
+		Name:      "messages_total",
+		Help:      "Messages processed from the mailqueue, by result.",
+	}, []string{"result"})
+	scansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "dispatcher",
+		Name:      "scans_total",
+		Help:      "Scans of the mailqueue folder, by result (ok or error).",
+	}, []string{"result"})
+	prunedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "sentmail",
+		Name:      "pruned_total",
+		Help:      "Sent messages removed or compressed by the retention policy, by action.",
+	}, []string{"action"})
+	lastScan = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mqd",
+		Subsystem: "dispatcher",
+		Name:      "last_successful_scan_timestamp_seconds",
+		Help:      "When the last scan of the mailqueue folder that completed without error ended.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(processedTotal, scansTotal, prunedTotal, lastScan)
+}
+
+// lastScanTime is when the last successful scan ended, in Unix
+// nanoseconds.
+var lastScanTime int64
+
+// LastScan returns when the last scan of a mailqueue folder in this
+// process that completed without error ended; the zero time if there
+// was none.
+func LastScan() time.Time {
+	if nano := atomic.LoadInt64(&lastScanTime); nano != 0 {
+		return time.Unix(0, nano)
+	}
+	return time.Time{}
+}
+
+// observeScan records the end of a scan of the mailqueue.
+func observeScan(err error) {
+	if err != nil {
+		scansTotal.WithLabelValues("error").Inc()
+		return
+	}
+	scansTotal.WithLabelValues("ok").Inc()
+	now := time.Now()
+	atomic.StoreInt64(&lastScanTime, now.UnixNano())
+	lastScan.Set(float64(now.UnixNano()) / 1e9)
+}
+
+var (
+	queueDepthDesc = prometheus.NewDesc("mqd_queue_messages",
+		"Messages in each queue folder.", []string{"folder"}, nil)
+	queueAgeDesc = prometheus.NewDesc("mqd_queue_oldest_message_age_seconds",
+		"Age of the oldest message in each queue folder.", []string{"folder"}, nil)
+)
+
+// queueCollector reports the depth and oldest message age of the
+// queue folders when it is collected.
+type queueCollector struct {
+	folders map[string]string
+}
+
+// NewQueueCollector returns a prometheus.Collector of the number of
+// messages in the mailqueue, badmail and sentmail folders, and the age
+// of the oldest of them. Folders that are not set are left out.
+func NewQueueCollector(mailqueue string, badmail string, sentmail string) prometheus.Collector {
+	c := &queueCollector{folders: map[string]string{}}
+	for name, path := range map[string]string{"mailqueue": mailqueue, "badmail": badmail, "sentmail": sentmail} {
+		if path != "" {
+			c.folders[name] = path
+		}
+	}
+	return c
+}
+
+// Describe fulfills the prometheus.Collector interface
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueAgeDesc
+}
+
+// Collect fulfills the prometheus.Collector interface
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for name, path := range c.folders {
+		count, oldest := 0, now
+		add := func(info os.FileInfo) {
+			count++
+			if info.ModTime().Before(oldest) {
+				oldest = info.ModTime()
+			}
+		}
+		if name == "sentmail" {
+			if err := walkSent(path, func(_ string, info os.FileInfo) { add(info) }); err != nil {
+				continue
+			}
+		} else if name == "mailqueue" {
+			items, err := queued(path)
+			if err != nil {
+				continue
+			}
+			for _, item := range items {
+				add(item.info)
+			}
+		} else {
+			infos, err := ioutil.ReadDir(path)
+			if err != nil {
+				continue
+			}
+			for _, info := range infos {
+				if info.IsDir() || strings.HasSuffix(info.Name(), EnvelopeSuffix) || strings.HasSuffix(info.Name(), ReportSuffix) {
+					continue
+				}
+				add(info)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(count), name)
+		ch <- prometheus.MustNewConstMetric(queueAgeDesc, prometheus.GaugeValue, now.Sub(oldest).Seconds(), name)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Priority folders of the mailqueue. Messages written into them are
+// high or low priority unless their envelope says otherwise.
+const (
+	HighFolder = "high"
+	LowFolder  = "low"
+)
+
+// Priorities on the X-Priority scale, which envelopes use too: 1 and 2
+// are high, 3 normal and 4 and 5 low.
+const (
+	HighPriority   = 1
+	NormalPriority = 3
+	LowPriority    = 5
+)
+
+// headLimit is how much of a message is read to find its priority.
+const headLimit = 64 << 10
+
+// HeaderPriority returns the priority that the X-Priority, Priority or
+// Importance headers give a message, or 0 if they don't.
+func HeaderPriority(header mail.Header) int {
+	if p := strings.TrimSpace(header.Get("X-Priority")); p != "" && p[0] >= '1' && p[0] <= '5' {
+		return int(p[0] - '0')
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Priority"))) {
+	case "urgent":
+		return HighPriority
+	case "normal":
+		return NormalPriority
+	case "non-urgent":
+		return LowPriority
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case "high":
+		return HighPriority
+	case "normal":
+		return NormalPriority
+	case "low":
+		return LowPriority
+	}
+	return 0
+}
+
+// priorityClass groups priorities into high (0), normal (1) and low
+// (2) classes, which are sent in that order.
+func priorityClass(priority int) int {
+	switch {
+	case priority == 0 || priority == NormalPriority:
+		return 1
+	case priority < NormalPriority:
+		return 0
+	}
+	return 2
+}
+
+// queueFolder is a folder that messages are sent from, and the
+// priority of the messages in it.
+type queueFolder struct {
+	path     string
+	priority int
+}
+
+// queueFolders returns the mailqueue and its priority folders.
+func queueFolders(mailqueue string) []queueFolder {
+	return []queueFolder{
+		{mailqueue, 0},
+		{filepath.Join(mailqueue, HighFolder), HighPriority},
+		{filepath.Join(mailqueue, LowFolder), LowPriority},
+	}
+}
+
+// folderPriority returns the priority of the queue folder that holds
+// path, or 0 for the mailqueue itself.
+func (q *folderQueue) folderPriority(path string) int {
+	dir := filepath.Dir(path)
+	for _, folder := range queueFolders(q.mailqueue) {
+		if folder.path == dir {
+			return folder.priority
+		}
+	}
+	return 0
+}
+
+// pendingItem is a message waiting in the mailqueue, with the
+// priority of its folder, or its own once it is known.
+type pendingItem struct {
+	path     string
+	info     os.FileInfo
+	priority int
+}
+
+// queued returns the messages in the mailqueue and its priority
+// folders.
+func queued(mailqueue string) ([]pendingItem, error) {
+	var items []pendingItem
+	for _, folder := range queueFolders(mailqueue) {
+		infos, err := ioutil.ReadDir(folder.path)
+		if err != nil {
+			if folder.path != mailqueue && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() || strings.HasSuffix(name, EnvelopeSuffix) || strings.HasSuffix(name, ReportSuffix) {
+				continue
+			}
+			items = append(items, pendingItem{path: filepath.Join(folder.path, name), info: info, priority: folder.priority})
+		}
+	}
+	return items, nil
+}
+
+// pending returns the messages in the mailqueue and its priority
+// folders in the order they should be sent: high priority first, and
+// the oldest first within each priority.
+func pending(mailqueue string) ([]pendingItem, error) {
+	items, err := queued(mailqueue)
+	if err != nil {
+		return nil, err
+	}
+	for ix := range items {
+		items[ix].priority = messagePriority(items[ix].path, items[ix].priority)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if ci, cj := priorityClass(items[i].priority), priorityClass(items[j].priority); ci != cj {
+			return ci < cj
+		}
+		if ti, tj := items[i].info.ModTime(), items[j].info.ModTime(); !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return items[i].info.Name() < items[j].info.Name()
+	})
+	return items, nil
+}
+
+// messagePriority returns the priority of the message at path, in a
+// folder of the given priority: the one in its envelope, or else that
+// of the folder, or else the one in its headers. Messages that can't
+// be read are left for processing to report.
+func messagePriority(path string, folder int) int {
+	if env, err := readEnvelope(path + EnvelopeSuffix); err == nil && env != nil && env.Priority != 0 {
+		return env.Priority
+	}
+	if folder != 0 {
+		return folder
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return NormalPriority
+	}
+	head, _ := ioutil.ReadAll(io.LimitReader(f, headLimit))
+	_ = f.Close()
+	_, head = ParsePreamble(head)
+	if msg, err := mail.ReadMessage(bytes.NewReader(head)); err == nil {
+		if p := HeaderPriority(msg.Header); p != 0 {
+			return p
+		}
+	}
+	return NormalPriority
+}
@@ -0,0 +1,53 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultRetryMaxAge is how long deferred messages are tried again
+// unless configured otherwise.
+const DefaultRetryMaxAge = 5 * 24 * time.Hour
+
+// Retry limits how deferred messages are tried again. Once a message
+// has been tried MaxAttempts times, or was queued longer than MaxAge
+// ago, the recipients still deferred are bounced to the badmail
+// folder. Zero values don't limit.
+type Retry struct {
+	MaxAttempts int
+	MaxAge      time.Duration
+}
+
+// expired returns why a deferred message, queued at queued and tried
+// attempts times, is not tried again, or "" if it is.
+func (r *Retry) expired(attempts int, queued, now time.Time) string {
+	switch {
+	case r == nil:
+		return ""
+	case r.MaxAttempts > 0 && attempts >= r.MaxAttempts:
+		return fmt.Sprintf("giving up after %d attempts", attempts)
+	case r.MaxAge > 0 && now.Sub(queued) > r.MaxAge:
+		return fmt.Sprintf("giving up after %s in the mailqueue", now.Sub(queued).Round(time.Minute))
+	}
+	return ""
+}
+
+// giveUp turns the Deferred deliveries of a Report into Failed ones,
+// for the given reason.
+func (r Report) giveUp(reason string) Report {
+	deliveries := make([]Delivery, len(r.Deliveries))
+	for ix, d := range r.Deliveries {
+		if d.Result == Deferred {
+			d.Result, d.Error = Failed, reason+": "+d.Error
+		}
+		deliveries[ix] = d
+	}
+	r.Deliveries = deliveries
+	r.Result = Failed
+	r.Error = reason + ": " + r.Error
+	return r
+}
@@ -0,0 +1,332 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// SentSuffix is appended to the names of messages moved to the
+// sentmail folder, which is followed by GzipSuffix or ZstdSuffix once
+// they are compressed.
+const (
+	SentSuffix = ".sent"
+	GzipSuffix = ".gz"
+	ZstdSuffix = ".zst"
+)
+
+// Compression methods for sent messages.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// sentFolder returns the date folder, sentmail/YYYY/MM/DD, that
+// messages sent at t are moved to.
+func sentFolder(sentmail string, t time.Time) string {
+	return filepath.Join(sentmail, t.Format("2006"), t.Format("01"), t.Format("02"))
+}
+
+// isSent reports whether name is that of a sent message, compressed
+// or not, rather than of its envelope.
+func isSent(name string) bool {
+	for _, suffix := range []string{SentSuffix, SentSuffix + GzipSuffix, SentSuffix + ZstdSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sentID returns the name a sent message had in the mailqueue.
+func sentID(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, GzipSuffix), ZstdSuffix)
+	name = strings.TrimSuffix(name, SentSuffix)
+	if len(name) > len(timestampPrefix) {
+		name = name[len(timestampPrefix):]
+	}
+	return name
+}
+
+// sentBase returns the path a sent message had before it was
+// compressed, which its envelope and report are named after.
+func sentBase(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(path, GzipSuffix), ZstdSuffix)
+}
+
+// walkSent calls fn for each sent message in the sentmail folder: in
+// the date folders, and any left at the top by older versions.
+func walkSent(sentmail string, fn func(path string, info os.FileInfo)) error {
+	return filepath.Walk(sentmail, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == sentmail {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() && isSent(info.Name()) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// findSent returns the path of the sent message that was named name in
+// the mailqueue, searching the newest date folders first, or an empty
+// string.
+func findSent(sentmail string, name string) string {
+	pattern := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return '?'
+		}
+		return r
+	}, timestampPrefix) + name + SentSuffix + "*"
+
+	folders := []string{sentmail}
+	days, _ := filepath.Glob(filepath.Join(sentmail, "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+	sort.Strings(days)
+	folders = append(folders, days...)
+	for ix := len(folders) - 1; ix >= 0; ix-- {
+		matches, _ := filepath.Glob(filepath.Join(folders[ix], pattern))
+		for jx := len(matches) - 1; jx >= 0; jx-- {
+			if isSent(matches[jx]) {
+				return matches[jx]
+			}
+		}
+	}
+	return ""
+}
+
+// openMessage opens the message file at path, decompressing sent
+// messages that were compressed.
+func openMessage(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasSuffix(path, GzipSuffix):
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return readCloser{r, f}, nil
+	case strings.HasSuffix(path, ZstdSuffix):
+		r, err := zstd.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return readCloser{r.IOReadCloser(), f}, nil
+	}
+	return f, nil
+}
+
+type readCloser struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (r readCloser) Close() error {
+	_ = r.ReadCloser.Close()
+	return r.f.Close()
+}
+
+// Retention limits the sent messages kept in the sentmail folder.
+// Zero values don't limit anything.
+type Retention struct {
+	// MaxAge is how long sent messages are kept.
+	MaxAge time.Duration
+	// MaxSize limits the total size of the sent messages; the oldest
+	// are removed first.
+	MaxSize int64
+	// Compress is Gzip or Zstd, to compress messages once they are
+	// CompressAfter old.
+	Compress      string
+	CompressAfter time.Duration
+}
+
+// PruneResult tells what PruneSent did.
+type PruneResult struct {
+	Compressed int
+	Removed    int
+	// Kept and Size are the number and total size of the sent
+	// messages left.
+	Kept int
+	Size int64
+}
+
+type sentFile struct {
+	path string
+	info os.FileInfo
+}
+
+// PruneSent applies the Retention policy r to the sentmail folder:
+// messages older than MaxAge are removed, the oldest of the others are
+// removed until they fit in MaxSize, and those left are compressed
+// once they are old enough. Date folders left empty are removed.
+// Messages keep their modification time when they are compressed, so
+// their age still tells when they were sent.
+func PruneSent(sentmail string, r Retention, now time.Time) (PruneResult, error) {
+	var (
+		result PruneResult
+		files  []sentFile
+	)
+	if err := walkSent(sentmail, func(path string, info os.FileInfo) {
+		files = append(files, sentFile{path, info})
+	}); err != nil {
+		return result, err
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].info.ModTime().Before(files[j].info.ModTime()) })
+
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	var kept []sentFile
+	for _, f := range files {
+		if r.MaxAge > 0 && now.Sub(f.info.ModTime()) > r.MaxAge {
+			if err := removeSent(f.path); err != nil {
+				keep(err)
+				kept = append(kept, f)
+				continue
+			}
+			result.Removed++
+			continue
+		}
+		kept = append(kept, f)
+		result.Size += f.info.Size()
+	}
+
+	for len(kept) > 0 && r.MaxSize > 0 && result.Size > r.MaxSize {
+		if err := removeSent(kept[0].path); err != nil {
+			keep(err)
+			break
+		}
+		result.Removed++
+		result.Size -= kept[0].info.Size()
+		kept = kept[1:]
+	}
+
+	if r.Compress != "" {
+		for ix, f := range kept {
+			if now.Sub(f.info.ModTime()) < r.CompressAfter || !strings.HasSuffix(f.path, SentSuffix) {
+				continue
+			}
+			info, err := compressSent(f.path, r.Compress)
+			if err != nil {
+				keep(err)
+				continue
+			}
+			result.Compressed++
+			result.Size += info.Size() - f.info.Size()
+			kept[ix].info = info
+		}
+	}
+	result.Kept = len(kept)
+
+	removeEmptyFolders(sentmail)
+	prunedTotal.WithLabelValues("removed").Add(float64(result.Removed))
+	prunedTotal.WithLabelValues("compressed").Add(float64(result.Compressed))
+	return result, firstErr
+}
+
+// removeSent removes a sent message, its envelope and its report.
+func removeSent(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	for _, suffix := range []string{EnvelopeSuffix, ReportSuffix} {
+		if err := os.Remove(sentBase(path) + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressSent replaces the sent message at path with a compressed
+// copy, named with the suffix of the method, and returns its FileInfo.
+func compressSent(path string, method string) (os.FileInfo, error) {
+	var suffix string
+	switch method {
+	case Gzip:
+		suffix = GzipSuffix
+	case Zstd:
+		suffix = ZstdSuffix
+	default:
+		return nil, fmt.Errorf("unknown compression %q", method)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".compress-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	var w io.WriteCloser
+	if method == Gzip {
+		w = gzip.NewWriter(tmp)
+	} else if w, err = zstd.NewWriter(tmp); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+	if _, err = w.Write(raw); err == nil {
+		err = w.Close()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	target := path + suffix
+	if err = os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), target); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(path); err != nil {
+		return nil, err
+	}
+	return os.Stat(target)
+}
+
+// removeEmptyFolders removes the date folders of sentmail that hold
+// nothing, deepest first.
+func removeEmptyFolders(sentmail string) {
+	var folders []string
+	_ = filepath.Walk(sentmail, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != sentmail {
+			folders = append(folders, path)
+		}
+		return nil
+	})
+	for ix := len(folders) - 1; ix >= 0; ix-- {
+		// fails unless the folder is empty
+		_ = os.Remove(folders[ix])
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dispatcher // import "jw4.us/mqd/dispatcher"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// State is where a message is on its way through the queue folders.
+type State string
+
+// States
+const (
+	// StateQueued messages wait in the mailqueue to be sent.
+	StateQueued State = "queued"
+	// StateDeferred messages are in the mailqueue after a failed
+	// attempt, to be tried again.
+	StateDeferred State = "deferred"
+	// StateSent messages are in the sentmail folder.
+	StateSent State = "sent"
+	// StateBad messages are in the badmail folder.
+	StateBad State = "bad"
+	// StateDuplicate messages are in the duplicates folder.
+	StateDuplicate State = "duplicate"
+)
+
+// timestampPrefix is the layout of the time prefixed to the names of
+// messages moved to the sentmail folder, or bounced to badmail. Sent
+// messages are kept in date folders, see sentFolder.
+const timestampPrefix = "2006-01-02_150405-"
+
+// MessageStatus tells where a message is, and the Report of its last
+// attempt, if it has one.
+type MessageStatus struct {
+	ID     string `json:"id"`
+	State  State  `json:"status"`
+	Report string `json:"report,omitempty"`
+}
+
+// Status implements the MailQueueDispatcher interface. Messages that
+// were sent can only be found when there is a sentmail folder; the
+// error of messages that can't be found satisfies os.IsNotExist.
+func (q *folderQueue) Status(name string) (*MessageStatus, error) {
+	path, state, err := q.locate(name)
+	if err != nil {
+		return nil, err
+	}
+	status := &MessageStatus{ID: name, State: state}
+	if report, err := ioutil.ReadFile(sentBase(path) + ReportSuffix); err == nil {
+		status.Report = string(report)
+	}
+	return status, nil
+}
+
+// locate finds the file of the message with the given name in the
+// queue folders.
+func (q *folderQueue) locate(name string) (string, State, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\*?[`) ||
+		strings.HasSuffix(name, EnvelopeSuffix) || strings.HasSuffix(name, ReportSuffix) {
+		return "", "", fmt.Errorf("invalid message name %q", name)
+	}
+
+	for _, folder := range queueFolders(q.mailqueue) {
+		path := filepath.Join(folder.path, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			if _, err = os.Stat(path + ReportSuffix); err == nil {
+				return path, StateDeferred, nil
+			}
+			return path, StateQueued, nil
+		}
+	}
+	var path string
+	if q.badmail != "" {
+		path = filepath.Join(q.badmail, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, StateBad, nil
+		}
+	}
+	if q.duplicates != nil {
+		path = filepath.Join(q.duplicates.Folder, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, StateDuplicate, nil
+		}
+	}
+	if q.sentmail != "" {
+		if path = findSent(q.sentmail, name); path != "" {
+			return path, StateSent, nil
+		}
+	}
+	return "", "", &os.PathError{Op: "status", Path: name, Err: os.ErrNotExist}
+}
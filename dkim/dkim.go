@@ -0,0 +1,318 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package dkim implements DomainKeys Identified Mail (RFC 6376)
+// signing of outgoing messages with RSA (rsa-sha256) or Ed25519
+// (ed25519-sha256, RFC 8463) keys.
+package dkim // import "jw4.us/mqd/dkim"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canonicalization names a DKIM canonicalization algorithm.
+type Canonicalization string
+
+// Canonicalizations
+const (
+	Simple  Canonicalization = "simple"
+	Relaxed Canonicalization = "relaxed"
+)
+
+// DefaultHeaders are signed when Options.Headers is empty. Only the
+// ones present in the message end up in the signature.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Options describe how a message is to be signed.
+type Options struct {
+	// Domain is the signing domain (d=).
+	Domain string
+	// Selector names the key within Domain (s=).
+	Selector string
+	// Signer is an *rsa.PrivateKey or ed25519.PrivateKey.
+	Signer crypto.Signer
+	// Headers lists the header fields to sign. From is always
+	// signed.
+	Headers []string
+	// HeaderCanonicalization and BodyCanonicalization default to
+	// Relaxed and Simple respectively.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+	// Time, if set, is recorded as the signature timestamp (t=).
+	Time time.Time
+}
+
+// ParseCanonicalization parses the c= tag form, "header/body" or just
+// "header", in which case the body uses Simple.
+func ParseCanonicalization(s string) (header Canonicalization, body Canonicalization, err error) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(s)), "/", 2)
+	header, body = Canonicalization(parts[0]), Simple
+	if len(parts) == 2 {
+		body = Canonicalization(parts[1])
+	}
+	if header == "" {
+		header = Simple
+	}
+	for _, c := range []Canonicalization{header, body} {
+		if c != Simple && c != Relaxed {
+			return "", "", fmt.Errorf("unknown canonicalization %q", string(c))
+		}
+	}
+	return header, body, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA or Ed25519 private key from
+// path.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(raw)
+}
+
+// ParsePrivateKey parses a PEM encoded RSA (PKCS #1 or PKCS #8) or
+// Ed25519 (PKCS #8) private key.
+func ParsePrivateKey(raw []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// Sign computes a DKIM signature for message and returns a copy of
+// the message with the DKIM-Signature header prepended. Line endings
+// are normalized to CRLF, as they will be on the wire.
+func Sign(message []byte, o *Options) ([]byte, error) {
+	if o == nil || o.Domain == "" || o.Selector == "" || o.Signer == nil {
+		return nil, fmt.Errorf("dkim: domain, selector and key are required")
+	}
+	algorithm, hash, err := algorithmFor(o.Signer)
+	if err != nil {
+		return nil, err
+	}
+	hc, bc := o.HeaderCanonicalization, o.BodyCanonicalization
+	if hc == "" {
+		hc = Relaxed
+	}
+	if bc == "" {
+		bc = Simple
+	}
+
+	message = normalizeLineEndings(message)
+	headers, body := SplitMessage(message)
+
+	bodyHash := sha256.Sum256(CanonicalBody(body, bc))
+
+	names := o.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+	selected, signedNames := SelectHeaders(headers, names)
+	if !containsFold(signedNames, "From") {
+		return nil, fmt.Errorf("dkim: message has no From header")
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=" + string(hc) + "/" + string(bc),
+		"d=" + o.Domain,
+		"s=" + o.Selector,
+	}
+	if !o.Time.IsZero() {
+		tags = append(tags, "t="+strconv.FormatInt(o.Time.Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signedNames, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=")
+	field := "DKIM-Signature: " + strings.Join(tags, "; ")
+
+	h := sha256.New()
+	for _, header := range selected {
+		h.Write([]byte(CanonicalHeader(header, hc)))
+	}
+	h.Write([]byte(strings.TrimSuffix(CanonicalHeader(field, hc), "\r\n")))
+	digest := h.Sum(nil)
+
+	sig, err := o.Signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: signing: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString(field)
+	out.WriteString(base64.StdEncoding.EncodeToString(sig))
+	out.WriteString("\r\n")
+	out.Write(message)
+	return out.Bytes(), nil
+}
+
+func algorithmFor(signer crypto.Signer) (string, crypto.Hash, error) {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA.
+		return "ed25519-sha256", crypto.Hash(0), nil
+	}
+	return "", 0, fmt.Errorf("dkim: unsupported key type %T", signer)
+}
+
+// SplitMessage splits a CRLF delimited message into its header
+// fields, each including continuation lines and the trailing CRLF,
+// and its body.
+func SplitMessage(message []byte) ([]string, []byte) {
+	var body []byte
+	head := message
+	if ix := bytes.Index(message, []byte("\r\n\r\n")); ix >= 0 {
+		head, body = message[:ix+2], message[ix+4:]
+	}
+
+	headers := []string{}
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+			continue
+		}
+		headers = append(headers, line)
+	}
+	return headers, body
+}
+
+// SelectHeaders picks the header fields named in names, in order. A
+// name listed more than once selects successive instances of that
+// field starting from the bottom of the header, as RFC 6376 requires.
+// Names that are not present are left out of the returned list.
+func SelectHeaders(headers []string, names []string) (selected []string, signed []string) {
+	used := map[int]bool{}
+	for _, name := range names {
+		for ix := len(headers) - 1; ix >= 0; ix-- {
+			if used[ix] || !strings.EqualFold(headerName(headers[ix]), name) {
+				continue
+			}
+			used[ix] = true
+			selected = append(selected, headers[ix])
+			signed = append(signed, name)
+			break
+		}
+	}
+	return selected, signed
+}
+
+func headerName(header string) string {
+	if ix := strings.IndexByte(header, ':'); ix >= 0 {
+		return strings.TrimSpace(header[:ix])
+	}
+	return ""
+}
+
+// CanonicalHeader canonicalizes a single header field, including its
+// trailing CRLF.
+func CanonicalHeader(header string, c Canonicalization) string {
+	if c != Relaxed {
+		return header
+	}
+	ix := strings.IndexByte(header, ':')
+	if ix < 0 {
+		return header
+	}
+	name := strings.ToLower(strings.TrimSpace(header[:ix]))
+	value := strings.Replace(header[ix+1:], "\r\n", "", -1)
+	value = strings.TrimSpace(compressWSP(value))
+	return name + ":" + value + "\r\n"
+}
+
+// CanonicalBody canonicalizes a CRLF delimited message body.
+func CanonicalBody(body []byte, c Canonicalization) []byte {
+	if c == Relaxed {
+		lines := strings.Split(string(body), "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(compressWSP(line), " ")
+		}
+		body = []byte(strings.Join(lines, "\r\n"))
+	}
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		if c == Relaxed {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return append(body, '\r', '\n')
+}
+
+func compressWSP(s string) string {
+	b := &strings.Builder{}
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func normalizeLineEndings(message []byte) []byte {
+	message = bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(message, []byte("\n"), []byte("\r\n"), -1)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
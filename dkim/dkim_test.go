@@ -0,0 +1,178 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "From: \"Joe SixPack\" <joe@football.example.com>\r\n" +
+	"To: \"Suzie Q\" <suzie@shopping.example.net>\r\n" +
+	"Subject:   Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.  \r\n" +
+	"\r\n" +
+	"We lost the game.\tAre you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n" +
+	"\r\n\r\n"
+
+func TestSignVerify(t *testing.T) {
+	tests := []struct {
+		key            string
+		canonicalize   string
+		expectedHeader string
+	}{
+		{key: "rsa.pem", canonicalize: "relaxed/relaxed", expectedHeader: "a=rsa-sha256; c=relaxed/relaxed"},
+		{key: "rsa.pem", canonicalize: "simple/simple", expectedHeader: "a=rsa-sha256; c=simple/simple"},
+		{key: "ed25519.pem", canonicalize: "relaxed/simple", expectedHeader: "a=ed25519-sha256; c=relaxed/simple"},
+		{key: "ed25519.pem", canonicalize: "simple", expectedHeader: "a=ed25519-sha256; c=simple/simple"},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		key, err := LoadPrivateKey(filepath.Join("testdata", test.key))
+		if err != nil {
+			t.Fatalf("loading key: %v", err)
+		}
+		hc, bc, err := ParseCanonicalization(test.canonicalize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o := &Options{
+			Domain: "example.com", Selector: "brisbane", Signer: key,
+			HeaderCanonicalization: hc, BodyCanonicalization: bc,
+			Time: time.Unix(1057990837, 0),
+		}
+		signed, err := Sign([]byte(testMessage), o)
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		if !bytes.HasPrefix(signed, []byte("DKIM-Signature: v=1; "+test.expectedHeader+"; d=example.com; s=brisbane; t=1057990837; h=From:Subject:Date:To:Message-ID; bh=")) {
+			t.Errorf("unexpected signature header:\n%s", signed)
+		}
+		if err = verify(signed, key.Public()); err != nil {
+			t.Errorf("verification failed: %v", err)
+		}
+
+		tampered := bytes.Replace(signed, []byte("lost the game"), []byte("won the game"), 1)
+		if err = verify(tampered, key.Public()); err == nil {
+			t.Errorf("verification of tampered body succeeded")
+		}
+		tampered = bytes.Replace(signed, []byte("Is dinner ready?"), []byte("Is lunch ready?"), 1)
+		if err = verify(tampered, key.Public()); err == nil {
+			t.Errorf("verification of tampered header succeeded")
+		}
+	}
+}
+
+func TestRelaxedToleratesWhitespace(t *testing.T) {
+	key, err := LoadPrivateKey(filepath.Join("testdata", "rsa.pem"))
+	if err != nil {
+		t.Fatalf("loading key: %v", err)
+	}
+	signed, err := Sign([]byte(testMessage), &Options{
+		Domain: "example.com", Selector: "brisbane", Signer: key,
+		HeaderCanonicalization: Relaxed, BodyCanonicalization: Relaxed})
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	// relays may refold headers and pad whitespace
+	rewrapped := bytes.Replace(signed, []byte("Subject:   Is dinner ready?"), []byte("subject: Is dinner\r\n\tready?  "), 1)
+	rewrapped = bytes.Replace(rewrapped, []byte("Hi.  \r\n"), []byte("Hi. \t\r\n"), 1)
+	if err = verify(rewrapped, key.Public()); err != nil {
+		t.Errorf("relaxed verification failed: %v", err)
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	tests := []struct {
+		body    string
+		simple  string
+		relaxed string
+	}{
+		{body: "", simple: "\r\n", relaxed: ""},
+		{body: "\r\n\r\n", simple: "\r\n", relaxed: ""},
+		{body: " C \r\nD \t E\r\n\r\n\r\n", simple: " C \r\nD \t E\r\n", relaxed: " C\r\nD E\r\n"},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if simple := string(CanonicalBody([]byte(test.body), Simple)); simple != test.simple {
+			t.Errorf("simple: expected %q, got %q", test.simple, simple)
+		}
+		if relaxed := string(CanonicalBody([]byte(test.body), Relaxed)); relaxed != test.relaxed {
+			t.Errorf("relaxed: expected %q, got %q", test.relaxed, relaxed)
+		}
+	}
+}
+
+var tagRE = regexp.MustCompile(`\s+`)
+
+// verify is a minimal DKIM verifier for the first DKIM-Signature
+// header of message, using pub in place of a DNS key lookup.
+func verify(message []byte, pub crypto.PublicKey) error {
+	headers, body := SplitMessage(message)
+	if len(headers) == 0 || !strings.EqualFold(headerName(headers[0]), "DKIM-Signature") {
+		return fmt.Errorf("no DKIM-Signature header")
+	}
+	field := headers[0]
+
+	tags := map[string]string{}
+	value := field[strings.IndexByte(field, ':')+1:]
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = tagRE.ReplaceAllString(kv[1], "")
+		}
+	}
+	hc, bc, err := ParseCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+
+	bodyHash := sha256.Sum256(CanonicalBody(body, bc))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fmt.Errorf("body hash mismatch")
+	}
+
+	h := sha256.New()
+	selected, _ := SelectHeaders(headers[1:], strings.Split(tags["h"], ":"))
+	for _, header := range selected {
+		h.Write([]byte(CanonicalHeader(header, hc)))
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(strings.TrimSuffix(field, "\r\n"), "b=")
+	h.Write([]byte(strings.TrimSuffix(CanonicalHeader(unsigned+"\r\n", hc), "\r\n")))
+	digest := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest, sig)
+	case "ed25519-sha256":
+		if !ed25519.Verify(pub.(ed25519.PublicKey), digest, sig) {
+			return fmt.Errorf("ed25519 signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown algorithm %q", tags["a"])
+}
@@ -0,0 +1,332 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mqd // import "jw4.us/mqd"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format names a settings file encoding.
+type Format string
+
+// Formats
+const (
+	JSON Format = "json"
+	YAML Format = "yaml"
+	TOML Format = "toml"
+)
+
+// FormatForPath returns the Format implied by the extension of path,
+// or an empty Format if the extension is not recognized.
+func FormatForPath(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return JSON
+	case ".yaml", ".yml":
+		return YAML
+	case ".toml":
+		return TOML
+	}
+	return ""
+}
+
+// SniffFormat inspects raw settings content and guesses the Format it
+// is written in. JSON is assumed for empty content and whenever the
+// document opens with a brace.
+func SniffFormat(raw []byte) Format {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || trimmed[0] == '{' {
+		return JSON
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return TOML
+		}
+		eq, colon := strings.Index(line, "="), strings.Index(line, ":")
+		if eq >= 0 && (colon < 0 || eq < colon) {
+			return TOML
+		}
+		return YAML
+	}
+	return YAML
+}
+
+// ReadSettings reads the settings file at path, choosing the Format
+// by file extension or, failing that, by sniffing the content. Any
+// include directives are resolved relative to the folder holding the
+// settings file.
+//
+// Global values (folders, interval) are only taken from the main
+// file; included files may only contribute connections, and a
+// connection key defined in more than one file is an error.
+func ReadSettings(path string) (*Settings, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := FormatForPath(path)
+	if format == "" {
+		format = SniffFormat(raw)
+	}
+	s, err := UnmarshalSettingsFormat(raw, format)
+	if err != nil {
+		return s, fmt.Errorf("%s: %v", path, err)
+	}
+	s.dir = filepath.Dir(path)
+	if err = s.resolveIncludes(s.dir); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// UnmarshalSettingsFormat converts raw bytes in the given Format into
+// the Settings configuration object. Include directives are recorded
+// but not resolved; use ReadSettings to load included files.
+func UnmarshalSettingsFormat(raw []byte, format Format) (*Settings, error) {
+	s := &Settings{Format: format}
+	doc, err := decodeDocument(raw, format)
+	if err != nil {
+		return s, err
+	}
+	if s.migratedFrom, err = migrateDocument(doc); err != nil {
+		return s, err
+	}
+	if err = documentToSettings(doc, s); err != nil {
+		return s, err
+	}
+	s.Format = format
+	return s, s.validate()
+}
+
+// MarshalSettings encodes the Settings in its source Format, falling
+// back to JSON. Connections that were loaded from included files are
+// left out, so that the include directive round-trips intact.
+func MarshalSettings(s *Settings) ([]byte, error) {
+	out := *s
+	if len(s.sources) > 0 {
+		out.C = map[string]ConnectionDetails{}
+		for key, details := range s.C {
+			if _, ok := s.sources[key]; !ok {
+				out.C[key] = details
+			}
+		}
+	}
+
+	switch s.Format {
+	case "", JSON:
+		return json.MarshalIndent(&out, "", "  ")
+	case YAML, TOML:
+		raw, err := json.Marshal(&out)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeDocument(raw, JSON)
+		if err != nil {
+			return nil, err
+		}
+		return encodeDocument(doc, s.Format)
+	}
+	return nil, fmt.Errorf("unknown settings format %q", string(s.Format))
+}
+
+// resolveIncludes loads every file named by the include directives
+// and merges their connections into s.
+func (s *Settings) resolveIncludes(base string) error {
+	for _, pattern := range s.Include {
+		files, err := includedFiles(base, pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = s.mergeInclude(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Settings) mergeInclude(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	format := FormatForPath(path)
+	if format == "" {
+		format = SniffFormat(raw)
+	}
+	doc, err := decodeDocument(raw, format)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for key := range doc {
+		if key != "connections" && key != "version" {
+			return fmt.Errorf("%s: only connections may be set in included files, found %q", path, key)
+		}
+	}
+	if _, err = migrateDocument(doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	delete(doc, "version")
+	inc := &Settings{}
+	if err = documentToSettings(doc, inc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	if s.C == nil {
+		s.C = map[string]ConnectionDetails{}
+	}
+	if s.sources == nil {
+		s.sources = map[string]string{}
+	}
+	for key, details := range inc.C {
+		if err = details.validate(key); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, ok := s.C[key]; ok {
+			origin := s.sources[key]
+			if origin == "" {
+				origin = "main settings file"
+			}
+			return fmt.Errorf("%s: duplicate connection %q, already defined in %s", path, key, origin)
+		}
+		s.C[key] = details
+		s.sources[key] = path
+	}
+	return nil
+}
+
+// includedFiles expands an include pattern. A folder includes every
+// settings file inside it, anything else is treated as a glob.
+// Results are sorted so that load order is predictable.
+func includedFiles(base string, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(base, pattern)
+	}
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		infos, err := ioutil.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{}
+		for _, info := range infos {
+			if info.Mode().IsRegular() && FormatForPath(info.Name()) != "" {
+				files = append(files, filepath.Join(pattern, info.Name()))
+			}
+		}
+		return files, nil
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("include %q: %v", pattern, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// decodeDocument parses raw bytes into a generic document. Every
+// format goes through this intermediate form so that the Settings
+// struct only needs to describe itself once, with json tags.
+func decodeDocument(raw []byte, format Format) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return doc, nil
+	}
+
+	var err error
+	switch format {
+	case "", JSON:
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		err = d.Decode(&doc)
+	case YAML:
+		err = yaml.Unmarshal(raw, &doc)
+	case TOML:
+		err = toml.Unmarshal(raw, &doc)
+	default:
+		err = fmt.Errorf("unknown settings format %q", string(format))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeValue(doc).(map[string]interface{}), nil
+}
+
+func encodeDocument(doc map[string]interface{}, format Format) ([]byte, error) {
+	switch format {
+	case "", JSON:
+		return json.MarshalIndent(doc, "", "  ")
+	case YAML:
+		return yaml.Marshal(doc)
+	case TOML:
+		buf := &bytes.Buffer{}
+		err := toml.NewEncoder(buf).Encode(doc)
+		return buf.Bytes(), err
+	}
+	return nil, fmt.Errorf("unknown settings format %q", string(format))
+}
+
+func documentToSettings(doc map[string]interface{}, s *Settings) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, s)
+}
+
+// normalizeValue converts decoder specific types into the plain
+// types shared by every format: string keyed maps, int64 for whole
+// numbers and float64 for the rest.
+func normalizeValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = normalizeValue(item)
+		}
+		return val
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, item := range val {
+			m[fmt.Sprint(k)] = normalizeValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = normalizeValue(item)
+		}
+		return val
+	case []map[string]interface{}:
+		list := make([]interface{}, len(val))
+		for i, item := range val {
+			list[i] = normalizeValue(item)
+		}
+		return list
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case int:
+		return int64(val)
+	}
+	return v
+}
@@ -0,0 +1,203 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package health checks that the dispatcher is running and able to
+// deliver: that the settings are valid, the queue folders writable,
+// the dispatch loop ticking, and, when asked, that the configured
+// connections answer.
+package health // import "jw4.us/mqd/health"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+	"jw4.us/mqd/mailer"
+)
+
+// staleScans is how many intervals may pass without a successful scan
+// before the dispatch loop counts as stuck.
+const staleScans = 3
+
+// Check is the outcome of one check.
+type Check struct {
+	Name    string    `json:"name"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+	// Skipped checks can't be run, such as probes of direct
+	// connections, and count as OK.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// OK reports whether all checks passed.
+func OK(checks []Check) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Checker runs the checks, caching probe results.
+type Checker struct {
+	load    func() (*mqd.Settings, error)
+	loop    bool
+	log     *slog.Logger
+	started time.Time
+	// probe is swapped out in tests.
+	probe func(*mqd.Settings, mqd.ConnectionDetails) error
+
+	mu     sync.Mutex
+	probes map[string]Check
+}
+
+// NewChecker returns a Checker of the settings load returns. When loop
+// is set the dispatch loop must be running in this process, and is
+// checked to have scanned the mailqueue recently. Failed probes are
+// logged to log, or the default logger when it is nil.
+func NewChecker(load func() (*mqd.Settings, error), loop bool, log *slog.Logger) *Checker {
+	return &Checker{load: load, loop: loop, log: logging.Or(log), started: time.Now(), probe: mailer.Probe, probes: map[string]Check{}}
+}
+
+// Health runs the checks that tell whether the service is alive: the
+// settings, the queue folders and the dispatch loop.
+func (c *Checker) Health() []Check {
+	checks, _ := c.health()
+	return checks
+}
+
+func (c *Checker) health() ([]Check, *mqd.Settings) {
+	now := time.Now()
+	s, err := c.load()
+	checks := []Check{result("settings", now, err)}
+	if err != nil {
+		return checks, nil
+	}
+
+	folders := []struct{ name, path string }{{"mailqueue", s.MailQueue}, {"badmail", s.BadMail}}
+	if s.SentMail != "" {
+		folders = append(folders, struct{ name, path string }{"sentmail", s.SentMail})
+	}
+	for _, folder := range folders {
+		checks = append(checks, result("folder "+folder.name, now, writable(folder.path)))
+	}
+
+	if c.loop {
+		last := dispatcher.LastScan()
+		if last.Before(c.started) {
+			last = c.started
+		}
+		err = nil
+		if limit := staleScans * time.Duration(s.Interval); now.Sub(last) > limit {
+			err = fmt.Errorf("no successful scan of the mailqueue since %s", last.Format(time.RFC3339))
+		}
+		checks = append(checks, result("dispatcher", now, err))
+	}
+	return checks, s
+}
+
+// Ready runs the Health checks and, when probe is set, probes each
+// connection. Probe results younger than maxAge are reused.
+func (c *Checker) Ready(probe bool, maxAge time.Duration) []Check {
+	checks, s := c.health()
+	if !probe || s == nil {
+		return checks
+	}
+
+	keys := make([]string, 0, len(s.C))
+	for key := range s.C {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	probes := make([]Check, len(keys))
+	var wg sync.WaitGroup
+	for ix, key := range keys {
+		c.mu.Lock()
+		cached, ok := c.probes[key]
+		c.mu.Unlock()
+		if ok && time.Since(cached.Checked) < maxAge {
+			probes[ix] = cached
+			continue
+		}
+		wg.Add(1)
+		go func(ix int, key string) {
+			defer wg.Done()
+			err := c.probe(s, s.C[key])
+			check := result("connection "+key, time.Now(), err)
+			if err == mailer.ErrNoProbe {
+				check = Check{Name: check.Name, OK: true, Checked: check.Checked, Skipped: true}
+			} else if err != nil {
+				c.log.Warn("probe failed", logging.Connection, key, logging.Err(err), logging.Code(err))
+			}
+			probes[ix] = check
+			c.mu.Lock()
+			c.probes[key] = check
+			c.mu.Unlock()
+		}(ix, key)
+	}
+	wg.Wait()
+	return append(checks, probes...)
+}
+
+// Handler serves /healthz with the Health checks and /readyz with the
+// Ready checks, answering 503 when any of them fail.
+func (c *Checker) Handler(probe bool, maxAge time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, c.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeChecks(w, c.Ready(probe, maxAge))
+	})
+	return mux
+}
+
+func writeChecks(w http.ResponseWriter, checks []Check) {
+	body := struct {
+		Status string  `json:"status"`
+		Checks []Check `json:"checks"`
+	}{"ok", checks}
+	code := http.StatusOK
+	if !OK(checks) {
+		body.Status, code = "failing", http.StatusServiceUnavailable
+	}
+	raw, _ := json.MarshalIndent(body, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(raw, '\n'))
+}
+
+func result(name string, checked time.Time, err error) Check {
+	check := Check{Name: name, OK: err == nil, Checked: checked}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// writable checks that folder exists and that entries can be created
+// in it. A folder is created rather than a file, which the dispatcher
+// would pick up as a message.
+func writable(folder string) error {
+	if folder == "" {
+		return fmt.Errorf("not configured")
+	}
+	dir, err := ioutil.TempDir(folder, ".mqd-health-")
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
@@ -0,0 +1,84 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package health
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/mailer"
+	"jw4.us/mqd/smtp/smtptest"
+)
+
+func TestChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	s := mqd.NewSettings(filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail"))
+	for _, folder := range []string{s.MailQueue, s.BadMail} {
+		if err = os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := smtptest.NewServer()
+	defer server.Close()
+	s.C["up@example.com"] = mqd.ConnectionDetails{Sender: "up@example.com", Server: server.Addr, Host: "127.0.0.1",
+		AuthType: mqd.PlainAuth, Username: "u", Password: "p"}
+	s.C["down@example.com"] = mqd.ConnectionDetails{Sender: "down@example.com", Server: "127.0.0.1:1", Host: "127.0.0.1",
+		AuthType: mqd.PlainAuth, Username: "u", Password: "p"}
+	s.C["direct@example.com"] = mqd.ConnectionDetails{Sender: "direct@example.com", Type: mqd.ConnectionDirect}
+
+	var loadErr error
+	c := NewChecker(func() (*mqd.Settings, error) { return s, loadErr }, true, nil)
+	if checks := c.Health(); !OK(checks) || len(checks) != 4 {
+		t.Errorf("expected 4 passing checks, got %+v", checks)
+	}
+
+	checks := c.Ready(true, time.Minute)
+	results := map[string]Check{}
+	for _, check := range checks {
+		results[check.Name] = check
+	}
+	if OK(checks) || !results["connection up@example.com"].OK || results["connection down@example.com"].OK ||
+		!results["connection direct@example.com"].Skipped {
+		t.Errorf("unexpected checks %+v", checks)
+	}
+	if commands := strings.Join(server.Commands(), " "); !strings.Contains(commands, "AUTH") || strings.Contains(commands, "MAIL") {
+		t.Errorf("expected a probe without a mail transaction, got %q", commands)
+	}
+
+	// cached results are reused
+	// probes run concurrently
+	var probed int32
+	c.probe = func(*mqd.Settings, mqd.ConnectionDetails) error { atomic.AddInt32(&probed, 1); return mailer.ErrNoProbe }
+	c.Ready(true, time.Minute)
+	if n := atomic.LoadInt32(&probed); n != 0 {
+		t.Errorf("expected cached probes, probed %d connections", n)
+	}
+	c.Ready(true, 0)
+	if n := atomic.LoadInt32(&probed); n != 3 {
+		t.Errorf("expected 3 probes, got %d", n)
+	}
+
+	c.started = time.Now().Add(-time.Hour)
+	if checks := c.Health(); OK(checks) || checks[len(checks)-1].Name != "dispatcher" || checks[len(checks)-1].OK {
+		t.Errorf("expected a stuck dispatcher, got %+v", checks)
+	}
+
+	loadErr = errors.New("bad settings")
+	if checks := c.Ready(true, 0); OK(checks) || len(checks) != 1 {
+		t.Errorf("expected just the failing settings check, got %+v", checks)
+	}
+}
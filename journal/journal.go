@@ -0,0 +1,116 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package journal keeps a durable record of every attempt to deliver
+// a message, and of its final outcome, as JSON lines in a rotated
+// file. Records outlive the messages, which are removed or moved to
+// the sentmail folder once they are sent.
+package journal // import "jw4.us/mqd/journal"
+
+import (
+	"encoding/json"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+)
+
+// Record is one attempt to deliver a message.
+type Record struct {
+	Time time.Time `json:"time"`
+	// ID is the name of the message file in the mailqueue.
+	ID         string   `json:"id"`
+	MessageID  string   `json:"message_id,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	// Dropped lists the recipient entries that could not be read.
+	Dropped []string `json:"dropped,omitempty"`
+	// Connection is the account the message was handed to.
+	Connection string `json:"connection,omitempty"`
+	// Result is sent, deferred or failed.
+	Result  string `json:"result"`
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error,omitempty"`
+	// Deliveries holds the outcome for each recipient when they
+	// differ.
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+	// Final is set when the message left the mailqueue, sent or
+	// moved to the badmail folder.
+	Final bool `json:"final,omitempty"`
+}
+
+// Delivery is the outcome of an attempt for one recipient.
+type Delivery struct {
+	Recipient string `json:"recipient"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Outcome returns the result of the Record for rcpt, which must be
+// one of its recipients.
+func (r Record) Outcome(rcpt string) Delivery {
+	for _, d := range r.Deliveries {
+		if d.Recipient == rcpt {
+			return d
+		}
+	}
+	return Delivery{Recipient: rcpt, Result: r.Result, Error: r.Error}
+}
+
+// Journal appends Records to the journal file. It fulfills the
+// dispatcher.Journal interface.
+type Journal struct {
+	file *logging.RotatingFile
+	now  func() time.Time
+}
+
+// Open opens the journal described by s, which must have its Path
+// resolved, creating it if needed.
+func Open(s mqd.JournalSettings) (*Journal, error) {
+	if s.MaxSize == 0 {
+		s.MaxSize = mqd.DefaultJournalMaxSize
+	}
+	if s.MaxFiles == 0 {
+		s.MaxFiles = mqd.DefaultJournalMaxFiles
+	}
+	f, err := logging.OpenRotating(s.Path, s.MaxSize, s.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: f, now: time.Now}, nil
+}
+
+// Record implements the dispatcher.Journal interface
+func (j *Journal) Record(id string, subject string, report dispatcher.Report) error {
+	r := Record{
+		Time:       j.now(),
+		ID:         id,
+		MessageID:  report.MessageID,
+		Subject:    subject,
+		Sender:     report.Sender,
+		Recipients: report.Recipients,
+		Dropped:    report.Dropped,
+		Connection: report.Connection,
+		Result:     report.Result.String(),
+		Attempt:    report.Attempts,
+		Error:      report.Error,
+		Final:      report.Result != dispatcher.Deferred,
+	}
+	for _, d := range report.Deliveries {
+		r.Deliveries = append(r.Deliveries, Delivery{Recipient: d.Recipient, Result: d.Result.String(), Error: d.Error})
+	}
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(raw, '\n'))
+	return err
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,128 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package journal
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	mailqueue, badmail := filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail")
+	for _, folder := range []string{mailqueue, badmail} {
+		if err = os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := "From: app@example.com\r\nTo: bob@x.com, carol@x.com\r\nSubject: Invoice #123\r\n\r\nbody\r\n"
+	if err = ioutil.WriteFile(filepath.Join(mailqueue, "invoice.eml"), []byte(message), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a small MaxSize rotates the journal after every record
+	path := filepath.Join(dir, "journal.jsonl")
+	j, err := Open(mqd.JournalSettings{Path: path, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := dispatcher.NewPickupFolderQueue(mailqueue, badmail, "", dispatcher.QueueOptions{Journal: j})
+	reports := []dispatcher.Report{{
+		Result: dispatcher.Deferred, MessageID: "<1@example.com>", Sender: "app@example.com", Connection: "app@example.com",
+		Recipients: []string{"bob@x.com", "carol@x.com"},
+		Deliveries: []dispatcher.Delivery{
+			{Recipient: "bob@x.com", Result: dispatcher.Sent},
+			{Recipient: "carol@x.com", Result: dispatcher.Deferred, Error: "452 mailbox full"},
+		},
+	}, {
+		Result: dispatcher.Sent, MessageID: "<1@example.com>", Sender: "app@example.com", Connection: "app@example.com",
+		Recipients: []string{"carol@x.com"},
+	}}
+	for _, report := range reports {
+		report := report
+		if err = q.Process(func([]byte, *dispatcher.Envelope) dispatcher.Report { return report }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path + ".1"); err != nil {
+		t.Fatalf("expected a rotated journal: %v", err)
+	}
+
+	yesterday := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
+	for ix, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"deferred 1", "sent 2"}},
+		{"message_id=1@example.com&final=true", []string{"sent 2"}},
+		{"subject=invoice+%23123&recipient=bob@x.com&result=sent", []string{"deferred 1"}},
+		{"recipient=carol&result=deferred", []string{"deferred 1"}},
+		{"recipient=dave", nil},
+		{"connection=APP@example.com&since=" + yesterday, []string{"deferred 1", "sent 2"}},
+		{"until=" + yesterday, nil},
+	} {
+		t.Logf("Test %d", ix)
+		values, _ := url.ParseQuery(test.query)
+		query, err := ParseQuery(values, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := Read(path, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range records {
+			if r.ID != "invoice.eml" || r.Subject != "Invoice #123" {
+				t.Errorf("unexpected record %+v", r)
+			}
+			got = append(got, r.Result+" "+string(rune('0'+r.Attempt)))
+		}
+		if strings.Join(got, ", ") != strings.Join(test.expected, ", ") {
+			t.Errorf("expected %v, got %v", test.expected, got)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC)
+	for ix, test := range []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2017-01-01T00:00:00Z", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2017-01-01", time.Date(2017, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"2017-01-01 12:30", time.Date(2017, 1, 1, 12, 30, 0, 0, time.Local)},
+		{"24h", now.Add(-24 * time.Hour)},
+		{"yesterday", time.Time{}},
+	} {
+		t.Logf("Test %d", ix)
+		got, err := ParseTime(test.value, now)
+		if test.expected.IsZero() {
+			if err == nil {
+				t.Errorf("expected an error, got %v", got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(test.expected) {
+			t.Errorf("expected %v, got %v (%v)", test.expected, got, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package journal // import "jw4.us/mqd/journal"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects journal Records. Its zero value selects them all.
+type Query struct {
+	// ID and MessageID match exactly; the angle brackets of a
+	// MessageID may be left out.
+	ID        string
+	MessageID string
+	// Sender, Recipient, Connection and Subject match substrings,
+	// ignoring case.
+	Sender     string
+	Recipient  string
+	Connection string
+	Subject    string
+	// Result is sent, deferred or failed. With a Recipient it is
+	// matched against the outcome for that recipient.
+	Result string
+	// Since and Until limit the time of the Records.
+	Since time.Time
+	Until time.Time
+	// Final selects only the last Record of each message.
+	Final bool
+}
+
+// Match reports whether the Record passes the query.
+func (q Query) Match(r Record) bool {
+	if q.ID != "" && q.ID != r.ID {
+		return false
+	}
+	if q.MessageID != "" && strings.Trim(q.MessageID, "<>") != strings.Trim(r.MessageID, "<>") {
+		return false
+	}
+	if !contains(r.Sender, q.Sender) || !contains(r.Connection, q.Connection) || !contains(r.Subject, q.Subject) {
+		return false
+	}
+	if q.Final && !r.Final {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	if q.Recipient == "" {
+		return q.Result == "" || q.Result == r.Result
+	}
+	for _, rcpt := range r.Recipients {
+		if contains(rcpt, q.Recipient) && (q.Result == "" || q.Result == r.Outcome(rcpt).Result) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(value, part string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(part))
+}
+
+// Read returns the Records in the journal at path, and in its rotated
+// files, that match q, oldest first.
+func Read(path string, q Query) ([]Record, error) {
+	files := []string{path}
+	for n := 1; ; n++ {
+		rotated := fmt.Sprintf("%s.%d", path, n)
+		if _, err := os.Stat(rotated); err != nil {
+			break
+		}
+		files = append([]string{rotated}, files...)
+	}
+
+	var records []Record
+	for _, file := range files {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			var r Record
+			if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			if q.Match(r) {
+				records = append(records, r)
+			}
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// ParseTime reads a time given as RFC 3339, as a local date or date
+// and time ("2006-01-02", "2006-01-02 15:04"), or as a duration before
+// now ("24h").
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// ParseQuery reads a Query from URL query parameters named after its
+// fields: id, message_id, sender, recipient, connection, subject,
+// result, since, until and final.
+func ParseQuery(values url.Values, now time.Time) (Query, error) {
+	q := Query{
+		ID:         values.Get("id"),
+		MessageID:  values.Get("message_id"),
+		Sender:     values.Get("sender"),
+		Recipient:  values.Get("recipient"),
+		Connection: values.Get("connection"),
+		Subject:    values.Get("subject"),
+		Result:     strings.ToLower(values.Get("result")),
+	}
+	var err error
+	if v := values.Get("since"); v != "" {
+		if q.Since, err = ParseTime(v, now); err != nil {
+			return q, err
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if q.Until, err = ParseTime(v, now); err != nil {
+			return q, err
+		}
+	}
+	if v := values.Get("final"); v != "" {
+		if q.Final, err = strconv.ParseBool(v); err != nil {
+			return q, fmt.Errorf("invalid final %q", v)
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package logging builds the structured loggers that are handed to the
+// other packages, and names the attributes they share so the records
+// about one message can be found together.
+package logging // import "jw4.us/mqd/logging"
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"os"
+
+	"jw4.us/mqd"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+// Attribute keys used across packages.
+const (
+	MessageID  = "message_id"
+	File       = "file"
+	Sender     = "sender"
+	Recipients = "recipients" // the number of recipients
+	Connection = "connection"
+	Duration   = "duration"
+	SMTPCode   = "smtp_code"
+	Remote     = "remote"
+	Error      = "error"
+)
+
+// New returns a logger that writes records to w in the format, and
+// from the level, of s.
+func New(s mqd.LogSettings, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{}
+	if s.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(s.Level)); err == nil {
+			opts.Level = level
+		}
+	}
+	if s.Format == mqd.LogJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Open opens the output of s: standard error, or else the file named
+// by s.Output, rotated as configured. Closing standard error is a no-op.
+func Open(s mqd.LogSettings) (io.WriteCloser, error) {
+	if s.Output == "" || s.Output == mqd.LogStderr {
+		return nopCloser{os.Stderr}, nil
+	}
+	return OpenRotating(s.Output, s.MaxSize, s.MaxFiles)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// Err returns the error attribute for err.
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.String(Error, err.Error())
+}
+
+// Code returns the smtp_code attribute for the SMTP reply carried by
+// err, or an empty attribute, which handlers leave out, when there is
+// none.
+func Code(err error) slog.Attr {
+	var re *mqdsmtp.RecipientsError
+	if errors.As(err, &re) && len(re.Rejected) > 0 {
+		err = re.Rejected[0].Err
+	}
+	var rcpt *mqdsmtp.RecipientError
+	if errors.As(err, &rcpt) {
+		err = rcpt.Err
+	}
+	var te *textproto.Error
+	if errors.As(err, &te) {
+		return slog.Int(SMTPCode, te.Code)
+	}
+	return slog.Attr{}
+}
+
+// Or returns l, or the default logger when l is nil.
+func Or(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
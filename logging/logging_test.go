@@ -0,0 +1,124 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jw4.us/mqd"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+func TestNew(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := New(mqd.LogSettings{Format: mqd.LogJSON, Level: "warn"}, buf)
+	log.Info("dropped")
+	err := &textproto.Error{Code: 451, Msg: "try later"}
+	log.Warn("deferred", MessageID, "<1@example.com>", Recipients, 2, Err(err), Code(err), Code(nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 record, got %d: %q", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]interface{}{
+		"msg": "deferred", "level": "WARN", MessageID: "<1@example.com>", Recipients: 2.0,
+		Error: err.Error(), SMTPCode: 451.0,
+	} {
+		if record[key] != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, record[key])
+		}
+	}
+	if _, ok := record[""]; ok {
+		t.Errorf("empty attribute logged: %v", record)
+	}
+}
+
+func TestCode(t *testing.T) {
+	for ix, test := range []struct {
+		err      error
+		expected int64
+	}{
+		{nil, 0},
+		{errors.New("plain"), 0},
+		{&textproto.Error{Code: 550, Msg: "no"}, 550},
+		{fmt.Errorf("wrapped: %w", &textproto.Error{Code: 535}), 535},
+		{&mqdsmtp.RecipientError{Recipient: "a@b.c", Err: &textproto.Error{Code: 452}}, 452},
+		{&mqdsmtp.RecipientsError{Rejected: []*mqdsmtp.RecipientError{{Recipient: "a@b.c", Err: &textproto.Error{Code: 550}}}}, 550},
+	} {
+		t.Logf("Test %d", ix)
+		attr := Code(test.err)
+		if test.expected == 0 {
+			if attr.Key != "" {
+				t.Errorf("expected no code, got %v", attr)
+			}
+			continue
+		}
+		if attr.Key != SMTPCode || attr.Value.Int64() != test.expected {
+			t.Errorf("expected %d, got %v", test.expected, attr)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "mqd.log")
+
+	r, err := OpenRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ix := 0; ix < 5; ix++ {
+		if _, err = fmt.Fprintf(r, "record %d\n", ix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"mqd.log":   "record 4\n",
+		"mqd.log.1": "record 3\n",
+		"mqd.log.2": "record 2\n",
+	} {
+		raw, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, raw)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %v", err)
+	}
+
+	// reopening appends until the limit
+	if r, err = OpenRotating(path, 20, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fmt.Fprint(r, "more\n")
+	_ = r.Close()
+	if raw, _ := ioutil.ReadFile(path); string(raw) != "record 4\nmore\n" {
+		t.Errorf("expected appended record, got %q", raw)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/logging"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+// Resolver looks up the mail exchangers of recipient domains.
+// *net.Resolver fulfills it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// lookupTimeout limits each DNS lookup of a direct delivery.
+const lookupTimeout = 30 * time.Second
+
+// directTransport is the Transport of direct connections. Instead of
+// relaying through a configured server it delivers to the mail
+// exchangers of each recipient domain in turn, in order of
+// preference, falling back to the address of the domain itself when
+// it has no MX records.
+type directTransport struct {
+	log      *slog.Logger
+	resolver Resolver
+	// port mail exchangers listen on, normally 25.
+	port string
+	opts mqdsmtp.Options
+}
+
+func (m *smtpMailer) directTransport(connection mqd.ConnectionDetails) *directTransport {
+	d := &directTransport{log: m.log, resolver: m.resolver, port: m.mxPort}
+	d.opts.HelloName = connection.Host
+	if connection.TLS == mqd.TLSRequired {
+		d.opts.RequireTLS = true
+	} else {
+		d.opts.InsecureTLS = true
+	}
+	return d
+}
+
+// Deliver fulfills the Transport interface. Recipients that could not
+// be delivered to are listed in a *mqdsmtp.RecipientsError.
+func (d *directTransport) Deliver(from string, to []string, msg []byte) error {
+	var domains []string
+	byDomain := map[string][]string{}
+	for _, rcpt := range to {
+		ascii, _, err := mqdsmtp.ASCIIDomain(rcpt)
+		if err != nil {
+			return err
+		}
+		domain := strings.ToLower(ascii[strings.LastIndexByte(ascii, '@')+1:])
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], rcpt)
+	}
+
+	refused := &mqdsmtp.RecipientsError{Server: "mail exchangers of " + strings.Join(domains, ", ")}
+	for _, domain := range domains {
+		rcpts := byDomain[domain]
+		switch err := d.deliver(domain, from, rcpts, msg).(type) {
+		case nil:
+			refused.Delivered = true
+		case *mqdsmtp.RecipientsError:
+			refused.Rejected = append(refused.Rejected, err.Rejected...)
+			refused.Delivered = refused.Delivered || err.Delivered
+		default:
+			for _, rcpt := range rcpts {
+				refused.Rejected = append(refused.Rejected, &mqdsmtp.RecipientError{Recipient: rcpt, Err: err})
+			}
+		}
+	}
+	if len(refused.Rejected) > 0 {
+		return refused
+	}
+	return nil
+}
+
+// deliver sends msg to the recipients in domain, trying each of its
+// mail exchangers until one of them answers.
+func (d *directTransport) deliver(domain, from string, to []string, msg []byte) error {
+	hosts, err := d.exchangers(domain)
+	if err != nil {
+		return err
+	}
+
+	// a lookup that finds no address tries nothing, which must not
+	// pass for a delivery
+	lastErr := fmt.Errorf("no addresses found for the mail exchangers of %s", domain)
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		addrs, err := d.resolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("looking up %s: %v", host, err)
+			continue
+		}
+		opts := d.opts
+		opts.ServerName = host
+		for _, addr := range addrs {
+			err = mqdsmtp.Send(net.JoinHostPort(addr, d.port), nil, from, to, msg, opts)
+			if !retryElsewhere(err) {
+				if err == nil {
+					d.log.Debug("delivered", logging.Recipients, len(to), logging.Remote, addr, "host", host)
+				}
+				return err
+			}
+			d.log.Debug("trying next exchanger", logging.Recipients, len(to), logging.Remote, addr, "host", host,
+				logging.Err(err), logging.Code(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// exchangers returns the host names of the mail exchangers of domain,
+// most preferred first.
+func (d *directTransport) exchangers(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	mxs, err := d.resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("looking up MX of %s: %v", domain, err)
+		}
+	}
+	if len(mxs) == 0 {
+		// RFC 5321 5.1: without MX records the domain itself is the
+		// mail exchanger, if it has an address.
+		_, err = d.resolver.LookupHost(ctx, domain)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, &textproto.Error{Code: 550, Msg: "5.1.2 domain " + domain + " not found"}
+		}
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		// RFC 7505 null MX
+		return nil, &textproto.Error{Code: 556, Msg: "5.1.10 domain " + domain + " does not accept mail"}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, len(mxs))
+	for ix, mx := range mxs {
+		hosts[ix] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// retryElsewhere reports whether err leaves hope that another mail
+// exchanger of the domain will take the message. Refusals of the
+// message or its recipients are final for the domain.
+func retryElsewhere(err error) bool {
+	switch err := err.(type) {
+	case nil, *mqdsmtp.RecipientsError, *mqdsmtp.AddressError:
+		return false
+	case *textproto.Error:
+		return err.Code < 500
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"bytes"
+	"strings"
+)
+
+// rawHeader is an editable view of the header section of a raw
+// message. Fields keep their original folding and line endings, so
+// untouched fields are transmitted byte for byte.
+type rawHeader struct {
+	fields []string
+	eol    string
+	body   []byte
+}
+
+func splitRawHeader(message []byte) *rawHeader {
+	h := &rawHeader{eol: "\r\n"}
+	end := bytes.Index(message, []byte("\r\n\r\n"))
+	sep := 4
+	if lf := bytes.Index(message, []byte("\n\n")); lf >= 0 && (end < 0 || lf < end) {
+		end, sep, h.eol = lf, 2, "\n"
+	}
+	head := message
+	if end >= 0 {
+		head, h.body = message[:end+sep/2], message[end+sep:]
+	}
+
+	for _, line := range strings.SplitAfter(string(head), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(h.fields) > 0 {
+			h.fields[len(h.fields)-1] += line
+			continue
+		}
+		h.fields = append(h.fields, line)
+	}
+	return h
+}
+
+// Bytes reassembles the message.
+func (h *rawHeader) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, field := range h.fields {
+		buf.WriteString(field)
+	}
+	buf.WriteString(h.eol)
+	buf.Write(h.body)
+	return buf.Bytes()
+}
+
+// Has reports whether a field with the given name is present.
+func (h *rawHeader) Has(name string) bool {
+	return h.index(name) >= 0
+}
+
+// Set replaces the first field with the given name, removing any
+// others, or appends a new field if there was none.
+func (h *rawHeader) Set(name, value string) {
+	ix := h.index(name)
+	if ix < 0 {
+		h.Add(name, value)
+		return
+	}
+	h.fields[ix] = name + ": " + value + h.eol
+	for i := len(h.fields) - 1; i > ix; i-- {
+		if fieldName(h.fields[i]) == strings.ToLower(name) {
+			h.fields = append(h.fields[:i], h.fields[i+1:]...)
+		}
+	}
+}
+
+// Add appends a field to the header.
+func (h *rawHeader) Add(name, value string) {
+	h.fields = append(h.fields, name+": "+value+h.eol)
+}
+
+// Del removes every field with the given name.
+func (h *rawHeader) Del(name string) {
+	kept := h.fields[:0]
+	for _, field := range h.fields {
+		if fieldName(field) != strings.ToLower(name) {
+			kept = append(kept, field)
+		}
+	}
+	h.fields = kept
+}
+
+func (h *rawHeader) index(name string) int {
+	name = strings.ToLower(name)
+	for ix, field := range h.fields {
+		if fieldName(field) == name {
+			return ix
+		}
+	}
+	return -1
+}
+
+func fieldName(field string) string {
+	if ix := strings.IndexByte(field, ':'); ix >= 0 {
+		return strings.ToLower(strings.TrimSpace(field[:ix]))
+	}
+	return ""
+}
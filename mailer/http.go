@@ -0,0 +1,179 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"jw4.us/mqd"
+)
+
+// httpTimeout is the default timeout of requests to HTTP APIs.
+const httpTimeout = 30 * time.Second
+
+// httpTransport sends messages through a provider's HTTP API.
+type httpTransport struct {
+	client   *http.Client
+	settings mqd.HTTPSettings
+	username string
+	password string
+	template *template.Template
+	// temporary and permanent are nil unless configured.
+	temporary *regexp.Regexp
+	permanent *regexp.Regexp
+}
+
+// httpMessage is the data the body template of an http connection is
+// executed with.
+type httpMessage struct {
+	Sender     string
+	Recipients []string
+	Message    string
+	Base64     string
+}
+
+// httpTransport returns the transport of the http connection
+// configured under name. It is built once, reading the template and
+// compiling the patterns, and reused for every message until the
+// settings are loaded again.
+func (m *smtpMailer) httpTransport(name string, connection mqd.ConnectionDetails) (*httpTransport, error) {
+	m.transportsMu.Lock()
+	defer m.transportsMu.Unlock()
+	if t, ok := m.transports[name]; ok {
+		return t, nil
+	}
+	t, err := m.newHTTPTransport(connection)
+	if err != nil {
+		return nil, err
+	}
+	if m.transports == nil {
+		m.transports = map[string]*httpTransport{}
+	}
+	m.transports[name] = t
+	return t, nil
+}
+
+func (m *smtpMailer) newHTTPTransport(connection mqd.ConnectionDetails) (*httpTransport, error) {
+	if connection.HTTP == nil {
+		return nil, fmt.Errorf("http connection %q has no http settings", connection.Sender)
+	}
+	t := &httpTransport{
+		settings: *connection.HTTP,
+		username: connection.Username,
+		password: connection.Password,
+		client:   &http.Client{Timeout: httpTimeout},
+	}
+	if t.settings.Timeout > 0 {
+		t.client.Timeout = time.Duration(t.settings.Timeout)
+	}
+	if t.settings.Method == "" {
+		t.settings.Method = http.MethodPost
+	}
+
+	var err error
+	if t.settings.Template != "" {
+		path := m.settings.Path(t.settings.Template)
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		funcs := template.FuncMap{"json": quoteJSON}
+		if t.template, err = template.New(path).Funcs(funcs).Parse(string(raw)); err != nil {
+			return nil, err
+		}
+	}
+	if t.settings.Temporary != "" {
+		if t.temporary, err = regexp.Compile(t.settings.Temporary); err != nil {
+			return nil, err
+		}
+	}
+	if t.settings.Permanent != "" {
+		if t.permanent, err = regexp.Compile(t.settings.Permanent); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Deliver fulfills the Transport interface
+func (t *httpTransport) Deliver(from string, to []string, msg []byte) error {
+	body, contentType, err := t.body(from, to, msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(t.settings.Method, t.settings.URL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if t.username != "" || t.password != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	for name, value := range t.settings.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return retryLater(t.settings.URL, to, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	reply, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	err = fmt.Errorf("%s: %s: %s", t.settings.URL, resp.Status, summary(reply))
+	switch {
+	case t.permanent != nil && t.permanent.Match(reply):
+		return err
+	case t.temporary != nil && t.temporary.Match(reply):
+		return retryLater(t.settings.URL, to, err)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return retryLater(t.settings.URL, to, err)
+	}
+	return err
+}
+
+// body returns the request body for a message, and its content type.
+func (t *httpTransport) body(from string, to []string, msg []byte) (io.Reader, string, error) {
+	if t.template == nil {
+		return bytes.NewReader(msg), "message/rfc822", nil
+	}
+	buf := &bytes.Buffer{}
+	data := httpMessage{
+		Sender:     from,
+		Recipients: to,
+		Message:    string(msg),
+		Base64:     base64.StdEncoding.EncodeToString(msg),
+	}
+	if err := t.template.Execute(buf, data); err != nil {
+		return nil, "", err
+	}
+	return buf, "application/json", nil
+}
+
+func quoteJSON(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	return string(raw), err
+}
+
+// summary shortens a response body for use in an error message.
+func summary(body []byte) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if len(s) > 200 {
+		s = s[:200] + "..."
+	}
+	return s
+}
@@ -8,6 +8,7 @@ import (
 	"net/smtp"
 
 	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
 )
 
 // EmailSender is an ad-hoc interface to describe the SendMail function
@@ -16,11 +17,20 @@ type EmailSender interface {
 	SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error
 }
 
+// Transport delivers prepared messages for a connection; there is one
+// for each mqd.ConnectionType. Deliver returns a RecipientsError from
+// jw4.us/mqd/smtp when some recipients were refused, or could not be
+// reached for now and should be tried again later. Any other error
+// fails the whole message.
+type Transport interface {
+	Deliver(from string, to []string, msg []byte) error
+}
+
 // Mailer describes an object that is able to send emails via the
 // EmailSender interface, and that can load settings and convert
 // raw email messages into sent mail.
 type Mailer interface {
 	EmailSender
 	LoadSettings(*mqd.Settings) error
-	ConvertAndSend(email []byte) bool
+	ConvertAndSend(email []byte, env *dispatcher.Envelope) dispatcher.Report
 }
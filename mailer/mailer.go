@@ -6,13 +6,21 @@ package mailer // import "jw4.us/mqd/mailer"
 
 import (
 	"bytes"
+	"crypto"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/mail"
 	"net/smtp"
-
-	"github.com/golang/glog"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
 
 	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+	mqdsmtp "jw4.us/mqd/smtp"
 )
 
 type senderFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
@@ -20,38 +28,241 @@ type senderFunc func(addr string, a smtp.Auth, from string, to []string, msg []b
 type smtpMailer struct {
 	sendFn   senderFunc
 	settings *mqd.Settings
+	log      *slog.Logger
+	now      func() time.Time
+	// keys are the DKIM keys, by path, until the settings are loaded
+	// again.
+	keysMu sync.Mutex
+	keys   map[string]crypto.Signer
+	// resolver and mxPort are used by direct connections.
+	resolver Resolver
+	mxPort   string
+	// limits keep the state of the rate limits, once one is used.
+	limitsMu sync.Mutex
+	limits   *limiter
+	// transports of http connections, by connection key, until the
+	// settings are loaded again.
+	transportsMu sync.Mutex
+	transports   map[string]*httpTransport
 }
 
 // NewMailer returns a Mailer implementation using mqd.Settings
-// to transmit emails.
-func NewMailer(s *mqd.Settings) Mailer {
-	return &smtpMailer{settings: s, sendFn: smtp.SendMail}
+// to transmit emails, which logs to log, or the default logger when it
+// is nil.
+func NewMailer(s *mqd.Settings, log *slog.Logger) Mailer {
+	return &smtpMailer{settings: s, log: logging.Or(log), sendFn: mqdsmtp.SendMail, now: time.Now, resolver: net.DefaultResolver, mxPort: "25"}
 }
 
 // LoadSettings updates the Mailer configuration given the supplied
-// mqd.Settings.
+// mqd.Settings. The DKIM keys and transports loaded for the previous
+// settings are dropped, so that rotated keys and edited templates take
+// effect.
 func (m *smtpMailer) LoadSettings(s *mqd.Settings) error {
 	m.settings = s
+	m.keysMu.Lock()
+	m.keys = nil
+	m.keysMu.Unlock()
+	m.transportsMu.Lock()
+	m.transports = nil
+	m.transportsMu.Unlock()
 	return nil
 }
 
 // ConvertAndSend takes in a raw []byte message, parses it to discover
-// the sender (preferring From: then X-Sender:) and the recipients
+// the sender (by default X-Sender:, then Resent-From:, then From:,
+// see Settings.SenderHeaders) and the recipients
 // and then transmits the email through the configured smtp settings
-// for the sender.
-func (m *smtpMailer) ConvertAndSend(message []byte) bool {
+// for the sender. An Envelope, if given, overrides the sender,
+// recipients and connection found from the headers. Messages are
+// deferred while the quiet hours or the send windows of the
+// connection say they should be held, and recipients are deferred
+// while the rate limits of the connection or their domain are reached.
+func (m *smtpMailer) ConvertAndSend(message []byte, env *dispatcher.Envelope) dispatcher.Report {
 	eml, err := parseEmail(message)
 	if err != nil {
-		glog.Errorf("parsing email: %q", err)
-		return false
+		m.log.Error("parsing message", logging.Err(err))
+		return dispatcher.Report{Result: dispatcher.Failed, Error: err.Error()}
+	}
+	sender, recipients, dropped, err := envelopeOrHeaders(eml, env, m.settings)
+	report := dispatcher.Report{
+		MessageID:  m.messageID(eml.Header, env, sender),
+		Sender:     sender,
+		Recipients: recipients,
+		Dropped:    dropped,
+	}
+	log := m.log.With(logging.MessageID, report.MessageID, logging.Sender, sender, logging.Recipients, len(recipients))
+	if err != nil {
+		log.Error("reading recipients", logging.Err(err))
+		return report.Fail(err)
+	}
+	if len(dropped) > 0 {
+		log.Warn("dropped unparseable recipients", "dropped", dropped)
+	}
+	name, connection, err := m.connectionFor(sender, env)
+	if err != nil {
+		log.Error("finding connection", logging.Err(err))
+		return report.Fail(err)
+	}
+	report.Connection = connection.Sender
+	log = log.With(logging.Connection, connection.Sender)
+	if reason := m.hold(eml.Header, env, connection); reason != "" {
+		log.Debug("holding message", "reason", reason)
+		report.Result, report.Error, report.Held = dispatcher.Deferred, reason, true
+		return report
+	}
+	allowed, limited, reason := m.ration(connection, recipients)
+	if len(allowed) == 0 {
+		log.Info("rate limited", "reason", reason)
+		report.Result, report.Error, report.Held = dispatcher.Deferred, reason, true
+		return report
+	}
+	if len(limited) > 0 {
+		log.Info("rate limited some recipients", "limited", len(limited), "reason", limited[0].Error)
 	}
-	sender := findSender(eml)
-	recipients := findRecipients(eml)
-	if err := m.send(sender, recipients, message); err != nil {
-		glog.Errorf("sending from %q to %v: %q", sender, recipients, err)
-		return false
+	report.Recipients = allowed
+	start := time.Now()
+	if err := m.send(name, connection, mailFrom(sender, env, connection), allowed, message, report.MessageID); err != nil {
+		if refused, ok := err.(*mqdsmtp.RecipientsError); ok {
+			log.Warn("recipients refused", logging.Duration, time.Since(start), "refused", len(refused.Rejected),
+				logging.Err(err), logging.Code(err))
+			return limitReport(partialReport(report, refused), recipients, limited)
+		}
+		if relayed(connection) && mqdsmtp.Temporary(err) {
+			log.Warn("sending deferred", logging.Duration, time.Since(start), logging.Err(err), logging.Code(err))
+			return limitReport(report.Defer(err), recipients, limited)
+		}
+		log.Error("sending failed", logging.Duration, time.Since(start), logging.Err(err), logging.Code(err))
+		return limitReport(report.Fail(err), recipients, limited)
 	}
-	return true
+	log.Info("sent", logging.Duration, time.Since(start))
+	report.Result = dispatcher.Sent
+	return limitReport(report, recipients, limited)
+}
+
+// relayed reports whether connection hands mail to a relay server,
+// whose connection failures and 4xx replies are worth retrying.
+func relayed(connection mqd.ConnectionDetails) bool {
+	return connection.Type == "" || connection.Type == mqd.ConnectionRelay
+}
+
+// partialReport records the outcome for each recipient of a message
+// some recipients of which were refused. Temporary refusals are
+// Deferred, to be tried again later.
+func partialReport(report dispatcher.Report, refused *mqdsmtp.RecipientsError) dispatcher.Report {
+	rejected := map[string]*mqdsmtp.RecipientError{}
+	for _, r := range refused.Rejected {
+		rejected[r.Recipient] = r
+	}
+	report.Result = dispatcher.Failed
+	report.Error = refused.Error()
+	for _, rcpt := range report.Recipients {
+		d := dispatcher.Delivery{Recipient: rcpt, Result: dispatcher.Sent}
+		if r, ok := rejected[rcpt]; ok {
+			d.Result, d.Error = dispatcher.Failed, r.Reason()
+			if r.Temporary() {
+				d.Result = dispatcher.Deferred
+			}
+		}
+		// the message as a whole is Deferred while any recipient is,
+		// and Sent if it reached anyone
+		if d.Result == dispatcher.Deferred || (d.Result == dispatcher.Sent && report.Result == dispatcher.Failed) {
+			report.Result = d.Result
+		}
+		report.Deliveries = append(report.Deliveries, d)
+	}
+	return report
+}
+
+// envelopeOrHeaders returns the sender and recipients of a message,
+// preferring the ones given in env, and the recipient entries dropped
+// under the recipient policy of settings.
+func envelopeOrHeaders(eml *mail.Message, env *dispatcher.Envelope, settings *mqd.Settings) (sender string, recipients, dropped []string, err error) {
+	eml = withPreamble(eml, env)
+	if env != nil {
+		if addr, err := mail.ParseAddress(env.Sender); err == nil {
+			sender = addr.Address
+		} else {
+			sender = strings.TrimSpace(env.Sender)
+		}
+		if len(env.Recipients) > 0 {
+			p := newRecipientParser(settings.RecipientPolicy)
+			for _, r := range env.Recipients {
+				if err = p.parse(r); err != nil {
+					return sender, nil, nil, fmt.Errorf("envelope: %v", err)
+				}
+			}
+			recipients, dropped = p.list, p.dropped
+		}
+	}
+	if sender == "" {
+		sender = findSender(eml, settings.SenderHeaders...)
+	}
+	// the headers only stand in for an envelope without recipients,
+	// not for one whose recipients were all dropped
+	if len(recipients) == 0 && (env == nil || len(env.Recipients) == 0) {
+		var more []string
+		recipients, more, err = findRecipients(eml, settings.RecipientPolicy)
+		dropped = append(dropped, more...)
+		if err != nil {
+			return sender, nil, dropped, err
+		}
+	}
+	if len(recipients) == 0 {
+		return sender, nil, dropped, fmt.Errorf("no valid recipients")
+	}
+	return sender, recipients, dropped, nil
+}
+
+// withPreamble returns eml with the lines of the pickup preamble in
+// env, if any, put back in front of its headers.
+func withPreamble(eml *mail.Message, env *dispatcher.Envelope) *mail.Message {
+	if env == nil || len(env.Preamble) == 0 {
+		return eml
+	}
+	header := mail.Header{}
+	for key, values := range eml.Header {
+		header[key] = values
+	}
+	for key, values := range env.Preamble {
+		header[key] = append(append([]string{}, values...), header[key]...)
+	}
+	return &mail.Message{Header: header, Body: eml.Body}
+}
+
+// connectionFor returns the connection named in env, or else the one
+// configured for sender, and its key.
+func (m *smtpMailer) connectionFor(sender string, env *dispatcher.Envelope) (string, mqd.ConnectionDetails, error) {
+	if env != nil && env.Connection != "" {
+		if details, ok := m.settings.C[env.Connection]; ok {
+			return env.Connection, details, nil
+		}
+		return "", mqd.ConnectionDetails{}, fmt.Errorf("envelope connection %q not found", env.Connection)
+	}
+	return m.settings.ConnectionKeyForSender(sender)
+}
+
+// hold returns the reason a message should stay in the mailqueue for
+// now, or an empty string if it can be sent.
+func (m *smtpMailer) hold(header mail.Header, env *dispatcher.Envelope, connection mqd.ConnectionDetails) string {
+	now := m.now()
+	if len(connection.SendWindows) > 0 && !mqd.InWindows(connection.SendWindows, now) {
+		return fmt.Sprintf("outside the send windows of %s", connection.Sender)
+	}
+	urgent := isUrgent(header)
+	if env != nil && env.Priority != 0 {
+		urgent = env.Priority < dispatcher.NormalPriority
+	}
+	if !urgent && mqd.InWindows(m.settings.QuietHours, now) {
+		return "quiet hours"
+	}
+	return ""
+}
+
+// isUrgent reports whether the message headers mark it as urgent or
+// high priority.
+func isUrgent(header mail.Header) bool {
+	p := dispatcher.HeaderPriority(header)
+	return p != 0 && p < dispatcher.NormalPriority
 }
 
 // SendMail fulfills the EmailSender interface.  It wraps an internal
@@ -60,18 +271,44 @@ func (m *smtpMailer) SendMail(addr string, a smtp.Auth, from string, to []string
 	return m.sendFn(addr, a, from, to, msg)
 }
 
-func (m *smtpMailer) send(sender string, recipients []string, message []byte) error {
-	connection, err := m.settings.ConnectionForSender(sender)
+// mailFrom returns the MAIL FROM address of a message from sender: the
+// one given in env, which is where bounces go, or else the account of
+// the connection. A sender of "<>" is the null reverse path.
+func mailFrom(sender string, env *dispatcher.Envelope, connection mqd.ConnectionDetails) string {
+	if env == nil || strings.TrimSpace(env.Sender) == "" {
+		return connection.Sender
+	}
+	if sender == "<>" {
+		return ""
+	}
+	return sender
+}
+
+// send delivers message through connection, configured under name.
+func (m *smtpMailer) send(name string, connection mqd.ConnectionDetails, from string, recipients []string, message []byte, messageID string) (err error) {
+	start := time.Now()
+	defer func() { observeSend(connection.Sender, time.Since(start), err) }()
+
+	transport, err := m.transport(name, connection)
+	if err != nil {
+		return err
+	}
+
+	message, err = m.prepare(connection, message, messageID)
 	if err != nil {
 		return err
 	}
 
-	auth, err := connection.Auth()
+	message, err = m.sign(connection, message)
 	if err != nil {
 		return err
 	}
 
-	return m.SendMail(connection.Server, auth, connection.Sender, recipients, message)
+	size := 0
+	if connection.RateLimit != nil {
+		size = connection.RateLimit.MaxRecipients
+	}
+	return deliverChunks(transport, connection.Sender, size, from, recipients, message)
 }
 
 func parseEmail(msg []byte) (*mail.Message, error) {
@@ -81,26 +318,74 @@ func parseEmail(msg []byte) (*mail.Message, error) {
 	return mail.ReadMessage(bytes.NewBuffer(msg))
 }
 
-func findSender(eml *mail.Message) string {
+// DefaultSenderHeaders is the order in which headers are searched for
+// the sender when the settings don't give one.
+var DefaultSenderHeaders = []string{"X-Sender", "Resent-From", "From"}
+
+// findSender returns the address of the sender of eml, searching the
+// headers named in order, or DefaultSenderHeaders. From and
+// Resent-From follow RFC 5322: when they hold several mailboxes the
+// matching Sender or Resent-Sender names the sender, and for resent
+// messages only the most recent (topmost) resent block is used. Any
+// other header yields its first address that parses.
+func findSender(eml *mail.Message, order ...string) string {
 	if eml == nil {
 		return ""
 	}
-	// prefer X-Sender
-	senders := getEmails(eml.Header, "X-Sender")
-	if len(senders) > 0 {
-		for _, sender := range senders {
-			addr, err := mail.ParseAddress(sender)
-			if err == nil {
-				return addr.Address
+	if len(order) == 0 {
+		order = DefaultSenderHeaders
+	}
+	for _, name := range order {
+		var sender string
+		switch textproto.CanonicalMIMEHeaderKey(name) {
+		case "From":
+			sender = authorOrAgent(eml.Header, "From", "Sender")
+		case "Resent-From":
+			sender = authorOrAgent(eml.Header, "Resent-From", "Resent-Sender")
+		default:
+			sender = firstAddress(eml.Header[textproto.CanonicalMIMEHeaderKey(name)])
+		}
+		if sender != "" {
+			return sender
+		}
+	}
+	return ""
+}
+
+// authorOrAgent returns the single author in the first author header,
+// or when there are several, the address in the first agent header,
+// falling back to the first author if there is no agent.
+func authorOrAgent(h mail.Header, author, agent string) string {
+	values := h[author]
+	if len(values) == 0 {
+		return ""
+	}
+	list, err := mail.ParseAddressList(values[0])
+	if err != nil || len(list) == 0 {
+		return firstAddress(values[:1])
+	}
+	if len(list) > 1 {
+		if values := h[agent]; len(values) > 0 {
+			if sender := firstAddress(values[:1]); sender != "" {
+				return sender
 			}
 		}
 	}
-	// fallback to From
-	senders = getEmails(eml.Header, "From")
-	if len(senders) > 0 {
-		for _, sender := range senders {
-			addr, err := mail.ParseAddress(sender)
-			if err == nil {
+	return list[0].Address
+}
+
+// firstAddress returns the first address in values that parses,
+// ignoring the null reverse path "<>".
+func firstAddress(values []string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) == "<>" {
+			continue
+		}
+		if list, err := mail.ParseAddressList(value); err == nil && len(list) > 0 {
+			return list[0].Address
+		}
+		for _, item := range strings.Split(value, ",") {
+			if addr, err := mail.ParseAddress(item); err == nil {
 				return addr.Address
 			}
 		}
@@ -108,33 +393,26 @@ func findSender(eml *mail.Message) string {
 	return ""
 }
 
-func findRecipients(eml *mail.Message) []string {
-	recipients := []string{}
+// findRecipients returns the recipient addresses in the headers of
+// eml, and the entries dropped under policy.
+func findRecipients(eml *mail.Message, policy mqd.RecipientPolicy) ([]string, []string, error) {
 	if eml == nil {
-		return recipients
+		return []string{}, nil, nil
 	}
-	return getEmails(eml.Header, "To", "Cc", "Bcc", "X-Receiver")
+	return getEmails(eml.Header, policy, "To", "Cc", "Bcc", "X-Receiver")
 }
 
-func getEmails(in map[string][]string, keys ...string) []string {
-	itemMap := map[string]interface{}{}
+func getEmails(in map[string][]string, policy mqd.RecipientPolicy, keys ...string) ([]string, []string, error) {
+	p := newRecipientParser(policy)
 	for _, key := range keys {
-		if items, ok := in[key]; ok {
-			for _, item := range items {
-				list, err := mail.ParseAddressList(item)
-				if err != nil {
-					glog.Warningf("failed to email list %q: %v", item, err)
-				} else {
-					for _, addr := range list {
-						itemMap[addr.Address] = nil
-					}
-				}
+		for _, item := range in[key] {
+			if err := p.parse(item); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", key, err)
 			}
 		}
 	}
-	slice := []string{}
-	for k := range itemMap {
-		slice = append(slice, k)
+	if p.list == nil {
+		p.list = []string{}
 	}
-	return slice
+	return p.list, p.dropped, nil
 }
@@ -5,10 +5,29 @@
 package mailer // import "jw4.us/mqd/mailer"
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	mqdsmtp "jw4.us/mqd/smtp"
+	"jw4.us/mqd/smtp/smtptest"
 )
 
 func TestFindSender(t *testing.T) {
@@ -40,6 +59,79 @@ func TestFindSender(t *testing.T) {
 	}
 }
 
+func TestFindSenderHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		order   []string
+		sender  string
+	}{{
+		name:    "single From",
+		message: "From: \"A\" <a@x.com>\r\nSender: s@x.com\r\n\r\nbody\r\n",
+		sender:  "a@x.com",
+	}, {
+		name:    "several From mailboxes use Sender",
+		message: "From: a@x.com, \"B\" <b@x.com>\r\nSender: \"Sec\" <s@x.com>\r\n\r\nbody\r\n",
+		sender:  "s@x.com",
+	}, {
+		name:    "several From mailboxes without Sender use the first",
+		message: "From: a@x.com, b@x.com\r\n\r\nbody\r\n",
+		sender:  "a@x.com",
+	}, {
+		name:    "resent message uses Resent-From",
+		message: "Resent-From: fwd@y.com\r\nResent-To: c@z.com\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		sender:  "fwd@y.com",
+	}, {
+		name:    "several Resent-From mailboxes use Resent-Sender",
+		message: "Resent-From: f1@y.com, f2@y.com\r\nResent-Sender: agent@y.com\r\nFrom: a@x.com\r\nSender: s@x.com\r\n\r\nbody\r\n",
+		sender:  "agent@y.com",
+	}, {
+		name: "most recent resent block wins",
+		message: "Resent-From: second@y.com\r\nResent-Date: Mon, 06 Mar 2017 12:00:00 +0000\r\n" +
+			"Resent-From: first@y.com\r\nResent-Date: Sun, 05 Mar 2017 12:00:00 +0000\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		sender: "second@y.com",
+	}, {
+		name:    "X-Sender beats Resent-From",
+		message: "X-Sender: env@x.com\r\nResent-From: fwd@y.com\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		sender:  "env@x.com",
+	}, {
+		name:    "unparseable From mailbox is skipped",
+		message: "From: not an address, b@x.com\r\n\r\nbody\r\n",
+		sender:  "b@x.com",
+	}, {
+		name:    "Return-Path when configured",
+		message: "Return-Path: <bounce@x.com>\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		order:   []string{"Return-Path", "From"},
+		sender:  "bounce@x.com",
+	}, {
+		name:    "null Return-Path is ignored",
+		message: "Return-Path: <>\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		order:   []string{"Return-Path", "From"},
+		sender:  "a@x.com",
+	}, {
+		name:    "custom order ignores Resent-From",
+		message: "Resent-From: fwd@y.com\r\nFrom: a@x.com\r\n\r\nbody\r\n",
+		order:   []string{"x-sender", "from"},
+		sender:  "a@x.com",
+	}, {
+		name:    "explicit Sender first",
+		message: "From: a@x.com\r\nSender: s@x.com\r\n\r\nbody\r\n",
+		order:   []string{"Sender", "From"},
+		sender:  "s@x.com",
+	}}
+
+	for _, test := range tests {
+		t.Logf("Test %s", test.name)
+		msg, err := parseEmail([]byte(test.message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sender := findSender(msg, test.order...); sender != test.sender {
+			t.Errorf("sender incorrect, expected %q got %q", test.sender, sender)
+		}
+	}
+}
+
 func TestFindRecipients(t *testing.T) {
 	tests := []struct {
 		message    []byte
@@ -58,13 +150,70 @@ func TestFindRecipients(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		recipients := findRecipients(msg)
+		recipients, _, err := findRecipients(msg, "")
+		if err != nil {
+			t.Error(err)
+		}
 		if len(recipients) != len(test.recipients) {
 			t.Errorf("mismatch, expected %d recipients, got %d", len(test.recipients), len(recipients))
 		}
 	}
 }
 
+func TestRecipientPolicy(t *testing.T) {
+	tests := []struct {
+		policy     mqd.RecipientPolicy
+		to         string
+		recipients []string
+		dropped    []string
+		fail       bool
+	}{{
+		policy:     mqd.RecipientStrict,
+		to:         "asdf@wert.yo, \"Q\" <qwer@asdf.gh>",
+		recipients: []string{"asdf@wert.yo", "qwer@asdf.gh"},
+	}, {
+		policy: mqd.RecipientStrict,
+		to:     "asdf@wert.yo, not an address",
+		fail:   true,
+	}, {
+		policy:     mqd.RecipientLenient,
+		to:         "asdf@wert.yo, not an address, \"Smith, Q\" <qwer@asdf.gh>",
+		recipients: []string{"asdf@wert.yo", "qwer@asdf.gh"},
+		dropped:    []string{"not an address"},
+	}, {
+		policy:     mqd.RecipientLenient,
+		to:         "asdf@wert.yo; qwer@asdf.gh",
+		recipients: nil,
+		dropped:    []string{"asdf@wert.yo; qwer@asdf.gh"},
+		fail:       true,
+	}, {
+		policy:     mqd.RecipientRepair,
+		to:         "asdf@wert.yo; Q Smith qwer@asdf.gh; <zxcv@zxcv.as; mailto:yt@qwer.yt",
+		recipients: []string{"asdf@wert.yo", "qwer@asdf.gh", "zxcv@zxcv.as", "yt@qwer.yt"},
+	}, {
+		policy:     mqd.RecipientRepair,
+		to:         "asdf@wert.yo; nobody",
+		recipients: []string{"asdf@wert.yo"},
+		dropped:    []string{"nobody"},
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		m := testMailer(t)
+		m.(*smtpMailer).settings.RecipientPolicy = test.policy
+		report := m.ConvertAndSend([]byte("To: "+test.to+"\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n"), nil)
+		if failed := report.Result == dispatcher.Failed; failed != test.fail {
+			t.Errorf("expected failure %t, got %s: %s", test.fail, report.Result, report.Error)
+		}
+		if strings.Join(report.Recipients, " ") != strings.Join(test.recipients, " ") {
+			t.Errorf("expected recipients %q, got %q", test.recipients, report.Recipients)
+		}
+		if strings.Join(report.Dropped, "|") != strings.Join(test.dropped, "|") {
+			t.Errorf("expected dropped %q, got %q", test.dropped, report.Dropped)
+		}
+	}
+}
+
 func TestConvertAndSend(t *testing.T) {
 	tests := []struct {
 		message    []byte
@@ -80,13 +229,730 @@ func TestConvertAndSend(t *testing.T) {
 
 	for ix, test := range tests {
 		t.Logf("Test %d", ix)
-		pass := m.ConvertAndSend(test.message)
+		pass := m.ConvertAndSend(test.message, nil).Result == dispatcher.Sent
 		if pass != test.shouldpass {
 			t.Errorf("ConvertAndSend returned %t, expected %t", pass, test.shouldpass)
 		}
 	}
 }
 
+func TestHold(t *testing.T) {
+	urgent := []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\nX-Priority: 1 (Highest)\r\n\r\nqwer\r\n")
+	normal := []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n")
+	bulk := []byte("To: asdf@qwer.ty\r\nFrom: baz@foo.com\r\nImportance: high\r\n\r\nqwer\r\n")
+
+	// Monday
+	day := time.Date(2017, time.March, 6, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		message []byte
+		at      time.Duration
+		result  dispatcher.Result
+	}{
+		{message: normal, at: 12 * time.Hour, result: dispatcher.Sent},
+		{message: normal, at: 23 * time.Hour, result: dispatcher.Deferred},
+		{message: normal, at: 30 * time.Hour, result: dispatcher.Deferred},
+		{message: urgent, at: 23 * time.Hour, result: dispatcher.Sent},
+		{message: bulk, at: 12 * time.Hour, result: dispatcher.Deferred},
+		{message: bulk, at: 26 * time.Hour, result: dispatcher.Sent},
+		{message: bulk, at: 50 * time.Hour, result: dispatcher.Deferred},
+	}
+
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.settings.QuietHours = []mqd.Window{{Start: "22:00", End: "07:00"}}
+	bulkConnection := sm.settings.C["baz@foo.com"]
+	bulkConnection.SendWindows = []mqd.Window{{Days: []string{"tue"}, Start: "01:00", End: "05:00"}}
+	sm.settings.C["baz@foo.com"] = bulkConnection
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		sm.now = func() time.Time { return day.Add(test.at) }
+		report := m.ConvertAndSend(test.message, nil)
+		if report.Result != test.result {
+			t.Errorf("ConvertAndSend returned %s, expected %s", report.Result, test.result)
+		}
+		if held := test.result == dispatcher.Deferred; report.Held != held {
+			t.Errorf("expected held %t, got %t", held, report.Held)
+		}
+	}
+}
+
+func TestHoldQueueFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	mailqueue, badmail := filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail")
+	for _, folder := range []string{filepath.Join(mailqueue, dispatcher.HighFolder), badmail} {
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message := []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n")
+	for _, path := range []string{filepath.Join(mailqueue, dispatcher.HighFolder, "high.eml"), filepath.Join(mailqueue, "normal.eml")} {
+		if err := ioutil.WriteFile(path, message, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.settings.QuietHours = []mqd.Window{{Start: "22:00", End: "07:00"}}
+	sm.now = func() time.Time { return time.Date(2017, time.March, 6, 23, 0, 0, 0, time.Local) }
+	sent := 0
+	dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent++
+		return nil
+	})
+
+	// messages in the high folder are as urgent during quiet hours as
+	// they are when the queue is ordered
+	q := dispatcher.NewPickupFolderQueue(mailqueue, badmail, "", dispatcher.QueueOptions{})
+	if err := q.Process(m.ConvertAndSend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(mailqueue, dispatcher.HighFolder, "high.eml")); sent != 1 || !os.IsNotExist(err) {
+		t.Errorf("expected only high.eml to be sent, got %d sends (%v)", sent, err)
+	}
+	if _, err := os.Stat(filepath.Join(mailqueue, "normal.eml")); err != nil {
+		t.Errorf("expected normal.eml to be held: %v", err)
+	}
+}
+
+func TestDKIMSigning(t *testing.T) {
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.settings.DKIM = map[string]mqd.DKIMSettings{
+		"foo.com": {Selector: "mqd", PrivateKey: "../dkim/testdata/ed25519.pem"},
+	}
+
+	var sent []byte
+	dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = msg
+		return nil
+	})
+
+	tests := []struct {
+		message []byte
+		signed  bool
+	}{{
+		message: []byte("To: asdf@qwer.ty\r\nFrom: \"BAZ\" <baz@foo.com>\r\nSubject: hello\r\n\r\nqwer\r\n"),
+		signed:  true,
+	}, {
+		message: []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\nSubject: hello\r\n\r\nqwer\r\n"),
+		signed:  false,
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if result := m.ConvertAndSend(test.message, nil).Result; result != dispatcher.Sent {
+			t.Fatalf("ConvertAndSend returned %s", result)
+		}
+		signed := bytes.HasPrefix(sent, []byte("DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/simple; d=foo.com; s=mqd;"))
+		if signed != test.signed {
+			t.Errorf("expected signed %t, got message:\n%s", test.signed, sent)
+		}
+	}
+}
+
+func TestSigningKeyReload(t *testing.T) {
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+
+	dir, err := ioutil.TempDir("", "mqd-dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "key.pem")
+	writeTestFile(t, path, readTestFile(t, "../dkim/testdata/ed25519.pem"))
+
+	// keys are loaded once, however many messages are signed at a time
+	keys := make(chan crypto.Signer, 4)
+	for ix := 0; ix < cap(keys); ix++ {
+		go func() {
+			key, err := sm.signingKey(path)
+			if err != nil {
+				t.Error(err)
+			}
+			keys <- key
+		}()
+	}
+	first := <-keys
+	for ix := 1; ix < cap(keys); ix++ {
+		if key := <-keys; !sameKey(key, first) {
+			t.Errorf("expected the cached key, got another")
+		}
+	}
+
+	writeTestFile(t, path, readTestFile(t, "../dkim/testdata/rsa.pem"))
+	if key, _ := sm.signingKey(path); !sameKey(key, first) {
+		t.Errorf("expected the cached key before LoadSettings")
+	}
+	if err := m.LoadSettings(sm.settings); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := sm.signingKey(path); err != nil || sameKey(key, first) {
+		t.Errorf("expected the rotated key after LoadSettings, got %T %v", key, err)
+	}
+}
+
+func sameKey(a, b crypto.Signer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(b.Public())
+}
+
+func TestRewriteSender(t *testing.T) {
+	message := "From: \"Billing Dept\" <billing@app.example>\r\nSender: robot@app.example\r\nTo: asdf@qwer.ty\r\nSubject: hello\r\n\r\nqwer\r\n"
+	tests := []struct {
+		policy  mqd.SenderRewrite
+		from    string
+		replyTo string
+		sender  string
+	}{
+		{policy: "", from: "\"Billing Dept\" <billing@app.example>", sender: "robot@app.example"},
+		{policy: mqd.RewriteNone, from: "\"Billing Dept\" <billing@app.example>", sender: "robot@app.example"},
+		{policy: mqd.RewriteFrom, from: "<foo@bar.com>"},
+		{policy: mqd.RewriteReplyTo, from: "\"Billing Dept\" <foo@bar.com>", replyTo: "\"Billing Dept\" <billing@app.example>"},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		h := splitRawHeader([]byte(message))
+		rewriteSender(h, mqd.ConnectionDetails{Sender: "foo@bar.com", RewriteFrom: test.policy})
+		eml, err := parseEmail(h.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from := eml.Header.Get("From"); from != test.from {
+			t.Errorf("From: expected %q, got %q", test.from, from)
+		}
+		if replyTo := eml.Header.Get("Reply-To"); replyTo != test.replyTo {
+			t.Errorf("Reply-To: expected %q, got %q", test.replyTo, replyTo)
+		}
+		if sender := eml.Header.Get("Sender"); sender != test.sender {
+			t.Errorf("Sender: expected %q, got %q", test.sender, sender)
+		}
+	}
+}
+
+func TestMessageIDAndDate(t *testing.T) {
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.now = func() time.Time { return time.Date(2017, time.March, 6, 12, 0, 0, 0, time.UTC) }
+
+	var sent []byte
+	dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent = msg
+		return nil
+	})
+
+	generated := regexp.MustCompile(`^<[0-9a-z]+\.[0-9a-f]{24}\.mqd@asdf\.gh>$`)
+	tests := []struct {
+		message   []byte
+		env       *dispatcher.Envelope
+		messageID string
+		date      string
+	}{{
+		message: []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\nSubject: hello\r\n\r\nqwer\r\n"),
+		date:    "Mon, 06 Mar 2017 12:00:00 +0000",
+	}, {
+		message:   []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\nSubject: hello\r\n\r\nqwer\r\n"),
+		env:       &dispatcher.Envelope{MessageID: "<kept.mqd@asdf.gh>"},
+		messageID: "<kept.mqd@asdf.gh>",
+		date:      "Mon, 06 Mar 2017 12:00:00 +0000",
+	}, {
+		message:   []byte("Message-Id: <1234@app>\r\nDate: Sun, 05 Mar 2017 11:00:00 +0100\r\nTo: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n"),
+		env:       &dispatcher.Envelope{MessageID: "<kept.mqd@asdf.gh>"},
+		messageID: "<1234@app>",
+		date:      "Sun, 05 Mar 2017 11:00:00 +0100",
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		report := m.ConvertAndSend(test.message, test.env)
+		if report.Result != dispatcher.Sent {
+			t.Fatalf("ConvertAndSend returned %s", report.Result)
+		}
+		expected := test.messageID
+		if expected == "" {
+			if !generated.MatchString(report.MessageID) {
+				t.Errorf("report Message-ID: unexpected %q", report.MessageID)
+			}
+			expected = report.MessageID
+		}
+		if report.MessageID != expected {
+			t.Errorf("report Message-ID: expected %q, got %q", expected, report.MessageID)
+		}
+		eml, err := parseEmail(sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := eml.Header.Get("Message-ID"); id != expected {
+			t.Errorf("Message-ID: expected %q, got %q", expected, id)
+		}
+		if date := eml.Header.Get("Date"); date != test.date {
+			t.Errorf("Date: expected %q, got %q", test.date, date)
+		}
+		again := m.ConvertAndSend(test.message, test.env)
+		if same := again.MessageID == report.MessageID; same != (test.messageID != "") {
+			t.Errorf("Message-ID of a second message: got %q after %q", again.MessageID, report.MessageID)
+		}
+	}
+}
+
+func TestConvertAndSendEnvelope(t *testing.T) {
+	m := testMailer(t)
+
+	var gotAddr, gotFrom string
+	var gotTo []string
+	dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotTo = addr, from, to
+		return nil
+	})
+
+	message := []byte("To: asdf@qwer.ty\r\nFrom: qwer@asdf.gh\r\nSubject: hello\r\n\r\nqwer\r\n")
+	tests := []struct {
+		env        *dispatcher.Envelope
+		addr       string
+		from       string
+		recipients []string
+	}{{
+		env:        nil,
+		addr:       "localhost:587",
+		from:       "foo@bar.com",
+		recipients: []string{"asdf@qwer.ty"},
+	}, {
+		env:        &dispatcher.Envelope{Recipients: []string{"hidden@else.where", "\"Other\" <other@else.where>"}},
+		addr:       "localhost:587",
+		from:       "foo@bar.com",
+		recipients: []string{"hidden@else.where", "other@else.where"},
+	}, {
+		env:        &dispatcher.Envelope{Sender: "baz@foo.com"},
+		addr:       "smtp.foo.com:587",
+		from:       "baz@foo.com",
+		recipients: []string{"asdf@qwer.ty"},
+	}, {
+		env:        &dispatcher.Envelope{Connection: "\"BAZ\" <baz@foo.com>"},
+		addr:       "smtp.foo.com:587",
+		from:       "baz@foo.com",
+		recipients: []string{"asdf@qwer.ty"},
+	}, {
+		// the envelope sender is the bounce address
+		env:        &dispatcher.Envelope{Sender: "Bounces <bounces@asdf.gh>", Connection: "baz@foo.com"},
+		addr:       "smtp.foo.com:587",
+		from:       "bounces@asdf.gh",
+		recipients: []string{"asdf@qwer.ty"},
+	}, {
+		// a pickup preamble adds recipients and picks the connection,
+		// whose account stays the MAIL FROM address
+		env:        &dispatcher.Envelope{Preamble: mail.Header{"X-Sender": {"qwer@asdf.gh"}, "X-Receiver": {"a@x.com"}}},
+		addr:       "localhost:587",
+		from:       "foo@bar.com",
+		recipients: []string{"asdf@qwer.ty", "a@x.com"},
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if report := m.ConvertAndSend(message, test.env); report.Result != dispatcher.Sent {
+			t.Fatalf("ConvertAndSend returned %s: %s", report.Result, report.Error)
+		}
+		if gotAddr != test.addr || gotFrom != test.from {
+			t.Errorf("expected server %q and sender %q, got %q and %q", test.addr, test.from, gotAddr, gotFrom)
+		}
+		if strings.Join(gotTo, ",") != strings.Join(test.recipients, ",") {
+			t.Errorf("expected recipients %v, got %v", test.recipients, gotTo)
+		}
+	}
+
+	if report := m.ConvertAndSend(message, &dispatcher.Envelope{Connection: "nope"}); report.Result != dispatcher.Failed {
+		t.Errorf("expected unknown connection to fail, got %s", report.Result)
+	}
+
+	// envelope recipients that are all dropped don't fall back to the
+	// headers
+	gotTo = nil
+	report := m.ConvertAndSend(message, &dispatcher.Envelope{Recipients: []string{"not an address"}})
+	if report.Result != dispatcher.Failed || gotTo != nil || len(report.Dropped) != 1 {
+		t.Errorf("expected invalid envelope recipients to fail, got %s to %v", report.Result, gotTo)
+	}
+}
+
+func TestPartialDelivery(t *testing.T) {
+	m := testMailer(t)
+	dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return &mqdsmtp.RecipientsError{Server: "localhost", Delivered: true, Rejected: []*mqdsmtp.RecipientError{
+			{Recipient: "b@x.com", Err: &textproto.Error{Code: 550, Msg: "no such user"}},
+			{Recipient: "c@x.com", Err: &textproto.Error{Code: 450, Msg: "try later"}},
+		}}
+	})
+
+	report := m.ConvertAndSend([]byte("To: a@x.com, b@x.com, c@x.com\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n"), nil)
+	if report.Result != dispatcher.Deferred {
+		t.Errorf("expected deferred, got %s", report.Result)
+	}
+	expected := []string{"a@x.com sent", "b@x.com failed: 550 no such user", "c@x.com deferred: 450 try later"}
+	if len(report.Deliveries) != len(expected) {
+		t.Fatalf("expected %d deliveries, got %v", len(expected), report.Deliveries)
+	}
+	for ix, d := range report.Deliveries {
+		if d.String() != expected[ix] {
+			t.Errorf("expected %q, got %q", expected[ix], d)
+		}
+	}
+}
+
+func TestRelayErrors(t *testing.T) {
+	tests := []struct {
+		err    error
+		result dispatcher.Result
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, dispatcher.Deferred},
+		{&textproto.Error{Code: 421, Msg: "4.3.2 shutting down"}, dispatcher.Deferred},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 try again later"}, dispatcher.Deferred},
+		{&textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, dispatcher.Failed},
+		{&mqdsmtp.ExtensionError{Extension: "SMTPUTF8"}, dispatcher.Failed},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		m := testMailer(t)
+		dummySender(m, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			return test.err
+		})
+		report := m.ConvertAndSend([]byte("To: a@x.com\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n"), nil)
+		if report.Result != test.result || report.Error != test.err.Error() {
+			t.Errorf("expected %s for %v, got %s: %s", test.result, test.err, report.Result, report.Error)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	newMailer := func() *smtpMailer {
+		sm := testMailer(t).(*smtpMailer)
+		sm.settings.RateLimitState = filepath.Join(dir, "state.json")
+		sm.settings.DomainLimits = map[string]mqd.RateLimit{"Slow.com": {PerDay: 1}}
+		connection := sm.settings.C["qwer@asdf.gh"]
+		connection.RateLimit = &mqd.RateLimit{PerMinute: 2, MaxRecipients: 2}
+		sm.settings.C["qwer@asdf.gh"] = connection
+		return sm
+	}
+	start := time.Date(2017, time.March, 6, 12, 0, 0, 0, time.UTC)
+	sm := newMailer()
+	tests := []struct {
+		to       string
+		at       time.Duration
+		restart  bool
+		result   dispatcher.Result
+		sends    []string
+		deferred []string
+	}{
+		{to: "a@x.com", result: dispatcher.Sent, sends: []string{"a@x.com"}},
+		// three recipients take two messages, and one is left
+		{to: "a@x.com, b@x.com, c@x.com", result: dispatcher.Deferred},
+		{to: "a@x.com, b@x.com, c@x.com", at: 30 * time.Second, result: dispatcher.Sent, sends: []string{"a@x.com b@x.com", "c@x.com"}},
+		// the buckets survive a restart
+		{to: "a@x.com", at: 40 * time.Second, restart: true, result: dispatcher.Deferred},
+		{to: "d@slow.com", at: 2 * time.Minute, result: dispatcher.Sent, sends: []string{"d@slow.com"}},
+		{to: "a@x.com, e@SLOW.com", at: 3 * time.Minute, result: dispatcher.Deferred, sends: []string{"a@x.com"}, deferred: []string{"e@SLOW.com"}},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if test.restart {
+			sm = newMailer()
+		}
+		var sends []string
+		dummySender(sm, func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			sends = append(sends, strings.Join(to, " "))
+			return nil
+		})
+		sm.now = func() time.Time { return start.Add(test.at) }
+		report := sm.ConvertAndSend([]byte("To: "+test.to+"\r\nFrom: qwer@asdf.gh\r\n\r\nqwer\r\n"), nil)
+		if report.Result != test.result {
+			t.Errorf("expected %s, got %s: %s", test.result, report.Result, report.Error)
+		}
+		if strings.Join(sends, ", ") != strings.Join(test.sends, ", ") {
+			t.Errorf("expected sends %v, got %v", test.sends, sends)
+		}
+		var deferred []string
+		for _, d := range report.Deliveries {
+			if d.Result == dispatcher.Deferred {
+				deferred = append(deferred, d.Recipient)
+				if !strings.Contains(d.Error, "rate limit of 1 per day for domain slow.com") {
+					t.Errorf("unexpected reason %q", d.Error)
+				}
+			}
+		}
+		if strings.Join(deferred, ", ") != strings.Join(test.deferred, ", ") {
+			t.Errorf("expected deferred %v, got %v", test.deferred, deferred)
+		}
+	}
+}
+
+func TestDirectDelivery(t *testing.T) {
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	srv.Refuse("nobody@a.test", "550 5.1.1 no such user")
+
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.mxPort = srv.Port()
+	sm.resolver = stubResolver{
+		mx: map[string][]*net.MX{
+			"a.test":    {{Host: "mx2.a.test.", Pref: 20}, {Host: "mx1.a.test.", Pref: 10}},
+			"null.test": {{Host: ".", Pref: 0}},
+			"slow.test": {{Host: "down.slow.test.", Pref: 10}},
+			"void.test": {{Host: "mx.void.test.", Pref: 10}},
+		},
+		hosts: map[string][]string{
+			"mx1.a.test":     {"127.0.0.2"},
+			"mx2.a.test":     {"127.0.0.1"},
+			"b.test":         {"127.0.0.1"},
+			"down.slow.test": {"127.0.0.2"},
+			"mx.void.test":   {},
+		},
+	}
+	sm.settings.C["direct@asdf.gh"] = mqd.ConnectionDetails{Sender: "direct@asdf.gh", Host: "mx.asdf.gh", Type: mqd.ConnectionDirect}
+
+	report := m.ConvertAndSend([]byte("To: x@a.test, nobody@a.test, y@B.test, z@gone.test, n@null.test, w@slow.test, v@void.test\r\nFrom: direct@asdf.gh\r\n\r\nqwer\r\n"), nil)
+	if report.Result != dispatcher.Deferred {
+		t.Errorf("expected deferred, got %s: %s", report.Result, report.Error)
+	}
+	expected := map[string]dispatcher.Result{
+		"x@a.test": dispatcher.Sent, "nobody@a.test": dispatcher.Failed, "y@B.test": dispatcher.Sent,
+		"z@gone.test": dispatcher.Failed, "n@null.test": dispatcher.Failed, "w@slow.test": dispatcher.Deferred,
+		"v@void.test": dispatcher.Deferred,
+	}
+	for _, d := range report.Deliveries {
+		if expected[d.Recipient] != d.Result {
+			t.Errorf("expected %s %s, got %s", d.Recipient, expected[d.Recipient], d)
+		}
+		delete(expected, d.Recipient)
+	}
+	if len(expected) > 0 {
+		t.Errorf("missing deliveries for %v", expected)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 2 || strings.Join(messages[0].To, " ") != "x@a.test" || strings.Join(messages[1].To, " ") != "y@B.test" {
+		t.Errorf("unexpected messages %+v", messages)
+	}
+	if commands := srv.Commands(); len(commands) == 0 || commands[0] != "EHLO mx.asdf.gh" {
+		t.Errorf("unexpected commands %q", commands)
+	}
+}
+
+func TestTransports(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs unix sockets and /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "mqd-transports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	lmtp := smtptest.NewLMTPServer("unix", filepath.Join(dir, "lmtp.sock"))
+	defer lmtp.Close()
+	lmtp.RefuseData("full@x.com", "452 4.2.2 mailbox full")
+
+	script := filepath.Join(dir, "sendmail.sh")
+	writeTestFile(t, script, "#!/bin/sh\necho \"$@\" > "+dir+"/args\ncat > "+dir+"/stdin\n[ \"$3\" = later@asdf.gh ] && exit 75\nexit 0\n")
+	if err = os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.now = func() time.Time { return time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC) }
+	sm.settings.C["lmtp@asdf.gh"] = mqd.ConnectionDetails{Sender: "lmtp@asdf.gh", Type: mqd.ConnectionLMTP, Path: lmtp.Addr}
+	sm.settings.C["pipe@asdf.gh"] = mqd.ConnectionDetails{Sender: "pipe@asdf.gh", Type: mqd.ConnectionSendmail, Path: script}
+	sm.settings.C["later@asdf.gh"] = mqd.ConnectionDetails{Sender: "later@asdf.gh", Type: mqd.ConnectionSendmail, Path: script}
+	sm.settings.C["mbox@asdf.gh"] = mqd.ConnectionDetails{Sender: "mbox@asdf.gh", Type: mqd.ConnectionMbox, Path: filepath.Join(dir, "archive.mbox")}
+	sm.settings.C["maildir@asdf.gh"] = mqd.ConnectionDetails{Sender: "maildir@asdf.gh", Type: mqd.ConnectionMaildir, Path: filepath.Join(dir, "Maildir")}
+
+	send := func(from, to string) dispatcher.Report {
+		return m.ConvertAndSend([]byte("To: "+to+"\r\nFrom: "+from+"\r\nMessage-ID: <1@asdf.gh>\r\nDate: Sat, 04 Mar 2017 05:06:07 +0000\r\n\r\nhello\r\nFrom here on\r\n"), nil)
+	}
+
+	report := send("lmtp@asdf.gh", "a@x.com, full@x.com")
+	if report.Result != dispatcher.Deferred || len(report.Deliveries) != 2 || report.Deliveries[1].String() != "full@x.com deferred: 452 4.2.2 mailbox full" {
+		t.Errorf("unexpected lmtp report %+v", report)
+	}
+	if messages := lmtp.Messages(); len(messages) != 1 || strings.Join(messages[0].To, " ") != "a@x.com" {
+		t.Errorf("unexpected lmtp messages %+v", messages)
+	}
+
+	if report = send("pipe@asdf.gh", "a@x.com, b@x.com"); report.Result != dispatcher.Sent {
+		t.Errorf("sendmail: %s %s", report.Result, report.Error)
+	}
+	if args := readTestFile(t, filepath.Join(dir, "args")); args != "-i -f pipe@asdf.gh -- a@x.com b@x.com\n" {
+		t.Errorf("unexpected sendmail arguments %q", args)
+	}
+	if stdin := readTestFile(t, filepath.Join(dir, "stdin")); strings.Contains(stdin, "\r") || !strings.HasSuffix(stdin, "\n\nhello\nFrom here on\n") {
+		t.Errorf("unexpected sendmail input %q", stdin)
+	}
+	if report = send("later@asdf.gh", "a@x.com"); report.Result != dispatcher.Deferred {
+		t.Errorf("expected sendmail exit status 75 to defer, got %s %s", report.Result, report.Error)
+	}
+
+	for ix := 0; ix < 2; ix++ {
+		if report = send("mbox@asdf.gh", "a@x.com"); report.Result != dispatcher.Sent {
+			t.Errorf("mbox: %s %s", report.Result, report.Error)
+		}
+	}
+	mbox := readTestFile(t, filepath.Join(dir, "archive.mbox"))
+	if strings.Count(mbox, "From mbox@asdf.gh Sat Mar  4 05:06:07 2017\n") != 2 || strings.Count(mbox, "\n>From here on\n\n") != 2 {
+		t.Errorf("unexpected mbox %q", mbox)
+	}
+
+	if report = send("maildir@asdf.gh", "a@x.com"); report.Result != dispatcher.Sent {
+		t.Errorf("maildir: %s %s", report.Result, report.Error)
+	}
+	delivered, _ := filepath.Glob(filepath.Join(dir, "Maildir", "new", "*"))
+	if len(delivered) != 1 || !strings.HasPrefix(readTestFile(t, delivered[0]), "Return-Path: <maildir@asdf.gh>\nTo: a@x.com\n") {
+		t.Errorf("unexpected maildir delivery %v", delivered)
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	status, reply := http.StatusAccepted, `{"id": "1"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := ioutil.ReadAll(r.Body)
+		got, gotBody = r, string(raw)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "mqd-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	writeTestFile(t, filepath.Join(dir, "body.tmpl"), `{"from": {{json .Sender}}, "to": {{json .Recipients}}, "raw": {{json .Base64}}}`)
+
+	m := testMailer(t)
+	sm := m.(*smtpMailer)
+	sm.settings.C["raw@asdf.gh"] = mqd.ConnectionDetails{Sender: "raw@asdf.gh", Type: mqd.ConnectionHTTP, Username: "api", Password: "key",
+		HTTP: &mqd.HTTPSettings{URL: srv.URL + "/raw", Permanent: `"error"`}}
+	sm.settings.C["json@asdf.gh"] = mqd.ConnectionDetails{Sender: "json@asdf.gh", Type: mqd.ConnectionHTTP,
+		HTTP: &mqd.HTTPSettings{URL: srv.URL + "/json", Headers: map[string]string{"Authorization": "Bearer token"}, Template: filepath.Join(dir, "body.tmpl")}}
+
+	message := func(from string) []byte {
+		return []byte("To: a@x.com\r\nFrom: " + from + "\r\nMessage-ID: <1@asdf.gh>\r\nDate: Sat, 04 Mar 2017 05:06:07 +0000\r\n\r\nhello\r\n")
+	}
+
+	if report := m.ConvertAndSend(message("raw@asdf.gh"), nil); report.Result != dispatcher.Sent {
+		t.Fatalf("raw: %s %s", report.Result, report.Error)
+	}
+	if user, pass, _ := got.BasicAuth(); user != "api" || pass != "key" || got.Header.Get("Content-Type") != "message/rfc822" || !strings.HasSuffix(gotBody, "\r\n\r\nhello\r\n") {
+		t.Errorf("unexpected raw request %v %q", got.Header, gotBody)
+	}
+
+	if report := m.ConvertAndSend(message("json@asdf.gh"), nil); report.Result != dispatcher.Sent {
+		t.Fatalf("json: %s %s", report.Result, report.Error)
+	}
+	var body struct {
+		From string
+		To   []string
+		Raw  []byte
+	}
+	if err := json.Unmarshal([]byte(gotBody), &body); err != nil {
+		t.Fatalf("unexpected json body %q: %v", gotBody, err)
+	}
+	if got.Header.Get("Authorization") != "Bearer token" || body.From != "json@asdf.gh" || strings.Join(body.To, " ") != "a@x.com" || !bytes.HasSuffix(body.Raw, []byte("hello\r\n")) {
+		t.Errorf("unexpected json request %v %+v", got.Header, body)
+	}
+
+	// the template is read once, until the settings are loaded again
+	writeTestFile(t, filepath.Join(dir, "body.tmpl"), `{"from": "edited"}`)
+	if report := m.ConvertAndSend(message("json@asdf.gh"), nil); report.Result != dispatcher.Sent || !strings.Contains(gotBody, `"raw"`) {
+		t.Errorf("expected the cached template to be used, got %s %q", report.Result, gotBody)
+	}
+	if err := m.LoadSettings(sm.settings); err != nil {
+		t.Fatal(err)
+	}
+	if report := m.ConvertAndSend(message("json@asdf.gh"), nil); report.Result != dispatcher.Sent || gotBody != `{"from": "edited"}` {
+		t.Errorf("expected the edited template after LoadSettings, got %s %q", report.Result, gotBody)
+	}
+
+	// connections sharing a sender keep their own transports
+	sm.settings.C["other"] = mqd.ConnectionDetails{Sender: "raw@asdf.gh", Type: mqd.ConnectionHTTP, HTTP: &mqd.HTTPSettings{URL: srv.URL + "/other"}}
+	for _, env := range []*dispatcher.Envelope{nil, {Connection: "other"}} {
+		report := m.ConvertAndSend(message("raw@asdf.gh"), env)
+		expected := "/raw"
+		if env != nil {
+			expected = "/other"
+		}
+		if report.Result != dispatcher.Sent || got.URL.Path != expected {
+			t.Errorf("expected a request to %s, got %s to %s", expected, report.Result, got.URL.Path)
+		}
+	}
+
+	tests := []struct {
+		status int
+		reply  string
+		result dispatcher.Result
+	}{
+		{http.StatusServiceUnavailable, "busy", dispatcher.Deferred},
+		{http.StatusTooManyRequests, "slow down", dispatcher.Deferred},
+		{http.StatusBadRequest, "bad recipient", dispatcher.Failed},
+		{http.StatusOK, `{"error": "suspended"}`, dispatcher.Failed},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		status, reply = test.status, test.reply
+		if report := m.ConvertAndSend(message("raw@asdf.gh"), nil); report.Result != test.result {
+			t.Errorf("expected %s, got %s: %s", test.result, report.Result, report.Error)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+type stubResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
 var (
 	testConfig = []byte(`{
     "interval": 45,
@@ -125,7 +991,7 @@ func testMailer(t *testing.T) Mailer {
 		t.Errorf("unmarshal fail: %v", err)
 	}
 
-	m := NewMailer(cfg)
+	m := NewMailer(cfg, nil)
 
 	fn := func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
 		t.Logf("Sending.. addr: %q, auth: %s, from: %q, to: %v, len: %d", addr, a, from, to, len(msg))
@@ -144,3 +1010,26 @@ func dummySender(m Mailer, sf senderFunc) func() {
 	sm.sendFn = senderFunc(sf)
 	return func() { sm.sendFn = orig }
 }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{nil, "none"},
+		{&textproto.Error{Code: 535, Msg: "5.7.8 bad credentials"}, "auth"},
+		{&textproto.Error{Code: 421, Msg: "4.3.2 shutting down"}, "temporary"},
+		{&textproto.Error{Code: 554, Msg: "5.7.1 rejected"}, "permanent"},
+		{&mqdsmtp.ExtensionError{Extension: "SMTPUTF8"}, "extension"},
+		{&mqdsmtp.ExtensionError{Extension: "STARTTLS"}, "tls"},
+		{&mqdsmtp.RecipientsError{}, "recipient"},
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, "network"},
+		{mqdsmtp.SendMail("127.0.0.1:1", nil, "a@example.com", []string{"b@example.com"}, nil), "network"},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if class := errorClass(test.err); class != test.class {
+			t.Errorf("expected class %s for %v, got %s", test.class, test.err, class)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+)
+
+// messageID returns the Message-ID of the message, or the one that
+// will be added to it when it is sent. That is the one the dispatcher
+// kept from an earlier attempt, if any, so that a deferred message
+// keeps its ID, or else a new one made of the time and random bytes.
+func (m *smtpMailer) messageID(header mail.Header, env *dispatcher.Envelope, sender string) string {
+	if id := strings.TrimSpace(header.Get("Message-ID")); id != "" {
+		return id
+	}
+	if env != nil && env.MessageID != "" {
+		return env.MessageID
+	}
+
+	domain := m.settings.MessageIDDomain
+	if domain == "" {
+		domain = domainOf(sender)
+	}
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	var random [12]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		m.log.Warn("reading random bytes for Message-ID", logging.Err(err))
+	}
+	return "<" + strconv.FormatInt(m.now().UnixNano(), 36) + "." + hex.EncodeToString(random[:]) + ".mqd@" + domain + ">"
+}
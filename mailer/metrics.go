@@ -0,0 +1,117 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+var (
+	sendTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "mailer",
+		Name:      "messages_total",
+		Help:      "Messages handed to a connection, by connection, result and error class.",
+	}, []string{"connection", "result", "class"})
+	sendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mqd",
+		Subsystem: "mailer",
+		Name:      "send_duration_seconds",
+		Help:      "Time taken to prepare, sign and deliver a message, by connection.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"connection"})
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "mailer",
+		Name:      "auth_failures_total",
+		Help:      "Messages a relay server refused because authentication failed, by connection.",
+	}, []string{"connection"})
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqd",
+		Subsystem: "mailer",
+		Name:      "rate_limited_total",
+		Help:      "Messages, or recipients of a limited domain, deferred by a rate limit, by what is limited.",
+	}, []string{"limit"})
+)
+
+func init() {
+	prometheus.MustRegister(sendTotal, sendDuration, authFailures, rateLimited)
+}
+
+// observeSend records the outcome of sending a message through
+// connection.
+func observeSend(connection string, elapsed time.Duration, err error) {
+	result := "sent"
+	if refused, ok := err.(*mqdsmtp.RecipientsError); ok {
+		switch {
+		case refused.Delivered:
+			result = "partial"
+		case temporary(refused):
+			result = "deferred"
+		default:
+			result = "failed"
+		}
+	} else if err != nil {
+		result = "failed"
+	}
+	class := errorClass(err)
+	sendTotal.WithLabelValues(connection, result, class).Inc()
+	sendDuration.WithLabelValues(connection).Observe(elapsed.Seconds())
+	if class == "auth" {
+		authFailures.WithLabelValues(connection).Inc()
+	}
+}
+
+// temporary reports whether every recipient was refused temporarily.
+func temporary(refused *mqdsmtp.RecipientsError) bool {
+	for _, r := range refused.Rejected {
+		if !r.Temporary() {
+			return false
+		}
+	}
+	return true
+}
+
+// errorClass groups errors returned by send for metrics: none, auth,
+// tls, extension, recipient, network, temporary, permanent or other.
+func errorClass(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return "none"
+	case *mqdsmtp.RecipientsError:
+		return "recipient"
+	case *mqdsmtp.ExtensionError:
+		if err.Extension == "STARTTLS" {
+			return "tls"
+		}
+		return "extension"
+	case *textproto.Error:
+		switch {
+		case err.Code == 530 || err.Code == 534 || err.Code == 535 || err.Code == 538:
+			return "auth"
+		case err.Code < 500:
+			return "temporary"
+		}
+		return "permanent"
+	case tls.RecordHeaderError, *tls.CertificateVerificationError,
+		x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return "tls"
+	case net.Error:
+		return "network"
+	}
+	if strings.Contains(err.Error(), "STARTTLS") {
+		return "tls"
+	}
+	return "other"
+}
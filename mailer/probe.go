@@ -0,0 +1,82 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"jw4.us/mqd"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+// ErrNoProbe is returned by Probe for connections whose type can't be
+// checked without sending mail, such as direct connections.
+var ErrNoProbe = errors.New("connection type can't be probed")
+
+// prober is implemented by Transports that can check that they would
+// be able to deliver, without sending anything.
+type prober interface {
+	Probe() error
+}
+
+// Probe checks that connection, from the settings s, is able to
+// deliver: relay and LMTP servers are connected to and greeted, and
+// relay servers authenticated with, local programs and folders are
+// checked to exist. Nothing is sent.
+func Probe(s *mqd.Settings, connection mqd.ConnectionDetails) error {
+	m := NewMailer(s, nil).(*smtpMailer)
+	transport, err := m.transport("", connection)
+	if err != nil {
+		return err
+	}
+	if p, ok := transport.(prober); ok {
+		return p.Probe()
+	}
+	return ErrNoProbe
+}
+
+// Probe fulfills the prober interface
+func (t *relayTransport) Probe() error {
+	return mqdsmtp.Probe(t.addr, t.auth, mqdsmtp.Options{})
+}
+
+// Probe fulfills the prober interface
+func (t *lmtpTransport) Probe() error {
+	return mqdsmtp.ProbeLMTP(t.addr, t.opts)
+}
+
+// Probe fulfills the prober interface
+func (t *sendmailTransport) Probe() error {
+	_, err := exec.LookPath(t.program)
+	return err
+}
+
+// Probe fulfills the prober interface
+func (t *mboxTransport) Probe() error {
+	return writable(filepath.Dir(t.path))
+}
+
+// Probe fulfills the prober interface
+func (t *maildirTransport) Probe() error {
+	if _, err := os.Stat(t.path); os.IsNotExist(err) {
+		// created on the first delivery
+		return writable(filepath.Dir(t.path))
+	}
+	return writable(filepath.Join(t.path, "tmp"))
+}
+
+// writable checks that files can be created in dir.
+func writable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".mqd-probe-")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,301 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+// rate is a limit of n messages per window on the mail sent through a
+// connection, or to a domain. Its bucket is named by key.
+type rate struct {
+	key    string
+	what   string
+	unit   string
+	n      int
+	window time.Duration
+}
+
+// rates returns the limits of l, for the connection or domain what.
+func rates(kind, what string, l *mqd.RateLimit) []rate {
+	if l == nil {
+		return nil
+	}
+	var list []rate
+	for _, r := range []struct {
+		unit   string
+		n      int
+		window time.Duration
+	}{
+		{"second", l.PerSecond, time.Second},
+		{"minute", l.PerMinute, time.Minute},
+		{"hour", l.PerHour, time.Hour},
+		{"day", l.PerDay, 24 * time.Hour},
+	} {
+		if r.n > 0 {
+			list = append(list, rate{key: kind + ":" + what + ":" + r.unit, what: kind + " " + what, unit: r.unit, n: r.n, window: r.window})
+		}
+	}
+	return list
+}
+
+func (r rate) String() string {
+	return fmt.Sprintf("rate limit of %d per %s for %s reached", r.n, r.unit, r.what)
+}
+
+// bucket holds the tokens left of a rate as of Updated. It is full
+// again, and can be forgotten, at Full.
+type bucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+	Full    time.Time `json:"full"`
+}
+
+// limiter keeps the token buckets of the rate limits. They are saved
+// to the state file after every change, so that restarting doesn't
+// reset them.
+type limiter struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[string]bucket
+}
+
+// loadLimiter reads the state file at path. A limiter is returned
+// even when that fails, starting with full buckets.
+func loadLimiter(path string) (*limiter, error) {
+	l := &limiter{path: path, buckets: map[string]bucket{}}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(raw, &l.buckets)
+	}
+	if err != nil {
+		l.buckets = map[string]bucket{}
+		return l, err
+	}
+	return l, nil
+}
+
+// tokens returns the tokens in the bucket of r at now. Buckets start
+// full, and refill at the rate, up to n.
+func (l *limiter) tokens(r rate, now time.Time) float64 {
+	b, ok := l.buckets[r.key]
+	if !ok {
+		return float64(r.n)
+	}
+	tokens := b.Tokens + now.Sub(b.Updated).Seconds()*float64(r.n)/r.window.Seconds()
+	if tokens > float64(r.n) {
+		tokens = float64(r.n)
+	}
+	return tokens
+}
+
+// short returns the first of list that doesn't have n tokens. A rate
+// is never short of more than its limit, so messages that count for
+// more than that are sent when its bucket is full.
+func (l *limiter) short(list []rate, n int, now time.Time) (rate, bool) {
+	for _, r := range list {
+		need := n
+		if need > r.n {
+			need = r.n
+		}
+		if l.tokens(r, now) < float64(need) {
+			return r, true
+		}
+	}
+	return rate{}, false
+}
+
+// take removes n tokens from the buckets of list.
+func (l *limiter) take(list []rate, n int, now time.Time) {
+	for _, r := range list {
+		tokens := l.tokens(r, now) - float64(n)
+		refill := time.Duration((float64(r.n) - tokens) / float64(r.n) * float64(r.window))
+		l.buckets[r.key] = bucket{Tokens: tokens, Updated: now, Full: now.Add(refill)}
+	}
+}
+
+// save writes the buckets that aren't full again to the state file.
+func (l *limiter) save(now time.Time) error {
+	for key, b := range l.buckets {
+		if !now.Before(b.Full) {
+			delete(l.buckets, key)
+		}
+	}
+	raw, err := json.Marshal(l.buckets)
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// limiter returns the limiter for the state file of the settings,
+// loading it the first time, or nil when nothing is limited.
+func (m *smtpMailer) limiter(connection mqd.ConnectionDetails) *limiter {
+	if connection.RateLimit == nil && len(m.settings.DomainLimits) == 0 {
+		return nil
+	}
+	m.limitsMu.Lock()
+	defer m.limitsMu.Unlock()
+	path := m.settings.RateLimitStatePath()
+	if m.limits == nil || m.limits.path != path {
+		var err error
+		if m.limits, err = loadLimiter(path); err != nil {
+			m.log.Warn("reading rate limit state, starting afresh", logging.File, path, logging.Err(err))
+		}
+	}
+	return m.limits
+}
+
+// domainLimit returns the limit on mail to domain, if any.
+func (m *smtpMailer) domainLimit(domain string) *mqd.RateLimit {
+	for name, l := range m.settings.DomainLimits {
+		if strings.EqualFold(name, domain) {
+			l := l
+			return &l
+		}
+	}
+	return nil
+}
+
+// ration applies the rate limits of connection and of the recipient
+// domains to a message. It returns the recipients that may be sent to
+// now, and those that must wait as Deferred deliveries, taking tokens
+// for the ones sent to. When the connection is over its limit nobody is
+// sent to, and the reason is returned.
+func (m *smtpMailer) ration(connection mqd.ConnectionDetails, recipients []string) (allowed []string, limited []dispatcher.Delivery, reason string) {
+	l := m.limiter(connection)
+	if l == nil {
+		return recipients, nil, ""
+	}
+	now := m.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var (
+		taken   []rate
+		domains = map[string]bool{}
+	)
+	for _, rcpt := range recipients {
+		domain := strings.ToLower(rcpt[strings.LastIndexByte(rcpt, '@')+1:])
+		list := rates("domain", domain, m.domainLimit(domain))
+		if r, ok := l.short(list, 1, now); ok {
+			limited = append(limited, dispatcher.Delivery{Recipient: rcpt, Result: dispatcher.Deferred, Error: r.String()})
+			rateLimited.WithLabelValues(r.what).Inc()
+			continue
+		}
+		allowed = append(allowed, rcpt)
+		if !domains[domain] {
+			domains[domain] = true
+			taken = append(taken, list...)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, limited, limited[0].Error
+	}
+	list := rates("connection", connection.Sender, connection.RateLimit)
+	messages := chunks(len(allowed), connection.RateLimit)
+	if r, ok := l.short(list, messages, now); ok {
+		rateLimited.WithLabelValues(r.what).Inc()
+		return nil, nil, r.String()
+	}
+
+	l.take(taken, 1, now)
+	l.take(list, messages, now)
+	if err := l.save(now); err != nil {
+		m.log.Warn("saving rate limit state", logging.File, l.path, logging.Err(err))
+	}
+	return allowed, limited, ""
+}
+
+// chunks returns how many messages sending to n recipients takes under
+// the MaxRecipients of l.
+func chunks(n int, l *mqd.RateLimit) int {
+	if l == nil || l.MaxRecipients <= 0 || n <= l.MaxRecipients {
+		return 1
+	}
+	return (n + l.MaxRecipients - 1) / l.MaxRecipients
+}
+
+// limitReport adds the recipients held back by rate limits to report,
+// which is then Deferred.
+func limitReport(report dispatcher.Report, recipients []string, limited []dispatcher.Delivery) dispatcher.Report {
+	if len(limited) == 0 {
+		return report
+	}
+	if len(report.Deliveries) == 0 {
+		for _, rcpt := range report.Recipients {
+			report.Deliveries = append(report.Deliveries, dispatcher.Delivery{Recipient: rcpt, Result: report.Result, Error: report.Error})
+		}
+	}
+	report.Recipients = recipients
+	report.Deliveries = append(report.Deliveries, limited...)
+	report.Result = dispatcher.Deferred
+	if report.Error == "" {
+		report.Error = limited[0].Error
+	}
+	return report
+}
+
+// deliverChunks delivers msg through t in separate messages to at most
+// size recipients each. Recipients of chunks that failed are listed in a
+// *mqdsmtp.RecipientsError, unless every chunk failed with the same
+// kind of error, which is returned as it is.
+func deliverChunks(t Transport, name string, size int, from string, to []string, msg []byte) error {
+	if size <= 0 || len(to) <= size {
+		return t.Deliver(from, to, msg)
+	}
+	refused := &mqdsmtp.RecipientsError{Server: name}
+	var first error
+	sent, failed := 0, 0
+	for start := 0; start < len(to); start += size {
+		end := start + size
+		if end > len(to) {
+			end = len(to)
+		}
+		chunk := to[start:end]
+		sent++
+		switch err := t.Deliver(from, chunk, msg).(type) {
+		case nil:
+			refused.Delivered = true
+		case *mqdsmtp.RecipientsError:
+			refused.Server = err.Server
+			refused.Rejected = append(refused.Rejected, err.Rejected...)
+			refused.Delivered = refused.Delivered || err.Delivered
+		default:
+			if first == nil {
+				first = err
+			}
+			failed++
+			for _, rcpt := range chunk {
+				refused.Rejected = append(refused.Rejected, &mqdsmtp.RecipientError{Recipient: rcpt, Err: err})
+			}
+		}
+	}
+	if failed == sent {
+		return first
+	}
+	if len(refused.Rejected) > 0 {
+		return refused
+	}
+	return nil
+}
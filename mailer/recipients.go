@@ -0,0 +1,131 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"jw4.us/mqd"
+)
+
+// recipientParser collects recipient addresses, handling entries that
+// don't parse according to a mqd.RecipientPolicy.
+type recipientParser struct {
+	policy  mqd.RecipientPolicy
+	seen    map[string]bool
+	list    []string
+	dropped []string
+}
+
+func newRecipientParser(policy mqd.RecipientPolicy) *recipientParser {
+	return &recipientParser{policy: policy, seen: map[string]bool{}}
+}
+
+// parse adds the addresses in value, an address list as found in a
+// To: header.
+func (p *recipientParser) parse(value string) error {
+	list, err := mail.ParseAddressList(value)
+	if err == nil {
+		p.add(list...)
+		return nil
+	}
+
+	separators := ","
+	switch p.policy {
+	case mqd.RecipientStrict:
+		return fmt.Errorf("invalid recipient list %q: %v", value, err)
+	case mqd.RecipientRepair:
+		separators = ",;"
+	}
+	for _, entry := range splitList(value, separators) {
+		if p.policy == mqd.RecipientRepair {
+			entry = repairAddress(entry)
+		}
+		addr, err := mail.ParseAddress(entry)
+		if err != nil {
+			p.dropped = append(p.dropped, entry)
+			continue
+		}
+		p.add(addr)
+	}
+	return nil
+}
+
+func (p *recipientParser) add(list ...*mail.Address) {
+	for _, addr := range list {
+		if !p.seen[addr.Address] {
+			p.seen[addr.Address] = true
+			p.list = append(p.list, addr.Address)
+		}
+	}
+}
+
+// splitList splits an address list on any of the separators that
+// aren't inside a quoted string, a comment or angle brackets. When the
+// brackets don't balance they are ignored. Empty entries are left out.
+func splitList(value, separators string) []string {
+	entries, balanced := split(value, separators, true)
+	if !balanced {
+		entries, _ = split(value, separators, false)
+	}
+	return entries
+}
+
+func split(value, separators string, brackets bool) ([]string, bool) {
+	var entries []string
+	start, depth, quoted, escaped := 0, 0, false, false
+	appendEntry := func(end int) {
+		if entry := strings.TrimSpace(value[start:end]); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	for ix, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case brackets && (c == '(' || c == '<'):
+			depth++
+		case brackets && (c == ')' || c == '>') && depth > 0:
+			depth--
+		case depth == 0 && strings.ContainsRune(separators, c):
+			appendEntry(ix)
+			start = ix + 1
+		}
+	}
+	appendEntry(len(value))
+	return entries, depth == 0
+}
+
+// repairAddress fixes common mistakes in a single address: a mailto:
+// prefix, a missing closing angle bracket, and a display name followed
+// by a bare address.
+func repairAddress(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if len(entry) > 7 && strings.EqualFold(entry[:7], "mailto:") {
+		entry = entry[7:]
+	}
+	open := strings.LastIndexByte(entry, '<')
+	if open >= 0 {
+		if !strings.Contains(entry[open:], ">") {
+			entry += ">"
+		}
+		return entry
+	}
+	if ix := strings.LastIndexAny(entry, " \t"); ix >= 0 && strings.Contains(entry[ix+1:], "@") {
+		name, addr := strings.TrimSpace(entry[:ix]), entry[ix+1:]
+		if !strings.HasPrefix(name, `"`) {
+			name = `"` + strings.ReplaceAll(name, `"`, ``) + `"`
+		}
+		entry = name + " <" + addr + ">"
+	}
+	return entry
+}
@@ -0,0 +1,69 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"net/mail"
+	"strings"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/logging"
+)
+
+// prepare applies the header rewriting configured for connection to
+// message. Anything that changes the message must happen here, ahead
+// of DKIM signing.
+func (m *smtpMailer) prepare(connection mqd.ConnectionDetails, message []byte, messageID string) ([]byte, error) {
+	h := splitRawHeader(message)
+	if rewriteSender(h, connection) {
+		m.log.Debug("rewrote From", logging.MessageID, messageID, logging.Connection, connection.Sender,
+			"policy", connection.RewriteFrom)
+	}
+	if !h.Has("Message-ID") {
+		h.Add("Message-ID", messageID)
+	}
+	if !h.Has("Date") {
+		h.Add("Date", m.now().Format(time.RFC1123Z))
+	}
+	return h.Bytes(), nil
+}
+
+// rewriteSender makes the From: header agree with the account the
+// connection authenticates as, according to the connection's rewrite
+// policy. The account is the envelope sender unless the message's
+// envelope gives another. It reports whether the header was changed.
+func rewriteSender(h *rawHeader, connection mqd.ConnectionDetails) bool {
+	policy := connection.RewriteFrom
+	if policy == "" || policy == mqd.RewriteNone || connection.Sender == "" {
+		return false
+	}
+
+	eml, err := parseEmail(h.Bytes())
+	if err != nil {
+		return false
+	}
+	original, err := mail.ParseAddress(eml.Header.Get("From"))
+	if err == nil && strings.EqualFold(original.Address, connection.Sender) {
+		return false
+	}
+
+	account := &mail.Address{Address: connection.Sender}
+	switch policy {
+	case mqd.RewriteFrom:
+		h.Set("From", account.String())
+	case mqd.RewriteReplyTo:
+		if original != nil {
+			account.Name = original.Name
+			if !h.Has("Reply-To") {
+				h.Set("Reply-To", original.String())
+			}
+		}
+		h.Set("From", account.String())
+	}
+	// a Sender: naming someone else would contradict the new From:
+	h.Del("Sender")
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"crypto"
+	"net/mail"
+	"strings"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dkim"
+)
+
+// sign adds a DKIM signature to message if signing is configured for
+// the connection or the domain of the From address. It must be the
+// last change made to the message before it is transmitted.
+func (m *smtpMailer) sign(connection mqd.ConnectionDetails, message []byte) ([]byte, error) {
+	domain := domainOf(connection.Sender)
+	if eml, err := parseEmail(message); err == nil {
+		if from, err := mail.ParseAddress(eml.Header.Get("From")); err == nil {
+			domain = domainOf(from.Address)
+		}
+	}
+
+	settings := m.settings.DKIMFor(connection, domain)
+	if settings == nil {
+		return message, nil
+	}
+
+	key, err := m.signingKey(m.settings.Path(settings.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	hc, bc := dkim.Relaxed, dkim.Simple
+	if settings.Canonicalization != "" {
+		if hc, bc, err = dkim.ParseCanonicalization(settings.Canonicalization); err != nil {
+			return nil, err
+		}
+	}
+	o := &dkim.Options{
+		Domain:                 settings.Domain,
+		Selector:               settings.Selector,
+		Signer:                 key,
+		Headers:                settings.Headers,
+		HeaderCanonicalization: hc,
+		BodyCanonicalization:   bc,
+		Time:                   m.now(),
+	}
+	if o.Domain == "" {
+		o.Domain = domain
+	}
+	return dkim.Sign(message, o)
+}
+
+// signingKey loads and caches the private key at path.
+func (m *smtpMailer) signingKey(path string) (crypto.Signer, error) {
+	m.keysMu.Lock()
+	defer m.keysMu.Unlock()
+	if key, ok := m.keys[path]; ok {
+		return key, nil
+	}
+	key, err := dkim.LoadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	if m.keys == nil {
+		m.keys = map[string]crypto.Signer{}
+	}
+	m.keys[path] = key
+	return key, nil
+}
+
+func domainOf(address string) string {
+	if ix := strings.LastIndexByte(address, '@'); ix >= 0 {
+		return strings.ToLower(address[ix+1:])
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mailer // import "jw4.us/mqd/mailer"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jw4.us/mqd"
+	mqdsmtp "jw4.us/mqd/smtp"
+)
+
+// transport returns the Transport for connection, configured under
+// name.
+func (m *smtpMailer) transport(name string, connection mqd.ConnectionDetails) (Transport, error) {
+	switch connection.Type {
+	case "", mqd.ConnectionRelay:
+		auth, err := connection.Auth()
+		if err != nil {
+			return nil, err
+		}
+		return &relayTransport{sender: m, addr: connection.Server, auth: auth}, nil
+	case mqd.ConnectionDirect:
+		return m.directTransport(connection), nil
+	case mqd.ConnectionLMTP:
+		addr := connection.Path
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = m.settings.Path(addr)
+		}
+		return &lmtpTransport{addr: addr, opts: mqdsmtp.Options{HelloName: connection.Host}}, nil
+	case mqd.ConnectionSendmail:
+		program := connection.Path
+		if strings.ContainsAny(program, `/\`) {
+			program = m.settings.Path(program)
+		}
+		return &sendmailTransport{program: program, args: connection.Args}, nil
+	case mqd.ConnectionMbox:
+		return &mboxTransport{path: m.settings.Path(connection.Path), now: m.now}, nil
+	case mqd.ConnectionMaildir:
+		return &maildirTransport{path: m.settings.Path(connection.Path), now: m.now}, nil
+	case mqd.ConnectionHTTP:
+		return m.httpTransport(name, connection)
+	}
+	return nil, fmt.Errorf("unknown connection type %q", string(connection.Type))
+}
+
+// relayTransport hands messages to a relay server through an
+// EmailSender.
+type relayTransport struct {
+	sender EmailSender
+	addr   string
+	auth   smtp.Auth
+}
+
+// Deliver fulfills the Transport interface
+func (t *relayTransport) Deliver(from string, to []string, msg []byte) error {
+	return t.sender.SendMail(t.addr, t.auth, from, to, msg)
+}
+
+// lmtpTransport hands messages to a local delivery agent.
+type lmtpTransport struct {
+	addr string
+	opts mqdsmtp.Options
+}
+
+// Deliver fulfills the Transport interface
+func (t *lmtpTransport) Deliver(from string, to []string, msg []byte) error {
+	return mqdsmtp.SendLMTP(t.addr, from, to, msg, t.opts)
+}
+
+// exTempFail is the sysexits.h status sendmail programs exit with
+// when delivery should be tried again later.
+const exTempFail = 75
+
+// sendmailTransport pipes messages to a sendmail compatible program.
+type sendmailTransport struct {
+	program string
+	args    []string
+}
+
+// Deliver fulfills the Transport interface
+func (t *sendmailTransport) Deliver(from string, to []string, msg []byte) error {
+	args := t.args
+	if len(args) == 0 {
+		args = []string{"-i", "-f", from, "--"}
+	}
+	readsHeaders := false
+	for _, arg := range args {
+		readsHeaders = readsHeaders || arg == "-t"
+	}
+	if !readsHeaders {
+		args = append(append([]string(nil), args...), to...)
+	}
+
+	cmd := exec.Command(t.program, args...)
+	cmd.Stdin = bytes.NewReader(unixLines(msg))
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	err = fmt.Errorf("%s: %v: %s", t.program, err, strings.TrimSpace(output.String()))
+	if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() == exTempFail {
+		return retryLater(t.program, to, err)
+	}
+	return err
+}
+
+// mboxLock serializes appends to mbox files.
+var mboxLock sync.Mutex
+
+// mboxTransport appends messages to an mbox file, in the mboxrd
+// format.
+type mboxTransport struct {
+	path string
+	now  func() time.Time
+}
+
+// Deliver fulfills the Transport interface
+func (t *mboxTransport) Deliver(from string, to []string, msg []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From %s %s\n", from, t.now().UTC().Format(time.ANSIC))
+	for _, line := range strings.SplitAfter(string(unixLines(msg)), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteByte('>')
+		}
+		buf.WriteString(line)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	mboxLock.Lock()
+	defer mboxLock.Unlock()
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// maildirCount keeps the names of maildir files unique within the
+// process.
+var maildirCount int64
+
+// maildirTransport stores messages in a Maildir folder, creating it
+// if needed.
+type maildirTransport struct {
+	path string
+	now  func() time.Time
+}
+
+// Deliver fulfills the Transport interface
+func (t *maildirTransport) Deliver(from string, to []string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.path, sub), 0700); err != nil {
+			return err
+		}
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := t.now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirCount, 1), host)
+
+	content := append([]byte("Return-Path: <"+from+">\n"), unixLines(msg)...)
+	tmp := filepath.Join(t.path, "tmp", name)
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.path, "new", name))
+}
+
+// unixLines converts the CRLF line endings of msg to LF, as local
+// mail stores and programs expect.
+func unixLines(msg []byte) []byte {
+	return bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+}
+
+// retryLater reports every recipient in to as temporarily
+// undeliverable because of err.
+func retryLater(server string, to []string, err error) error {
+	refused := &mqdsmtp.RecipientsError{Server: server}
+	for _, rcpt := range to {
+		refused.Rejected = append(refused.Rejected, &mqdsmtp.RecipientError{Recipient: rcpt, Err: err})
+	}
+	return refused
+}
@@ -0,0 +1,93 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package metrics serves the Prometheus metrics of the dispatcher,
+// the mailer and the listeners, along with the depth of the queue
+// folders, and the health checks of the service.
+package metrics // import "jw4.us/mqd/metrics"
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/health"
+	"jw4.us/mqd/logging"
+)
+
+// DefaultPath is where metrics are served unless configured
+// otherwise.
+const DefaultPath = "/metrics"
+
+// Server is the metrics HTTP server.
+type Server struct {
+	settings mqd.MetricsSettings
+	log      *slog.Logger
+	mux      *http.ServeMux
+	http     *http.Server
+}
+
+// NewServer returns a Server for the metrics settings of s, which
+// reports on the queue folders of s, and serves the /healthz and
+// /readyz checks of checker. Without a checker only s is checked. It
+// logs to log, or the default logger when it is nil.
+func NewServer(s *mqd.Settings, checker *health.Checker, log *slog.Logger) (*Server, error) {
+	if s.Metrics == nil {
+		return nil, errors.New("no metrics settings")
+	}
+	log = logging.Or(log).With("listener", "metrics")
+	srv := &Server{settings: *s.Metrics, log: log, mux: http.NewServeMux()}
+	if srv.settings.Path == "" {
+		srv.settings.Path = DefaultPath
+	}
+
+	queue := prometheus.NewRegistry()
+	queue.MustRegister(dispatcher.NewQueueCollector(s.MailQueue, s.BadMail, s.SentMail))
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, queue}
+	srv.mux.Handle(srv.settings.Path, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+
+	if checker == nil {
+		checker = health.NewChecker(func() (*mqd.Settings, error) { return s, nil }, false, log)
+	}
+	probeInterval := srv.settings.ProbeInterval
+	if probeInterval == 0 {
+		probeInterval = mqd.DefaultProbeInterval
+	}
+	checks := checker.Handler(srv.settings.Probe, time.Duration(probeInterval))
+	srv.mux.Handle("/healthz", checks)
+	srv.mux.Handle("/readyz", checks)
+	srv.http = &http.Server{Handler: srv.mux, ReadHeaderTimeout: 30 * time.Second}
+	return srv, nil
+}
+
+// ServeHTTP fulfills the http.Handler interface
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the configured address and serves
+// clients until Close is called.
+func (srv *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", srv.settings.Listen)
+	if err != nil {
+		return err
+	}
+	srv.log.Info("listening", "addr", l.Addr().String())
+	if err = srv.http.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops the Server.
+func (srv *Server) Close() error {
+	return srv.http.Close()
+}
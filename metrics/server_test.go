@@ -0,0 +1,131 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+)
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	s := mqd.NewSettings(filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail"))
+	for _, folder := range []string{s.MailQueue, s.BadMail} {
+		if err = os.Mkdir(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Metrics = &mqd.MetricsSettings{Listen: "127.0.0.1:0"}
+
+	srv, err := NewServer(s, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultPath, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+	// the dispatcher counters are shared by every test in the process,
+	// so they are compared with what they were before
+	counters := []string{`mqd_dispatcher_messages_total{result="deferred"}`, `mqd_dispatcher_scans_total{result="ok"}`}
+	before := map[string]float64{}
+	body := scrape()
+	for _, name := range counters {
+		before[name] = value(body, name)
+	}
+
+	env := &dispatcher.Envelope{Sender: "app@example.com", Recipients: []string{"a@example.com"}}
+	for ix := 0; ix < 2; ix++ {
+		if _, err = dispatcher.Enqueue(s.MailQueue, env, []byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := dispatcher.NewPickupFolderQueue(s.MailQueue, s.BadMail, "", dispatcher.QueueOptions{})
+	if err = q.Process(func([]byte, *dispatcher.Envelope) dispatcher.Report {
+		return dispatcher.Report{Result: dispatcher.Deferred}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	body = scrape()
+	for _, expected := range []string{
+		`mqd_queue_messages{folder="mailqueue"} 2`,
+		`mqd_queue_messages{folder="badmail"} 0`,
+		`mqd_dispatcher_last_successful_scan_timestamp_seconds`,
+		`mqd_queue_oldest_message_age_seconds{folder="mailqueue"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in the metrics", expected)
+		}
+	}
+	for name, delta := range map[string]float64{counters[0]: 2, counters[1]: 1} {
+		if got := value(body, name) - before[name]; got != delta {
+			t.Errorf("expected %s to grow by %v, got %v", name, delta, got)
+		}
+	}
+}
+
+// value returns the value of the metric name in the exposition body,
+// or 0 if it isn't there.
+func value(body string, name string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	s := mqd.NewSettings(filepath.Join(dir, "mailqueue"), filepath.Join(dir, "badmail"))
+	s.Metrics = &mqd.MetricsSettings{Listen: "127.0.0.1:0"}
+	srv, err := NewServer(s, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ix, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		t.Logf("Test %d", ix)
+		for _, path := range []string{"/healthz", "/readyz"} {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code != expected {
+				t.Errorf("expected %d from %s, got %d: %s", expected, path, w.Code, w.Body)
+			}
+		}
+		if ix > 0 {
+			continue
+		}
+		// the folders are missing the first time round
+		for _, folder := range []string{s.MailQueue, s.BadMail} {
+			if err = os.Mkdir(folder, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
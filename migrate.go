@@ -0,0 +1,153 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mqd // import "jw4.us/mqd"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// SettingsVersion is the schema version written by this package.
+// Files without a version key are treated as version 0.
+const SettingsVersion = 2
+
+// migration upgrades a decoded settings document by exactly one
+// schema version, in place.
+type migration func(doc map[string]interface{}) error
+
+// migrations[n] upgrades a version n document to version n+1.
+var migrations = []migration{
+	migrateV0,
+	migrateV1,
+}
+
+// migrateV0 upgrades the original unversioned layout. Auth types were
+// matched case sensitively, so they are canonicalized to upper case.
+func migrateV0(doc map[string]interface{}) error {
+	conns, _ := doc["connections"].(map[string]interface{})
+	for key, c := range conns {
+		conn, ok := c.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("connection %q: expected an object", key)
+		}
+		if at, ok := conn["authtype"].(string); ok {
+			conn["authtype"] = strings.ToUpper(at)
+		}
+	}
+	return nil
+}
+
+// migrateV1 converts the interval from a number of seconds into a
+// duration string. Version 1 silently replaced out of range values
+// with 30 seconds; that is applied here so behavior doesn't change.
+// Intervals already given as duration strings, as documented, are
+// kept.
+func migrateV1(doc map[string]interface{}) error {
+	seconds := int64(30)
+	switch v := doc["interval"].(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("interval: %v", err)
+		}
+		doc["interval"] = Duration(d).String()
+		return nil
+	case nil:
+	case int64:
+		if v >= 5 && v <= 3600 {
+			seconds = v
+		}
+	case float64:
+		if v >= 5 && v <= 3600 {
+			seconds = int64(v)
+		}
+	default:
+		return fmt.Errorf("interval: expected a number of seconds or a duration, got %v", v)
+	}
+	doc["interval"] = Duration(time.Duration(seconds) * time.Second).String()
+	return nil
+}
+
+// migrateDocument upgrades doc to SettingsVersion, returning the
+// version it started at.
+func migrateDocument(doc map[string]interface{}) (int, error) {
+	from, err := documentVersion(doc)
+	if err != nil {
+		return 0, err
+	}
+	if from > SettingsVersion {
+		return from, fmt.Errorf("settings version %d is newer than the supported version %d", from, SettingsVersion)
+	}
+	for v := from; v < SettingsVersion; v++ {
+		if err = migrations[v](doc); err != nil {
+			return from, fmt.Errorf("migrating settings from version %d: %v", v, err)
+		}
+		doc["version"] = int64(v + 1)
+	}
+	return from, nil
+}
+
+func documentVersion(doc map[string]interface{}) (int, error) {
+	switch v := doc["version"].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		if v >= 0 {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid settings version %v", doc["version"])
+}
+
+// MigrateSettingsFile reads the settings file at path and upgrades it
+// to the current schema version, returning the original content and
+// the content of the upgraded file in the same format. Included files
+// are not touched.
+//
+// Files that are already at the current version are left as they
+// are, with their comments and formatting, and after is the same as
+// before. Otherwise, if rewrite is true, the original file is first
+// copied to a backup named after its old version, e.g.
+// ".smtp-dispatcher.settings.v0.bak", and then replaced.
+func MigrateSettingsFile(path string, rewrite bool) (before []byte, after []byte, err error) {
+	before, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := FormatForPath(path)
+	if format == "" {
+		format = SniffFormat(before)
+	}
+	s, err := UnmarshalSettingsFormat(before, format)
+	if err != nil {
+		return before, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if s.MigratedFrom() >= SettingsVersion {
+		return before, before, nil
+	}
+	after, err = MarshalSettings(s)
+	if err != nil {
+		return before, nil, err
+	}
+	if !rewrite {
+		return before, after, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return before, after, err
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", path, s.MigratedFrom())
+	if err = ioutil.WriteFile(backup, before, fi.Mode().Perm()); err != nil {
+		return before, after, fmt.Errorf("writing backup %q: %v", backup, err)
+	}
+	if err = ioutil.WriteFile(path, after, fi.Mode().Perm()); err != nil {
+		return before, after, fmt.Errorf("writing %q (backup in %q): %v", path, backup, err)
+	}
+	return before, after, nil
+}
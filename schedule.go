@@ -0,0 +1,165 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mqd // import "jw4.us/mqd"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written in settings files as a
+// human friendly string such as "90s" or "2m". Plain numbers are
+// read as a count of seconds.
+type Duration time.Duration
+
+// String fulfills the fmt.Stringer interface, dropping the zero units
+// that time.Duration leaves on round values (e.g. "2m" not "2m0s").
+func (d Duration) String() string {
+	s := time.Duration(d).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// MarshalJSON fulfills the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON fulfills the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(raw []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("invalid duration %s", raw)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Window describes a recurring span of the day, e.g. business hours
+// or the hours a bulk account may be used. A Window whose End is
+// before its Start wraps past midnight; the day it starts on is the
+// one matched against Days.
+type Window struct {
+	// Days the window applies to, as three letter English names
+	// ("mon", "tue", ...). Empty means every day.
+	Days []string `json:"days,omitempty"`
+	// Start and End are times of day in 24 hour "15:04" form.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Location is the IANA time zone name the window is expressed
+	// in. Empty means the local time zone of the service.
+	Location string `json:"location,omitempty"`
+}
+
+// String fulfills the fmt.Stringer interface
+func (w Window) String() string {
+	s := w.Start + "-" + w.End
+	if len(w.Days) > 0 {
+		s = strings.Join(w.Days, ",") + " " + s
+	}
+	if w.Location != "" {
+		s += " " + w.Location
+	}
+	return s
+}
+
+// Validate checks that the Window fields can be parsed.
+func (w Window) Validate() error {
+	_, _, _, _, err := w.parse()
+	return err
+}
+
+// Contains reports whether t falls inside the Window. Windows that
+// fail to Validate never contain any time.
+func (w Window) Contains(t time.Time) bool {
+	start, end, days, loc, err := w.parse()
+	if err != nil {
+		return false
+	}
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if start <= end {
+		return days[day] && minute >= start && minute < end
+	}
+	// wraps past midnight; the early morning part belongs to the
+	// window that started the day before.
+	if minute >= start {
+		return days[day]
+	}
+	return minute < end && days[(day+6)%7]
+}
+
+func (w Window) parse() (start, end int, days [7]bool, loc *time.Location, err error) {
+	if start, err = minuteOfDay(w.Start); err != nil {
+		return
+	}
+	if end, err = minuteOfDay(w.End); err != nil {
+		return
+	}
+	if start == end {
+		err = fmt.Errorf("window %s is empty", w)
+		return
+	}
+	loc = time.Local
+	if w.Location != "" {
+		if loc, err = time.LoadLocation(w.Location); err != nil {
+			return
+		}
+	}
+	if len(w.Days) == 0 {
+		days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, name := range w.Days {
+		found := false
+		for wd := time.Sunday; wd <= time.Saturday; wd++ {
+			if strings.EqualFold(name, wd.String()[:3]) || strings.EqualFold(name, wd.String()) {
+				days[wd], found = true, true
+			}
+		}
+		if !found {
+			err = fmt.Errorf("window %s: unknown day %q", w, name)
+			return
+		}
+	}
+	return
+}
+
+func minuteOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// InWindows reports whether t falls inside any of the windows.
+func InWindows(windows []Window, t time.Time) bool {
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
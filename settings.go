@@ -5,15 +5,21 @@
 package mqd // import "jw4.us/mqd"
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/mail"
 	gosmtp "net/smtp"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
+	"jw4.us/mqd/dkim"
 	"jw4.us/mqd/smtp"
 )
 
@@ -26,51 +32,253 @@ const (
 	PlainAuth SMTPAuthType = "PLAIN"
 )
 
+// SenderRewrite names a policy for making the From: header of a
+// message match the account of the connection it is sent through.
+type SenderRewrite string
+
+// SenderRewrites
+const (
+	// RewriteNone leaves the From: header as the application wrote
+	// it. This is the default.
+	RewriteNone SenderRewrite = "none"
+	// RewriteFrom replaces the From: header with the account.
+	RewriteFrom SenderRewrite = "from"
+	// RewriteReplyTo keeps the original display name on the account
+	// address and adds a Reply-To: with the original From:, unless
+	// the message already has one.
+	RewriteReplyTo SenderRewrite = "reply-to"
+)
+
+// ConnectionType names the transport a connection delivers mail
+// with.
+type ConnectionType string
+
+// ConnectionTypes
+const (
+	// ConnectionRelay hands mail to the Server of the connection over
+	// SMTP. This is the default.
+	ConnectionRelay ConnectionType = "relay"
+	// ConnectionDirect delivers mail straight to the mail exchangers
+	// of each recipient domain, found with DNS MX lookups.
+	ConnectionDirect ConnectionType = "direct"
+	// ConnectionLMTP hands mail to a local delivery agent over LMTP,
+	// on the unix socket, or host:port, in Path.
+	ConnectionLMTP ConnectionType = "lmtp"
+	// ConnectionSendmail pipes mail to the sendmail compatible
+	// program in Path.
+	ConnectionSendmail ConnectionType = "sendmail"
+	// ConnectionMbox appends mail to the mbox file in Path.
+	ConnectionMbox ConnectionType = "mbox"
+	// ConnectionMaildir stores mail in the Maildir folder in Path.
+	ConnectionMaildir ConnectionType = "maildir"
+	// ConnectionHTTP sends mail through a provider's HTTP API, as
+	// described by the HTTP settings of the connection.
+	ConnectionHTTP ConnectionType = "http"
+)
+
+// TLSPolicy names when a direct connection uses TLS.
+type TLSPolicy string
+
+// TLSPolicies
+const (
+	// TLSOpportunistic uses STARTTLS when the mail exchanger offers
+	// it, without verifying its certificate. This is the default.
+	TLSOpportunistic TLSPolicy = "opportunistic"
+	// TLSRequired defers mail for mail exchangers that don't offer
+	// STARTTLS, or whose certificate doesn't verify.
+	TLSRequired TLSPolicy = "required"
+)
+
+// RecipientPolicy names how recipient headers that can't be parsed
+// are handled.
+type RecipientPolicy string
+
+// RecipientPolicies
+const (
+	// RecipientStrict fails messages with any recipient header that
+	// doesn't parse.
+	RecipientStrict RecipientPolicy = "strict"
+	// RecipientLenient extracts whichever addresses of a bad header
+	// parse on their own, and drops the rest. This is the default.
+	RecipientLenient RecipientPolicy = "lenient"
+	// RecipientRepair fixes common mistakes, such as semicolon
+	// separators and missing angle brackets, before falling back to
+	// RecipientLenient.
+	RecipientRepair RecipientPolicy = "repair"
+)
+
+// Interval limits
+const (
+	DefaultInterval = Duration(30 * time.Second)
+	MinInterval     = Duration(5 * time.Second)
+	MaxInterval     = Duration(time.Hour)
+)
+
 // Settings holds the configuration parameters used by the mail queue
 // dispatcher.
 type Settings struct {
+	Version   int                          `json:"version"`
 	C         map[string]ConnectionDetails `json:"connections"`
 	MailQueue string                       `json:"mailqueue"`
 	BadMail   string                       `json:"badmail"`
 	SentMail  string                       `json:"sentmail"`
-	Interval  int                          `json:"interval"`
+	// Interval between scans of the mailqueue folder, between 5s
+	// and 1h. Defaults to 30s.
+	Interval Duration `json:"interval"`
+	// PickupPreamble reads IIS style pickup files, which start with
+	// x-sender: and x-receiver: lines that are removed before the
+	// message is sent.
+	PickupPreamble bool `json:"pickup_preamble,omitempty"`
+	// QuietHours hold non-urgent mail in the mailqueue while any of
+	// the windows is open. Messages marked urgent with X-Priority,
+	// Priority or Importance headers are always sent.
+	QuietHours []Window `json:"quiet_hours,omitempty"`
+	// DKIM holds signing settings keyed by sender domain, used for
+	// connections that don't have their own.
+	DKIM map[string]DKIMSettings `json:"dkim,omitempty"`
+	// MessageIDDomain is used on the right hand side of Message-ID
+	// headers added to messages that lack one. Defaults to the sender
+	// domain.
+	MessageIDDomain string `json:"message_id_domain,omitempty"`
+	// SenderHeaders lists the headers searched, in order, for the
+	// sender of a message; e.g. ["X-Sender", "Return-Path",
+	// "Resent-From", "From"]. From and Resent-From fall back to Sender
+	// and Resent-Sender when they hold several mailboxes. Defaults to
+	// X-Sender, Resent-From, From.
+	SenderHeaders []string `json:"sender_headers,omitempty"`
+	// RecipientPolicy decides what happens to recipient addresses
+	// that don't parse. Dropped addresses are listed in the report of
+	// the message, which is kept with it in the sentmail folder too,
+	// and in the journal. Defaults to lenient.
+	RecipientPolicy RecipientPolicy `json:"recipient_policy,omitempty"`
+	// Submission, if set, runs an SMTP submission server that
+	// accepts mail for the mailqueue.
+	Submission *SubmissionSettings `json:"submission,omitempty"`
+	// API, if set, runs an HTTP API for submitting messages and
+	// following them through the queue.
+	API *APISettings `json:"api,omitempty"`
+	// Metrics, if set, serves Prometheus metrics over HTTP.
+	Metrics *MetricsSettings `json:"metrics,omitempty"`
+	// Log describes the format, level and destination of the service
+	// log. Defaults to text at info level, in a rotated file next to
+	// the program.
+	Log *LogSettings `json:"log,omitempty"`
+	// Journal, if set, keeps a record of every attempt to deliver a
+	// message and its outcome.
+	Journal *JournalSettings `json:"journal,omitempty"`
+	// Retention, if set, limits how long and how much sent mail is
+	// kept in the sentmail folder.
+	Retention *RetentionSettings `json:"retention,omitempty"`
+	// Duplicates, if set, keeps messages that were already sent from
+	// being sent again.
+	Duplicates *DuplicateSettings `json:"duplicates,omitempty"`
+	// Retry limits how often and how long deferred messages are
+	// tried again before they are bounced. Without it they are
+	// bounced after 120h.
+	Retry *RetrySettings `json:"retry,omitempty"`
+	// DomainLimits rate limit the mail sent to each recipient domain,
+	// whichever connection it goes through.
+	DomainLimits map[string]RateLimit `json:"domain_limits,omitempty"`
+	// RateLimitState is the file, relative to the settings file, that
+	// keeps the state of the rate limits across restarts. Defaults to
+	// ratelimit.json.
+	RateLimitState string `json:"rate_limit_state,omitempty"`
+	// Include lists files, folders or glob patterns that hold
+	// additional connections, e.g. "conf.d". Relative entries are
+	// resolved against the folder of the main settings file.
+	Include []string `json:"include,omitempty"`
+	// Format is the encoding the settings were read from, and the
+	// one they will be written back in.
+	Format Format `json:"-"`
+
+	// sources maps connection keys loaded from included files to
+	// the file they came from.
+	sources map[string]string
+	// migratedFrom is the schema version of the source document.
+	migratedFrom int
+	// dir is the folder the settings file was read from.
+	dir string
 }
 
 // NewSettings generates a new Settings configuration, initializing it
 // with the supplied mailqueue and badmail folders, and an empty map
 // of connection details.
 func NewSettings(mailqueue string, badmail string) *Settings {
-	return &Settings{C: map[string]ConnectionDetails{}, MailQueue: mailqueue, BadMail: badmail, Interval: 30}
+	return &Settings{
+		Version: SettingsVersion, C: map[string]ConnectionDetails{},
+		MailQueue: mailqueue, BadMail: badmail, Interval: DefaultInterval,
+		migratedFrom: SettingsVersion}
+}
+
+// MigratedFrom returns the schema version the Settings were read
+// from. If it is lower than SettingsVersion the source file uses an
+// older layout that was upgraded in memory.
+func (s *Settings) MigratedFrom() int {
+	return s.migratedFrom
 }
 
 // String fulfills the fmt.Stringer interface
 func (s *Settings) String() string {
+	details := []string{}
+	for key, d := range s.C {
+		details = append(details, fmt.Sprintf("%s:{%s}", key, &d))
+	}
+	sort.Strings(details)
 	return fmt.Sprintf(
-		"mailqueue: %s, badmail: %s, interval: %d seconds, details: %s",
-		s.MailQueue, s.BadMail, s.Interval, s.C)
+		"mailqueue: %s, badmail: %s, interval: %s, details: map[%s]",
+		s.MailQueue, s.BadMail, s.Interval, strings.Join(details, " "))
 }
 
 // ConnectionForSender uses the supplied sender and tries to find
 // ConnectionDetails that match the email address.
 func (s *Settings) ConnectionForSender(sender string) (ConnectionDetails, error) {
+	_, details, err := s.ConnectionKeyForSender(sender)
+	return details, err
+}
+
+// ConnectionKeyForSender works like ConnectionForSender, and also
+// returns the key the connection is configured under.
+func (s *Settings) ConnectionKeyForSender(sender string) (string, ConnectionDetails, error) {
 	if details, ok := s.C[sender]; ok {
-		return details, nil
+		return sender, details, nil
 	}
 	addr, err := mail.ParseAddress(sender)
 	if err != nil {
-		return ConnectionDetails{}, err
+		return "", ConnectionDetails{}, err
+	}
+	for _, key := range []string{addr.Address, strings.ToLower(addr.Address)} {
+		if details, ok := s.C[key]; ok {
+			return key, details, nil
+		}
+	}
+	return "", ConnectionDetails{}, fmt.Errorf("connection details not found for %q", sender)
+}
+
+// Path resolves a file name from the settings, e.g. a key file,
+// relative to the folder the settings file was read from.
+func (s *Settings) Path(name string) string {
+	if name == "" || filepath.IsAbs(name) || s.dir == "" {
+		return name
 	}
-	if details, ok := s.C[addr.Address]; ok {
-		return details, nil
+	return filepath.Join(s.dir, name)
+}
+
+// DKIMFor returns the DKIM signing settings to use for mail sent
+// through connection with a From address in domain, or nil if the
+// message should not be signed. Settings on the connection take
+// precedence over the ones for the domain.
+func (s *Settings) DKIMFor(connection ConnectionDetails, domain string) *DKIMSettings {
+	if connection.DKIM != nil {
+		return connection.DKIM
 	}
-	if details, ok := s.C[strings.ToLower(addr.Address)]; ok {
-		return details, nil
+	if d, ok := s.DKIM[strings.ToLower(domain)]; ok {
+		return &d
 	}
-	return ConnectionDetails{}, fmt.Errorf("connection details not found for %q", sender)
+	return nil
 }
 
-// ReadSettingsFrom uses an io.Reader to read in JSON that is parsed
-// into a Settings configuration object.
+// ReadSettingsFrom uses an io.Reader to read in JSON, YAML or TOML
+// that is parsed into a Settings configuration object.
 func ReadSettingsFrom(r io.Reader) (*Settings, error) {
 	raw, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -79,25 +287,106 @@ func ReadSettingsFrom(r io.Reader) (*Settings, error) {
 	return UnmarshalSettings(raw)
 }
 
-// UnmarshalSettings converts raw bytes that are expected to be in JSON
-// format into the Settings configuration object.
+// UnmarshalSettings converts raw bytes in JSON, YAML or TOML format
+// into the Settings configuration object. The format is detected by
+// sniffing the content.
 func UnmarshalSettings(raw []byte) (*Settings, error) {
-	s := &Settings{}
-	err := unmarshalSettings(raw, s)
-	if err != nil {
-		return s, err
-	}
+	return UnmarshalSettingsFormat(raw, SniffFormat(raw))
+}
 
-	if s.Interval < 5 || s.Interval > 3600 {
-		s.Interval = 30
+func (s *Settings) validate() error {
+	if s.Interval == 0 {
+		s.Interval = DefaultInterval
+	}
+	if s.Interval < MinInterval || s.Interval > MaxInterval {
+		return fmt.Errorf("interval %s is outside the range %s to %s", s.Interval, MinInterval, MaxInterval)
+	}
+	switch s.RecipientPolicy {
+	case "", RecipientStrict, RecipientLenient, RecipientRepair:
+	default:
+		return fmt.Errorf("unknown recipient_policy %q", string(s.RecipientPolicy))
 	}
-	return s, nil
+	if s.Submission != nil {
+		if err := s.Submission.validate(); err != nil {
+			return fmt.Errorf("submission: %v", err)
+		}
+	}
+	if s.API != nil {
+		if err := s.API.validate(); err != nil {
+			return fmt.Errorf("api: %v", err)
+		}
+	}
+	if s.Metrics != nil {
+		if s.Metrics.Listen == "" {
+			return fmt.Errorf("metrics: listen is required")
+		}
+		if s.Metrics.ProbeInterval < 0 {
+			return fmt.Errorf("metrics: probe_interval must not be negative")
+		}
+	}
+	if s.Log != nil {
+		if err := s.Log.validate(); err != nil {
+			return fmt.Errorf("log: %v", err)
+		}
+	}
+	if s.Retention != nil {
+		if s.SentMail == "" {
+			return fmt.Errorf("retention: needs a sentmail folder")
+		}
+		if err := s.Retention.validate(); err != nil {
+			return fmt.Errorf("retention: %v", err)
+		}
+	}
+	if s.Duplicates != nil {
+		if s.Duplicates.Folder == "" {
+			return fmt.Errorf("duplicates: folder is required")
+		}
+		if s.Duplicates.Window < 0 {
+			return fmt.Errorf("duplicates: window must not be negative")
+		}
+	}
+	if s.Retry != nil && (s.Retry.MaxAttempts < 0 || s.Retry.MaxAge < 0) {
+		return fmt.Errorf("retry: max_attempts and max_age must not be negative")
+	}
+	if s.Journal != nil {
+		if s.Journal.Path == "" {
+			return fmt.Errorf("journal: path is required")
+		}
+		if s.Journal.MaxSize < 0 || s.Journal.MaxFiles < 0 {
+			return fmt.Errorf("journal: max_size and max_files must not be negative")
+		}
+	}
+	for domain, l := range s.DomainLimits {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("domain_limits %q: %v", domain, err)
+		}
+		if l.MaxRecipients != 0 {
+			return fmt.Errorf("domain_limits %q: max_recipients only applies to connections", domain)
+		}
+	}
+	for _, w := range s.QuietHours {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("quiet_hours: %v", err)
+		}
+	}
+	for domain, d := range s.DKIM {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("dkim %q: %v", domain, err)
+		}
+	}
+	for key, details := range s.C {
+		if err := details.validate(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// WriteSettingsTo marshals the Settings config struct and sends it to
-// the io.Writer, returning any errors encountered along the way.
+// WriteSettingsTo marshals the Settings config struct in its source
+// Format and sends it to the io.Writer, returning any errors
+// encountered along the way.
 func WriteSettingsTo(w io.Writer, s *Settings) error {
-	bytes, err := json.MarshalIndent(s, "", "  ")
+	bytes, err := MarshalSettings(s)
 	if err != nil {
 		return err
 	}
@@ -111,8 +400,15 @@ func WriteSettingsTo(w io.Writer, s *Settings) error {
 }
 
 // WriteSettings is a helper function to open a file and send it to the
-// WriteSettingsTo function.
+// WriteSettingsTo function. Settings without a Format are written in
+// the format implied by the file extension, or JSON.
 func WriteSettings(path string, s *Settings) error {
+	if s.Format == "" {
+		out := *s
+		out.Format = FormatForPath(path)
+		s = &out
+	}
+
 	fi, err := os.Create(path)
 	if err != nil {
 		return err
@@ -140,14 +436,457 @@ type ConnectionDetails struct {
 	Username string `json:"username,omitempty"`
 	// Password of the Sender account.
 	Password string `json:"password,omitempty"`
+	// SendWindows, if set, restrict this connection to relaying mail
+	// only while one of the windows is open. Mail for it is held in
+	// the mailqueue at other times.
+	SendWindows []Window `json:"send_windows,omitempty"`
+	// DKIM, if set, signs mail sent through this connection,
+	// overriding any settings for the sender domain.
+	DKIM *DKIMSettings `json:"dkim,omitempty"`
+	// RewriteFrom decides how a From: header that differs from the
+	// Sender account is handled. The envelope sender is the Sender
+	// account, unless the message's envelope gives one.
+	RewriteFrom SenderRewrite `json:"rewrite_from,omitempty"`
+	// Type names the transport used: relay, the default, direct,
+	// lmtp, sendmail, mbox or maildir. Only relay connections use
+	// Server and the authentication settings. Direct and lmtp
+	// connections give Host as their name when greeting servers.
+	Type ConnectionType `json:"type,omitempty"`
+	// Path is the socket, program, file or folder of lmtp, sendmail,
+	// mbox and maildir connections, relative to the settings file.
+	Path string `json:"path,omitempty"`
+	// Args replace the arguments given to a sendmail program, which
+	// default to "-i -f <sender> --" followed by the recipients. The
+	// recipients are not added when Args include "-t".
+	Args []string `json:"args,omitempty"`
+	// TLS is the TLSPolicy of a direct connection.
+	TLS TLSPolicy `json:"tls,omitempty"`
+	// HTTP describes the API called by http connections. Username and
+	// Password, if set, are sent with basic authentication.
+	HTTP *HTTPSettings `json:"http,omitempty"`
+	// RateLimit, if set, limits the mail sent through this
+	// connection. Mail over the limit is held in the mailqueue.
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+// validate checks the connection with the given key, which is named in
+// the errors returned.
+func (c ConnectionDetails) validate(key string) error {
+	for _, w := range c.SendWindows {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("connection %q send_windows: %v", key, err)
+		}
+	}
+	switch c.RewriteFrom {
+	case "", RewriteNone, RewriteFrom, RewriteReplyTo:
+	default:
+		return fmt.Errorf("connection %q: unknown rewrite_from %q", key, string(c.RewriteFrom))
+	}
+	switch c.Type {
+	case "", ConnectionRelay, ConnectionDirect:
+	case ConnectionLMTP, ConnectionSendmail, ConnectionMbox, ConnectionMaildir:
+		if c.Path == "" {
+			return fmt.Errorf("connection %q: %s connections need a path", key, string(c.Type))
+		}
+	case ConnectionHTTP:
+		if err := c.HTTP.validate(); err != nil {
+			return fmt.Errorf("connection %q: %v", key, err)
+		}
+	default:
+		return fmt.Errorf("connection %q: unknown type %q", key, string(c.Type))
+	}
+	switch c.TLS {
+	case "", TLSOpportunistic, TLSRequired:
+	default:
+		return fmt.Errorf("connection %q: unknown tls policy %q", key, string(c.TLS))
+	}
+	if c.DKIM != nil {
+		if err := c.DKIM.validate(); err != nil {
+			return fmt.Errorf("connection %q dkim: %v", key, err)
+		}
+	}
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validate(); err != nil {
+			return fmt.Errorf("connection %q rate_limit: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// RateLimit limits how many messages are sent in each second, minute,
+// hour and day. Zero values don't limit anything. Limits are token
+// buckets: they allow bursts of up to the limit, and then a steady
+// rate of it.
+type RateLimit struct {
+	PerSecond int `json:"per_second,omitempty"`
+	PerMinute int `json:"per_minute,omitempty"`
+	PerHour   int `json:"per_hour,omitempty"`
+	PerDay    int `json:"per_day,omitempty"`
+	// MaxRecipients splits messages to more recipients into several,
+	// each of which counts against the limits. It only applies to
+	// connections.
+	MaxRecipients int `json:"max_recipients,omitempty"`
+}
+
+// DefaultRateLimitState is the default Settings.RateLimitState.
+const DefaultRateLimitState = "ratelimit.json"
+
+// RateLimitStatePath returns the path of the file that keeps the state
+// of the rate limits.
+func (s *Settings) RateLimitStatePath() string {
+	if s.RateLimitState != "" {
+		return s.Path(s.RateLimitState)
+	}
+	return s.Path(DefaultRateLimitState)
+}
+
+func (r *RateLimit) validate() error {
+	if r.PerSecond < 0 || r.PerMinute < 0 || r.PerHour < 0 || r.PerDay < 0 || r.MaxRecipients < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// HTTPSettings describe how an http connection calls a provider's
+// API. Responses with a 2xx status are delivered; 408, 429 and 5xx
+// statuses, and failures to get a response at all, defer the message;
+// other statuses fail it.
+type HTTPSettings struct {
+	// URL the message is sent to.
+	URL string `json:"url"`
+	// Method defaults to POST.
+	Method string `json:"method,omitempty"`
+	// Headers are added to the request, e.g. an Authorization header
+	// with an API key.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Template is the path, relative to the settings file, of a
+	// text/template producing the request body. Without one the raw
+	// message is sent as message/rfc822. The template is executed
+	// with .Sender, .Recipients, .Message and .Base64 (the message,
+	// base64 encoded), and a json function that quotes values, e.g.
+	//
+	//     {"from": {{json .Sender}}, "to": {{json .Recipients}},
+	//      "raw": {{json .Base64}}}
+	Template string `json:"template,omitempty"`
+	// Temporary and Permanent are regular expressions matched against
+	// the response body, for APIs that report errors with a 2xx
+	// status. A match overrides the outcome of the status.
+	Temporary string `json:"temporary,omitempty"`
+	Permanent string `json:"permanent,omitempty"`
+	// Timeout of each request. Defaults to 30s.
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (h *HTTPSettings) validate() error {
+	if h == nil || h.URL == "" {
+		return fmt.Errorf("http connections need an http url")
+	}
+	for _, expr := range []string{h.Temporary, h.Permanent} {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("http: %v", err)
+		}
+	}
+	return nil
+}
+
+// SubmissionSettings describe the built in SMTP submission server,
+// which writes the messages it accepts into the mailqueue.
+type SubmissionSettings struct {
+	// Listen is the address to listen on, e.g. ":587".
+	Listen string `json:"listen"`
+	// Hostname is given in the greeting and Received: headers.
+	// Defaults to the name of the computer.
+	Hostname string `json:"hostname,omitempty"`
+	// Users maps the usernames clients authenticate with to their
+	// passwords. When empty no authentication is required.
+	Users map[string]string `json:"users,omitempty"`
+	// Certificate and Key are the paths of the PEM encoded certificate
+	// chain and private key used for STARTTLS, relative to the
+	// settings file. When they are set clients must use STARTTLS
+	// before they can authenticate.
+	Certificate string `json:"certificate,omitempty"`
+	Key         string `json:"key,omitempty"`
+	// MaxSize is the largest message accepted, in bytes. Defaults to
+	// 25MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// AllowedNetworks lists the addresses, or CIDR networks, that may
+	// connect, e.g. ["127.0.0.1", "10.0.0.0/8"]. Defaults to any when
+	// Users are set, and to the loopback addresses when they aren't,
+	// so that the server is never an open relay.
+	AllowedNetworks []string `json:"allowed_networks,omitempty"`
+}
+
+// DefaultMaxSize is the default SubmissionSettings.MaxSize and
+// APISettings.MaxSize.
+const DefaultMaxSize = 25 << 20
+
+// loopbackNetworks are the AllowedNetworks of a submission server
+// without Users.
+var loopbackNetworks = []string{"127.0.0.0/8", "::1"}
+
+// Networks parses AllowedNetworks, or returns their default.
+func (s *SubmissionSettings) Networks() ([]*net.IPNet, error) {
+	entries := s.AllowedNetworks
+	if len(entries) == 0 && len(s.Users) == 0 {
+		entries = loopbackNetworks
+	}
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (s *SubmissionSettings) validate() error {
+	if s.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if (s.Certificate == "") != (s.Key == "") {
+		return fmt.Errorf("certificate and key must be given together")
+	}
+	if s.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative")
+	}
+	_, err := s.Networks()
+	return err
+}
+
+// APISettings describe the built in HTTP API.
+type APISettings struct {
+	// Listen is the address to listen on, e.g. "127.0.0.1:8025".
+	Listen string `json:"listen"`
+	// Tokens lists the bearer tokens clients authenticate with.
+	Tokens []string `json:"tokens"`
+	// Certificate and Key are the paths of the PEM encoded certificate
+	// chain and private key to serve HTTPS with, relative to the
+	// settings file. Plain HTTP is served without them.
+	Certificate string `json:"certificate,omitempty"`
+	Key         string `json:"key,omitempty"`
+	// MaxSize is the largest request body accepted, in bytes.
+	// Defaults to 25MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+func (s *APISettings) validate() error {
+	if s.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if len(s.Tokens) == 0 {
+		return fmt.Errorf("at least one token is required")
+	}
+	for _, token := range s.Tokens {
+		if token == "" {
+			return fmt.Errorf("tokens must not be empty")
+		}
+	}
+	if (s.Certificate == "") != (s.Key == "") {
+		return fmt.Errorf("certificate and key must be given together")
+	}
+	if s.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative")
+	}
+	return nil
+}
+
+// MetricsSettings describe the Prometheus metrics listener, which also
+// serves the /healthz and /readyz health checks.
+type MetricsSettings struct {
+	// Listen is the address to listen on, e.g. ":9125".
+	Listen string `json:"listen"`
+	// Path metrics are served at. Defaults to /metrics.
+	Path string `json:"path,omitempty"`
+	// Probe makes /readyz connect to each connection, to check that it
+	// would be able to deliver.
+	Probe bool `json:"probe,omitempty"`
+	// ProbeInterval is how long probe results are reused. Defaults
+	// to 5m.
+	ProbeInterval Duration `json:"probe_interval,omitempty"`
+}
+
+// DefaultProbeInterval is the default MetricsSettings.ProbeInterval.
+const DefaultProbeInterval = Duration(5 * time.Minute)
+
+// LogFormat names the encodings of log records
+type LogFormat string
+
+// LogFormats
+const (
+	LogText LogFormat = "text"
+	LogJSON LogFormat = "json"
+)
+
+// LogStderr is the LogSettings.Output that writes to standard error.
+const LogStderr = "stderr"
+
+// LogSettings describe the service log.
+type LogSettings struct {
+	// Format is text (the default) or json.
+	Format LogFormat `json:"format,omitempty"`
+	// Level is the least severe level logged: debug, info (the
+	// default), warn or error.
+	Level string `json:"level,omitempty"`
+	// Output is stderr, or the path of a log file relative to the
+	// settings file. Files are rotated when they reach MaxSize.
+	Output string `json:"output,omitempty"`
+	// MaxSize is the size in bytes at which the log file is rotated.
+	// Defaults to 10MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// MaxFiles is the number of rotated files kept. Defaults to 5.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// Default LogSettings limits.
+const (
+	DefaultLogMaxSize  = 10 << 20
+	DefaultLogMaxFiles = 5
+)
+
+// JournalSettings describe the delivery journal, which is appended
+// to and never rewritten.
+type JournalSettings struct {
+	// Path of the journal file, relative to the settings file.
+	Path string `json:"path"`
+	// MaxSize is the size in bytes at which the journal is rotated.
+	// Defaults to 100MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// MaxFiles is the number of rotated files kept. Defaults to 10.
+	MaxFiles int `json:"max_files,omitempty"`
+}
+
+// Default JournalSettings limits.
+const (
+	DefaultJournalMaxSize  = 100 << 20
+	DefaultJournalMaxFiles = 10
+)
+
+// DuplicateSettings describe how messages that were sent before are
+// recognized and set aside. A message is a duplicate of another with
+// the same Message-ID, or content if it has none, and the same
+// envelope recipients, that was sent within the Window.
+type DuplicateSettings struct {
+	// Folder duplicates are moved to, with a report naming the
+	// original. The keys of sent messages are kept there too.
+	Folder string `json:"folder"`
+	// Window is how long sent messages are remembered. Defaults
+	// to 24h.
+	Window Duration `json:"window,omitempty"`
+}
+
+// RetrySettings describe when deferred messages are given up on: once
+// they were tried MaxAttempts times, or were queued longer than MaxAge
+// ago. The recipients still deferred are then bounced to the badmail
+// folder.
+type RetrySettings struct {
+	// MaxAttempts is unlimited when zero.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// MaxAge defaults to 120h.
+	MaxAge Duration `json:"max_age,omitempty"`
+}
+
+// RetentionSettings describe what is kept of the sentmail folder.
+// Sent messages are removed once they are older than MaxAge, and the
+// oldest are removed while they take more than MaxSize bytes. They are
+// pruned in the background, every Interval.
+type RetentionSettings struct {
+	MaxAge  Duration `json:"max_age,omitempty"`
+	MaxSize int64    `json:"max_size,omitempty"`
+	// Compress is gzip or zstd, to compress messages that are
+	// CompressAfter old.
+	Compress      string   `json:"compress,omitempty"`
+	CompressAfter Duration `json:"compress_after,omitempty"`
+	// Interval between prunes. Defaults to 1h.
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// DefaultPruneInterval is the default RetentionSettings.Interval.
+const DefaultPruneInterval = Duration(time.Hour)
+
+func (s *RetentionSettings) validate() error {
+	switch s.Compress {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("unknown compression %q", s.Compress)
+	}
+	if s.MaxAge < 0 || s.MaxSize < 0 || s.CompressAfter < 0 || s.Interval < 0 {
+		return fmt.Errorf("max_age, max_size, compress_after and interval must not be negative")
+	}
+	return nil
+}
+
+func (s *LogSettings) validate() error {
+	switch s.Format {
+	case "", LogText, LogJSON:
+	default:
+		return fmt.Errorf("unknown format %q", s.Format)
+	}
+	if s.Level != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(s.Level)); err != nil {
+			return fmt.Errorf("unknown level %q", s.Level)
+		}
+	}
+	if s.MaxSize < 0 || s.MaxFiles < 0 {
+		return fmt.Errorf("max_size and max_files must not be negative")
+	}
+	return nil
+}
+
+// DKIMSettings describe how outgoing messages are DKIM signed. The
+// algorithm (rsa-sha256 or ed25519-sha256) follows the key type.
+type DKIMSettings struct {
+	// Domain is the signing domain (d=). Defaults to the domain of
+	// the From address.
+	Domain string `json:"domain,omitempty"`
+	// Selector names the public key record under the domain.
+	Selector string `json:"selector"`
+	// PrivateKey is the path of a PEM encoded RSA or Ed25519 key,
+	// relative to the settings file.
+	PrivateKey string `json:"private_key"`
+	// Headers to sign; defaults to a list of the common ones.
+	Headers []string `json:"headers,omitempty"`
+	// Canonicalization in "header/body" form, e.g. "relaxed/simple"
+	// (the default).
+	Canonicalization string `json:"canonicalization,omitempty"`
+}
+
+func (d *DKIMSettings) validate() error {
+	if d.Selector == "" || d.PrivateKey == "" {
+		return fmt.Errorf("selector and private_key are required")
+	}
+	if d.Canonicalization != "" {
+		if _, _, err := dkim.ParseCanonicalization(d.Canonicalization); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Auth returns an implementation of the smtp.Auth interface that can
-// be used to perform the smtp authentication for this ConnectionDetails
+// be used to perform the smtp authentication for this ConnectionDetails.
+// Only relay connections authenticate; the others have a nil Auth.
 func (d *ConnectionDetails) Auth() (gosmtp.Auth, error) {
 	if d == nil {
 		return nil, fmt.Errorf("invalid connection info; nil")
 	}
+	if d.Type != "" && d.Type != ConnectionRelay {
+		return nil, nil
+	}
 
 	switch d.AuthType {
 	case LoginAuth:
@@ -165,7 +904,3 @@ func (d *ConnectionDetails) String() string {
 		"sender: %s, authtype: %s, server: %s, host: %s, username: %s, password: ******",
 		d.Sender, d.AuthType, d.Server, d.Host, d.Username)
 }
-
-func unmarshalSettings(data []byte, s *Settings) error {
-	return json.Unmarshal(data, s)
-}
@@ -0,0 +1,343 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package mqd
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestMigrationGolden upgrades every settings file in testdata/settings
+// and compares the result with the matching .golden file.
+func TestMigrationGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "settings", "v*.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if filepath.Ext(file) == ".golden" {
+			continue
+		}
+		t.Logf("File %s", file)
+		_, after, err := MigrateSettingsFile(file, false)
+		if err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+		golden := file + ".golden"
+		if *update {
+			if err = ioutil.WriteFile(golden, after, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("missing golden file, run with -update: %v", err)
+		}
+		if !bytes.Equal(after, expected) {
+			t.Errorf("migrated settings differ from %s:\n%s", golden, after)
+		}
+
+		s, err := UnmarshalSettings(after)
+		if err != nil {
+			t.Fatalf("re-read: %v", err)
+		}
+		if s.Version != SettingsVersion || s.MigratedFrom() != SettingsVersion {
+			t.Errorf("expected version %d, got %d (from %d)", SettingsVersion, s.Version, s.MigratedFrom())
+		}
+	}
+}
+
+func TestMigrateRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings_test")
+	if err != nil {
+		t.Fatalf("error creating temp folder: %q", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	original, err := ioutil.ReadFile(filepath.Join("testdata", "settings", "v0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, ".smtp-dispatcher.settings")
+	writeFile(t, path, string(original))
+
+	before, after, err := MigrateSettingsFile(path, true)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if !bytes.Equal(before, original) {
+		t.Errorf("before content does not match original file")
+	}
+	if backup, err := ioutil.ReadFile(path + ".v0.bak"); err != nil || !bytes.Equal(backup, original) {
+		t.Errorf("backup missing or different: %v", err)
+	}
+	if current, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(current, after) {
+		t.Errorf("settings file not rewritten: %v", err)
+	}
+
+	// current files keep their comments and formatting
+	current := "# current settings\nversion: 2\ninterval: 45s\nmailqueue:   mq\nbadmail: bm\n"
+	path = filepath.Join(dir, "current.yaml")
+	writeFile(t, path, current)
+	if before, after, err = MigrateSettingsFile(path, true); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("expected no changes to a current file, got %q (%v)", after, err)
+	}
+	if raw, err := ioutil.ReadFile(path); err != nil || string(raw) != current {
+		t.Errorf("current file rewritten: %q (%v)", raw, err)
+	}
+	if _, err = os.Stat(path + ".v2.bak"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup of a current file, got %v", err)
+	}
+
+	if _, err = UnmarshalSettings([]byte(`{"version": 99}`)); err == nil {
+		t.Errorf("expected error for unsupported version")
+	}
+
+	// unversioned files may already use the documented duration syntax
+	for _, raw := range []string{`{"interval": "90s", "mailqueue": "mq", "badmail": "bm"}`, "interval: 90s\nmailqueue: mq\nbadmail: bm\n"} {
+		if s, err := UnmarshalSettings([]byte(raw)); err != nil || s.Interval != Duration(90*time.Second) {
+			t.Errorf("expected an interval of 90s from %q, got %+v (%v)", raw, s, err)
+		}
+	}
+	if _, err = UnmarshalSettings([]byte(`{"interval": "soon"}`)); err == nil {
+		t.Errorf("expected error for an invalid interval")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		raw      string
+		duration time.Duration
+		str      string
+	}{
+		{raw: `"90s"`, duration: 90 * time.Second, str: "1m30s"},
+		{raw: `"2m"`, duration: 2 * time.Minute, str: "2m"},
+		{raw: `"1h"`, duration: time.Hour, str: "1h"},
+		{raw: `"1h30m"`, duration: 90 * time.Minute, str: "1h30m"},
+		{raw: `45`, duration: 45 * time.Second, str: "45s"},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		var d Duration
+		if err := d.UnmarshalJSON([]byte(test.raw)); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if time.Duration(d) != test.duration || d.String() != test.str {
+			t.Errorf("expected %s (%s), got %s", test.duration, test.str, d)
+		}
+	}
+
+	if _, err := UnmarshalSettings([]byte(`{"version": 2, "interval": "2h"}`)); err == nil {
+		t.Errorf("expected out of range interval error")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	// Monday
+	day := time.Date(2017, time.March, 6, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		window   Window
+		at       time.Duration
+		contains bool
+	}{
+		{window: Window{Start: "09:00", End: "17:00"}, at: 9 * time.Hour, contains: true},
+		{window: Window{Start: "09:00", End: "17:00"}, at: 17 * time.Hour, contains: false},
+		{window: Window{Days: []string{"tue"}, Start: "09:00", End: "17:00"}, at: 12 * time.Hour, contains: false},
+		{window: Window{Days: []string{"Monday"}, Start: "09:00", End: "17:00"}, at: 12 * time.Hour, contains: true},
+		{window: Window{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at: 23 * time.Hour, contains: true},
+		{window: Window{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at: 29 * time.Hour, contains: true},
+		{window: Window{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, at: 5 * time.Hour, contains: false},
+		{window: Window{Start: "01:00", End: "24:00", Location: "UTC"}, at: 23*time.Hour + 59*time.Minute, contains: true},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if err := test.window.Validate(); err != nil {
+			t.Fatalf("validate %s: %v", test.window, err)
+		}
+		if contains := test.window.Contains(day.Add(test.at)); contains != test.contains {
+			t.Errorf("%s contains %s: expected %t", test.window, day.Add(test.at), test.contains)
+		}
+	}
+
+	for _, w := range []Window{{Start: "9", End: "17:00"}, {Start: "09:00", End: "09:00"}, {Days: []string{"xyz"}, Start: "01:00", End: "02:00"}} {
+		if err := w.Validate(); err == nil {
+			t.Errorf("expected %s to be invalid", w)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		raw    string
+		format Format
+	}{
+		{raw: "", format: JSON},
+		{raw: "  {\"interval\": 30}", format: JSON},
+		{raw: "# comment\ninterval: 30\n", format: YAML},
+		{raw: "---\nmailqueue: \"c:\\\\mq\"\n", format: YAML},
+		{raw: "interval = 30\n", format: TOML},
+		{raw: "# comment\n\n[connections.\"a@b.c\"]\nsender = \"a@b.c\"\n", format: TOML},
+		{raw: "mailqueue = \"c:\\\\mq\"\n", format: TOML},
+	}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if format := SniffFormat([]byte(test.raw)); format != test.format {
+			t.Errorf("expected %q, got %q", test.format, format)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	docs := map[Format]string{
+		JSON: `{"interval": 45, "mailqueue": "mq", "badmail": "bm",
+  "connections": {"foo@bar.com": {"sender": "foo@bar.com", "server": "localhost:587",
+  "host": "localhost", "authtype": "PLAIN", "username": "asdf", "password": "qwer"}}}`,
+		YAML: `interval: 45
+mailqueue: mq
+badmail: bm
+connections:
+  foo@bar.com:
+    sender: foo@bar.com
+    server: localhost:587
+    host: localhost
+    authtype: PLAIN
+    username: asdf
+    password: qwer
+`,
+		TOML: `interval = 45
+mailqueue = "mq"
+badmail = "bm"
+
+[connections."foo@bar.com"]
+sender = "foo@bar.com"
+server = "localhost:587"
+host = "localhost"
+authtype = "PLAIN"
+username = "asdf"
+password = "qwer"
+`,
+	}
+
+	for format, doc := range docs {
+		t.Logf("Format %s", format)
+		s, err := UnmarshalSettings([]byte(doc))
+		if err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if s.Format != format {
+			t.Errorf("expected format %q, got %q", format, s.Format)
+		}
+		checkSettings(t, s)
+
+		buf := &bytes.Buffer{}
+		if err = WriteSettingsTo(buf, s); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if sniffed := SniffFormat(buf.Bytes()); sniffed != format {
+			t.Errorf("written in %q, expected %q:\n%s", sniffed, format, buf.String())
+		}
+		again, err := UnmarshalSettingsFormat(buf.Bytes(), format)
+		if err != nil {
+			t.Fatalf("re-read: %v\n%s", err, buf.String())
+		}
+		checkSettings(t, again)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings_test")
+	if err != nil {
+		t.Fatalf("error creating temp folder: %q", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	main := filepath.Join(dir, "main.yaml")
+	writeFile(t, main, "interval: 45\nmailqueue: mq\nbadmail: bm\ninclude: [conf.d]\n"+
+		"connections:\n  foo@bar.com: {sender: foo@bar.com, server: 'localhost:587', host: localhost, authtype: PLAIN}\n")
+	writeFile(t, filepath.Join(dir, "conf.d", "a.json"), `{"connections": {"a@team.com": {"sender": "a@team.com", "authtype": "LOGIN"}}}`)
+	writeFile(t, filepath.Join(dir, "conf.d", "b.toml"), "[connections.\"b@team.com\"]\nsender = \"b@team.com\"\nauthtype = \"LOGIN\"\n")
+	writeFile(t, filepath.Join(dir, "conf.d", "README"), "not a settings file")
+
+	s, err := ReadSettings(main)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	checkSettings(t, s)
+	for _, key := range []string{"a@team.com", "b@team.com"} {
+		if _, ok := s.C[key]; !ok {
+			t.Errorf("included connection %q missing", key)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err = WriteSettingsTo(buf, s); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if strings.Contains(buf.String(), "team.com") {
+		t.Errorf("included connections written to main file:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "conf.d") {
+		t.Errorf("include directive lost:\n%s", buf.String())
+	}
+
+	writeFile(t, filepath.Join(dir, "conf.d", "c.yaml"), "connections:\n  a@team.com: {sender: a@team.com}\n")
+	if _, err = ReadSettings(main); err == nil || !strings.Contains(err.Error(), "duplicate connection") {
+		t.Errorf("expected duplicate connection error, got %v", err)
+	}
+
+	writeFile(t, filepath.Join(dir, "conf.d", "c.yaml"), "interval: 60\n")
+	if _, err = ReadSettings(main); err == nil || !strings.Contains(err.Error(), "only connections") {
+		t.Errorf("expected only connections error, got %v", err)
+	}
+
+	// included connections are validated like the main file's
+	for ix, test := range []struct{ connection, expected string }{
+		{"{type: http}", "http connections need an http url"},
+		{"{send_windows: [{start: '25:00', end: '05:00'}]}", "send_windows"},
+		{"{type: sendmail}", "need a path"},
+		{"{tls: sometimes}", "unknown tls policy"},
+		{"{rate_limit: {per_minute: -1}}", "rate_limit"},
+	} {
+		t.Logf("Test %d", ix)
+		writeFile(t, filepath.Join(dir, "conf.d", "c.yaml"), "connections:\n  c@team.com: "+test.connection+"\n")
+		_, err = ReadSettings(main)
+		if err == nil || !strings.Contains(err.Error(), "c.yaml") || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected %q error, got %v", test.expected, err)
+		}
+	}
+}
+
+func checkSettings(t *testing.T, s *Settings) {
+	if s.Interval != Duration(45*time.Second) || s.MailQueue != "mq" || s.BadMail != "bm" {
+		t.Errorf("unexpected globals: %s", s)
+	}
+	d, err := s.ConnectionForSender("foo@bar.com")
+	if err != nil {
+		t.Fatalf("connection: %v", err)
+	}
+	if d.Server != "localhost:587" || d.AuthType != PlainAuth {
+		t.Errorf("unexpected connection: %s", &d)
+	}
+}
+
+func writeFile(t *testing.T, path string, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("problem creating folder: %q", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("problem writing file: %q", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package smtp // import "jw4.us/mqd/smtp"
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// SendLMTP delivers msg from the address from to the addresses in to
+// through the LMTP (RFC 2033) server listening on addr, which is a
+// unix socket path or a host:port. Only opts.HelloName and
+// opts.ServerName are used.
+//
+// As with Send, recipients the server refuses are listed in a
+// *RecipientsError. With LMTP that includes recipients whose delivery
+// failed after the message was transferred.
+func SendLMTP(addr string, from string, to []string, msg []byte, opts Options) error {
+	c, extensions, opts, err := dialLMTP(addr, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	has := func(ext string) bool { return extensions[ext] }
+
+	from, converted, err := PrepareEnvelope(opts.ServerName, has, from, to, msg)
+	if err != nil {
+		return err
+	}
+	params := ""
+	if has("8BITMIME") {
+		params += " BODY=8BITMIME"
+	}
+	if has("SMTPUTF8") {
+		params += " SMTPUTF8"
+	}
+	if _, err = cmd(c, 250, "MAIL FROM:<%s>%s", from, params); err != nil {
+		return err
+	}
+
+	refused := &RecipientsError{Server: opts.ServerName}
+	var accepted []int
+	for ix, rcpt := range converted {
+		if _, err = cmd(c, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err
+			}
+			refused.Rejected = append(refused.Rejected, &RecipientError{Recipient: to[ix], Err: err})
+			continue
+		}
+		accepted = append(accepted, ix)
+	}
+	if len(accepted) == 0 {
+		_, _ = cmd(c, 221, "QUIT")
+		return refused
+	}
+
+	if _, err = cmd(c, 354, "DATA"); err != nil {
+		return err
+	}
+	w := c.DotWriter()
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	// one reply for each accepted recipient, in order
+	for _, ix := range accepted {
+		if _, _, err = c.ReadResponse(250); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err
+			}
+			refused.Rejected = append(refused.Rejected, &RecipientError{Recipient: to[ix], Err: err})
+			continue
+		}
+		refused.Delivered = true
+	}
+	_, _ = cmd(c, 221, "QUIT")
+
+	if len(refused.Rejected) > 0 {
+		return refused
+	}
+	return nil
+}
+
+// ProbeLMTP checks that the LMTP server at addr answers, greeting it
+// without sending anything.
+func ProbeLMTP(addr string, opts Options) error {
+	c, _, _, err := dialLMTP(addr, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	_, err = cmd(c, 221, "QUIT")
+	return err
+}
+
+// dialLMTP connects to the LMTP server at addr and greets it,
+// returning the extensions it advertises and opts with their defaults
+// filled in.
+func dialLMTP(addr string, opts Options) (*textproto.Conn, map[string]bool, Options, error) {
+	network := "unix"
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		network = "tcp"
+	}
+	if opts.HelloName == "" {
+		opts.HelloName = "localhost"
+	}
+	if opts.ServerName == "" {
+		opts.ServerName = addr
+	}
+
+	conn, err := net.DialTimeout(network, addr, DialTimeout)
+	if err != nil {
+		return nil, nil, opts, err
+	}
+	c := textproto.NewConn(conn)
+	if _, _, err = c.ReadResponse(220); err != nil {
+		_ = c.Close()
+		return nil, nil, opts, err
+	}
+	reply, err := cmd(c, 250, "LHLO %s", opts.HelloName)
+	if err != nil {
+		_ = c.Close()
+		return nil, nil, opts, err
+	}
+	extensions := map[string]bool{}
+	for _, line := range strings.Split(reply, "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			extensions[strings.ToUpper(fields[0])] = true
+		}
+	}
+	return c, extensions, opts, nil
+}
+
+// cmd sends a command and reads its reply, which must have expectCode.
+func cmd(c *textproto.Conn, expectCode int, format string, args ...interface{}) (string, error) {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, msg, err := c.ReadResponse(expectCode)
+	return msg, err
+}
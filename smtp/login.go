@@ -8,8 +8,6 @@ import (
 	"fmt"
 	"net/smtp"
 	"strings"
-
-	"github.com/golang/glog"
 )
 
 type loginAuth struct {
@@ -26,14 +24,12 @@ func LoginAuth(username, password string) smtp.Auth {
 // Start fulfills the smtp.Auth interface.  It returns information to
 // identify it's capabilities.
 func (l *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
-	glog.Infof("Start(server: %+v)", *server)
 	return "LOGIN", []byte{}, nil
 }
 
 // Next fulfills the smtp.Auth interface.  It responds to inputs from
 // the remote SMTP server until the authentication is complete or fails.
 func (l *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
-	glog.Infof("Next(fromServer: %q, more: %t)", string(fromServer), more)
 	response := strings.ToLower(string(fromServer[:9]))
 	switch response {
 	case "username:":
@@ -0,0 +1,350 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package smtp // import "jw4.us/mqd/smtp"
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// ExtensionError is returned when a message needs an SMTP extension
+// that the server does not advertise. Sending it again to the same
+// server won't help.
+type ExtensionError struct {
+	Server    string
+	Extension string
+	Reason    string
+}
+
+// Error fulfills the error interface
+func (e *ExtensionError) Error() string {
+	return fmt.Sprintf("%s does not support %s, which is needed because %s", e.Server, e.Extension, e.Reason)
+}
+
+// AddressError is returned for an address that can't be sent to by
+// any server, such as one whose domain is not a valid IDNA name.
+type AddressError struct {
+	Address string
+	Reason  string
+}
+
+// Error fulfills the error interface
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("address %q: %s", e.Address, e.Reason)
+}
+
+// RecipientError describes a recipient the server refused.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+// Error fulfills the error interface
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Recipient, e.Reason())
+}
+
+// Reason returns the reply of the server, without quoting.
+func (e *RecipientError) Reason() string {
+	if te, ok := e.Err.(*textproto.Error); ok {
+		return fmt.Sprintf("%03d %s", te.Code, te.Msg)
+	}
+	return e.Err.Error()
+}
+
+// Temporary reports whether the recipient may be accepted later: the
+// server refused it with a transient (4xx) reply, or it could not be
+// reached at all. Missing extensions and invalid addresses won't go
+// away by trying again.
+func (e *RecipientError) Temporary() bool {
+	return Temporary(e.Err)
+}
+
+// Temporary reports whether sending again might get past err.
+func Temporary(err error) bool {
+	switch err := err.(type) {
+	case *textproto.Error:
+		return err.Code < 500
+	case *ExtensionError, *AddressError:
+		return false
+	}
+	return true
+}
+
+// RecipientsError is returned by SendMail when the server refused
+// some of the recipients. The message was delivered to all the other
+// recipients, unless Delivered is false because every one of them was
+// refused.
+type RecipientsError struct {
+	Server    string
+	Rejected  []*RecipientError
+	Delivered bool
+}
+
+// Error fulfills the error interface
+func (e *RecipientsError) Error() string {
+	refused := make([]string, len(e.Rejected))
+	for ix, r := range e.Rejected {
+		refused[ix] = r.Error()
+	}
+	return fmt.Sprintf("%s refused %d recipient(s): %s", e.Server, len(e.Rejected), strings.Join(refused, "; "))
+}
+
+// SendMail connects to the server at addr, switches to TLS if the
+// server supports it, authenticates with a if it is not nil, and then
+// sends msg from the address from to the addresses in to. It works
+// like net/smtp.SendMail, and also handles internationalized mail:
+//
+//   - domains are converted to their ASCII (punycode) form,
+//   - addresses with non-ASCII local parts, and messages with raw
+//     UTF-8 in their headers, are only sent if the server supports
+//     SMTPUTF8,
+//   - messages with 8 bit content are only sent if the server
+//     supports 8BITMIME.
+//
+// When the server lacks a needed extension an *ExtensionError is
+// returned before anything is sent.
+//
+// Unlike net/smtp.SendMail, a recipient refused by the server doesn't
+// abort the transaction: the message is sent to the recipients that
+// were accepted, and a *RecipientsError lists the others, in the form
+// they were given in to.
+func SendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	return Send(addr, a, from, to, msg, Options{})
+}
+
+// DialTimeout limits the time Send waits for a connection.
+const DialTimeout = 30 * time.Second
+
+// Options adjust how Send talks to a server.
+type Options struct {
+	// HelloName is the name given with EHLO. Defaults to localhost.
+	HelloName string
+	// ServerName is the name the certificate of the server is checked
+	// against. Defaults to the host of the address.
+	ServerName string
+	// RequireTLS fails the delivery when the server doesn't offer
+	// STARTTLS, rather than sending in the clear.
+	RequireTLS bool
+	// InsecureTLS skips verifying the certificate of the server, as is
+	// usual for opportunistic TLS between mail exchangers.
+	InsecureTLS bool
+}
+
+// Send works like SendMail, with the connection adjusted by opts.
+func Send(addr string, a smtp.Auth, from string, to []string, msg []byte, opts Options) error {
+	c, opts, err := dial(addr, a, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+
+	from, converted, err := PrepareEnvelope(opts.ServerName, extensionFn(c), from, to, msg)
+	if err != nil {
+		return err
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	refused := &RecipientsError{Server: opts.ServerName}
+	for ix, rcpt := range converted {
+		if err = c.Rcpt(rcpt); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return err
+			}
+			refused.Rejected = append(refused.Rejected, &RecipientError{Recipient: to[ix], Err: err})
+		}
+	}
+	if len(refused.Rejected) == len(to) {
+		_ = c.Quit()
+		return refused
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	err = c.Quit()
+	if len(refused.Rejected) > 0 {
+		refused.Delivered = true
+		return refused
+	}
+	return err
+}
+
+// Probe checks that the server at addr would take mail: it connects,
+// greets the server, starts TLS when the server offers it (or fails
+// if opts require it) and authenticates with a, if given, without
+// sending anything.
+func Probe(addr string, a smtp.Auth, opts Options) error {
+	c, _, err := dial(addr, a, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = c.Close() }()
+	return c.Quit()
+}
+
+// dial connects to the server at addr and gets the session ready for
+// a mail transaction, returning opts with their defaults filled in.
+func dial(addr string, a smtp.Auth, opts Options) (*smtp.Client, Options, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, opts, err
+	}
+	if opts.ServerName == "" {
+		opts.ServerName = host
+	}
+	if opts.HelloName == "" {
+		opts.HelloName = "localhost"
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, DialTimeout)
+	if err != nil {
+		return nil, opts, err
+	}
+	c, err := smtp.NewClient(conn, opts.ServerName)
+	if err != nil {
+		_ = conn.Close()
+		return nil, opts, err
+	}
+	if err = start(c, a, opts); err != nil {
+		_ = c.Close()
+		return nil, opts, err
+	}
+	return c, opts, nil
+}
+
+// start greets the server, starts TLS and authenticates.
+func start(c *smtp.Client, a smtp.Auth, opts Options) error {
+	if err := c.Hello(opts.HelloName); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: opts.ServerName, InsecureSkipVerify: opts.InsecureTLS}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	} else if opts.RequireTLS {
+		return &ExtensionError{Server: opts.ServerName, Extension: "STARTTLS", Reason: "TLS is required"}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return &ExtensionError{Server: opts.ServerName, Extension: "AUTH", Reason: "the connection has credentials"}
+		}
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extensionFn(c *smtp.Client) func(string) bool {
+	return func(ext string) bool {
+		ok, _ := c.Extension(ext)
+		return ok
+	}
+}
+
+// PrepareEnvelope converts the envelope addresses to the form the
+// server can accept, and checks that the server advertises the
+// extensions (tested with hasExtension) that the addresses and msg
+// need. net/smtp adds the SMTPUTF8 and BODY=8BITMIME parameters to
+// MAIL FROM by itself whenever the server supports them.
+func PrepareEnvelope(server string, hasExtension func(string) bool, from string, to []string, msg []byte) (string, []string, error) {
+	needUTF8 := ""
+	convert := func(address string) (string, error) {
+		ascii, utf8Local, err := ASCIIDomain(address)
+		if err != nil {
+			return "", err
+		}
+		if utf8Local && needUTF8 == "" {
+			needUTF8 = fmt.Sprintf("the address %q has a non-ASCII local part", address)
+		}
+		return ascii, nil
+	}
+
+	var err error
+	if from, err = convert(from); err != nil {
+		return "", nil, err
+	}
+	converted := make([]string, 0, len(to))
+	for _, rcpt := range to {
+		c, err := convert(rcpt)
+		if err != nil {
+			return "", nil, err
+		}
+		converted = append(converted, c)
+	}
+
+	header, body := splitMessage(msg)
+	if needUTF8 == "" && !isASCII(header) {
+		needUTF8 = "the message headers contain non-ASCII characters"
+	}
+	if needUTF8 != "" && !hasExtension("SMTPUTF8") {
+		return "", nil, &ExtensionError{Server: server, Extension: "SMTPUTF8", Reason: needUTF8}
+	}
+	if !isASCII(body) && !hasExtension("8BITMIME") {
+		return "", nil, &ExtensionError{Server: server, Extension: "8BITMIME", Reason: "the message body contains 8 bit data"}
+	}
+	return from, converted, nil
+}
+
+// ASCIIDomain converts the domain of address to its ASCII form using
+// IDNA, and reports whether the local part still contains non-ASCII
+// characters, in which case the address can only be used with
+// SMTPUTF8.
+func ASCIIDomain(address string) (string, bool, error) {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return address, !isASCII([]byte(address)), nil
+	}
+	local, domain := address[:at], address[at+1:]
+	if !utf8.ValidString(address) {
+		return "", false, &AddressError{Address: address, Reason: "not valid UTF-8"}
+	}
+	if !isASCII([]byte(domain)) {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return "", false, &AddressError{Address: address, Reason: fmt.Sprintf("invalid domain: %v", err)}
+		}
+		domain = ascii
+	}
+	return local + "@" + domain, !isASCII([]byte(local)), nil
+}
+
+func splitMessage(msg []byte) ([]byte, []byte) {
+	if ix := bytes.Index(msg, []byte("\r\n\r\n")); ix >= 0 {
+		return msg[:ix], msg[ix+4:]
+	}
+	if ix := bytes.Index(msg, []byte("\n\n")); ix >= 0 {
+		return msg[:ix], msg[ix+2:]
+	}
+	return msg, nil
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
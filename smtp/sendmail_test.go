@@ -0,0 +1,190 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package smtp
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"jw4.us/mqd/smtp/smtptest"
+)
+
+func TestPrepareEnvelope(t *testing.T) {
+	tests := []struct {
+		from       string
+		to         []string
+		msg        string
+		extensions string
+		rcpt       string
+		missing    string
+	}{{
+		from: "a@example.com", to: []string{"b@example.com"},
+		msg:  "Subject: hi\r\n\r\nhello\r\n",
+		rcpt: "b@example.com",
+	}, {
+		from: "a@example.com", to: []string{"b@exämple.de"},
+		msg:  "Subject: hi\r\n\r\nhello\r\n",
+		rcpt: "b@xn--exmple-cua.de",
+	}, {
+		from: "a@example.com", to: []string{"josé@exämple.de"},
+		msg:     "Subject: hi\r\n\r\nhello\r\n",
+		missing: "SMTPUTF8",
+	}, {
+		from: "a@example.com", to: []string{"josé@exämple.de"},
+		msg: "Subject: hi\r\n\r\nhello\r\n", extensions: "SMTPUTF8 8BITMIME",
+		rcpt: "josé@xn--exmple-cua.de",
+	}, {
+		from: "a@example.com", to: []string{"b@example.com"},
+		msg:     "From: José <a@example.com>\r\n\r\nhello\r\n",
+		missing: "SMTPUTF8",
+	}, {
+		from: "a@example.com", to: []string{"b@example.com"},
+		msg:     "Subject: hi\r\n\r\nol\xc3\xa1\r\n",
+		missing: "8BITMIME",
+	}, {
+		from: "a@example.com", to: []string{"b@example.com"},
+		msg: "Subject: hi\r\n\r\nol\xc3\xa1\r\n", extensions: "8BITMIME",
+		rcpt: "b@example.com",
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		has := func(ext string) bool { return strings.Contains(" "+test.extensions+" ", " "+ext+" ") }
+		_, to, err := PrepareEnvelope("test", has, test.from, test.to, []byte(test.msg))
+		if test.missing != "" {
+			ee, ok := err.(*ExtensionError)
+			if !ok || ee.Extension != test.missing {
+				t.Errorf("expected missing %s, got %v", test.missing, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(to) != 1 || to[0] != test.rcpt {
+			t.Errorf("expected recipient %q, got %v", test.rcpt, to)
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	tests := []struct {
+		extensions []string
+		to         string
+		msg        string
+		mail       string
+		fail       bool
+	}{{
+		to:   "bob@example.com",
+		msg:  "Subject: hi\r\n\r\nhello\r\n",
+		mail: "MAIL FROM:<a@example.com>",
+	}, {
+		extensions: []string{"8BITMIME", "SMTPUTF8"},
+		to:         "josé@exämple.de",
+		msg:        "Subject: olá\r\n\r\nolá\r\n",
+		mail:       "MAIL FROM:<a@example.com> BODY=8BITMIME SMTPUTF8",
+	}, {
+		extensions: []string{"8BITMIME"},
+		to:         "josé@exämple.de",
+		msg:        "Subject: hi\r\n\r\nhello\r\n",
+		fail:       true,
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		srv := smtptest.NewServer(test.extensions...)
+		err := SendMail(srv.Addr, nil, "a@example.com", []string{test.to}, []byte(test.msg))
+		srv.Close()
+		if test.fail {
+			if _, ok := err.(*ExtensionError); !ok {
+				t.Errorf("expected ExtensionError, got %v", err)
+			}
+			if len(srv.Messages()) != 0 {
+				t.Errorf("message sent despite missing extension")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("SendMail: %v", err)
+		}
+		if commands := srv.Commands(); commands[1] != test.mail {
+			t.Errorf("expected %q, got %q", test.mail, commands[1])
+		}
+		if messages := srv.Messages(); len(messages) != 1 || messages[0].Data != strings.TrimSuffix(test.msg, "\r\n") {
+			t.Errorf("unexpected messages %q", messages)
+		}
+	}
+}
+
+func TestSendMailRefused(t *testing.T) {
+	srv := smtptest.NewServer()
+	srv.Refuse("b@example.com", "550 5.1.1 no such user")
+	srv.Refuse("c@example.com", "450 4.2.1 mailbox busy")
+	err := SendMail(srv.Addr, nil, "a@example.com", []string{"a@example.com", "b@example.com", "c@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	srv.Close()
+
+	refused, ok := err.(*RecipientsError)
+	if !ok {
+		t.Fatalf("expected RecipientsError, got %v", err)
+	}
+	if !refused.Delivered || len(srv.Messages()) != 1 {
+		t.Errorf("expected delivery to the accepted recipient")
+	}
+	if len(refused.Rejected) != 2 {
+		t.Fatalf("expected 2 refused recipients, got %v", refused.Rejected)
+	}
+	if r := refused.Rejected[0]; r.Recipient != "b@example.com" || r.Temporary() {
+		t.Errorf("expected permanent refusal of b@example.com, got %v", r)
+	}
+	if r := refused.Rejected[1]; r.Recipient != "c@example.com" || !r.Temporary() {
+		t.Errorf("expected temporary refusal of c@example.com, got %v", r)
+	}
+
+	srv = smtptest.NewServer()
+	srv.Refuse("b@example.com", "550 5.1.1 no such user")
+	err = SendMail(srv.Addr, nil, "a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	srv.Close()
+	if refused, ok := err.(*RecipientsError); !ok || refused.Delivered || len(srv.Messages()) != 0 {
+		t.Errorf("expected nothing delivered, got %v", err)
+	}
+}
+
+func TestSendRequireTLS(t *testing.T) {
+	srv := smtptest.NewServer()
+	defer srv.Close()
+
+	err := Send(srv.Addr, nil, "a@example.com", []string{"b@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"), Options{HelloName: "mx.example.com", RequireTLS: true})
+	if err == nil || len(srv.Messages()) != 0 {
+		t.Errorf("expected sending without TLS to fail, got %v", err)
+	}
+	if Temporary(err) {
+		t.Errorf("expected a missing STARTTLS to be permanent, got %v", err)
+	}
+	if commands := srv.Commands(); len(commands) == 0 || commands[0] != "EHLO mx.example.com" {
+		t.Errorf("unexpected commands %q", commands)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	_, _, invalid := ASCIIDomain("a@\xffexample.com")
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{&textproto.Error{Code: 451, Msg: "4.3.0 try later"}, true},
+		{&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}, false},
+		{&ExtensionError{Server: "mx.example.com", Extension: "SMTPUTF8"}, false},
+		{invalid, false},
+		{errors.New("connection reset"), true},
+	}
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		if temporary := (&RecipientError{Recipient: "b@example.com", Err: test.err}).Temporary(); temporary != test.temporary {
+			t.Errorf("expected temporary %v for %v, got %v", test.temporary, test.err, temporary)
+		}
+	}
+}
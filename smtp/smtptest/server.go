@@ -0,0 +1,237 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package smtptest provides a minimal SMTP server for testing mail
+// delivery, in the spirit of net/http/httptest.
+package smtptest // import "jw4.us/mqd/smtp/smtptest"
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Message is a message received by a Server.
+type Message struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Server is an SMTP server listening on a local port. It accepts any
+// sender and, unless told to refuse them, any recipient, and records
+// the commands and messages it receives.
+type Server struct {
+	// Addr is the address the Server listens on: host:port, or the
+	// path of a unix socket.
+	Addr string
+
+	extensions []string
+	lmtp       bool
+	l          net.Listener
+	wg         sync.WaitGroup
+
+	mu         sync.Mutex
+	refuse     map[string]string
+	refuseData map[string]string
+	commands   []string
+	messages   []Message
+}
+
+// NewServer starts a Server on a local port, advertising the given
+// extensions in its EHLO reply along with AUTH PLAIN. It panics if no
+// port is available.
+func NewServer(extensions ...string) *Server {
+	return NewServerAt("127.0.0.1:0", extensions...)
+}
+
+// NewServerAt starts a Server listening on addr.
+func NewServerAt(addr string, extensions ...string) *Server {
+	return newServer("tcp", addr, false, extensions)
+}
+
+// NewLMTPServer starts a Server that speaks LMTP (RFC 2033) on the
+// given network ("tcp" or "unix") and address.
+func NewLMTPServer(network, addr string, extensions ...string) *Server {
+	return newServer(network, addr, true, extensions)
+}
+
+func newServer(network, addr string, lmtp bool, extensions []string) *Server {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		panic("smtptest: failed to listen on " + addr + ": " + err.Error())
+	}
+	s := &Server{
+		Addr:       l.Addr().String(),
+		extensions: extensions,
+		lmtp:       lmtp,
+		refuse:     map[string]string{},
+		refuseData: map[string]string{},
+		l:          l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Port returns the port the Server listens on.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr)
+	return port
+}
+
+// Refuse makes the Server answer RCPT TO commands for address with
+// reply, e.g. "550 5.1.1 no such user".
+func (s *Server) Refuse(address, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refuse[address] = reply
+}
+
+// RefuseData makes an LMTP Server fail the delivery of messages to
+// address with reply, after the message has been transferred.
+func (s *Server) RefuseData(address, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refuseData[address] = reply
+}
+
+// Commands returns the commands received so far.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Close stops the Server, and waits for open connections to finish.
+func (s *Server) Close() {
+	_ = s.l.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() { _ = conn.Close() }()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	var msg Message
+	reply("220 smtptest ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO", "LHLO":
+			reply("250-smtptest")
+			for _, ext := range s.extensions {
+				reply("250-" + ext)
+			}
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			msg = Message{From: argument(line)}
+			reply("250 2.1.0 Ok")
+		case "RCPT":
+			addr := argument(line)
+			s.mu.Lock()
+			refusal, refused := s.refuse[addr]
+			s.mu.Unlock()
+			if refused {
+				reply(refusal)
+				continue
+			}
+			msg.To = append(msg.To, addr)
+			reply("250 2.1.5 Ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				l = strings.TrimRight(l, "\r\n")
+				if l == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(l, "."))
+			}
+			msg.Data = strings.Join(data, "\r\n")
+			if !s.lmtp {
+				s.deliver(msg)
+				reply("250 2.0.0 queued")
+				continue
+			}
+			delivered := msg
+			delivered.To = nil
+			for _, rcpt := range msg.To {
+				s.mu.Lock()
+				refusal, refused := s.refuseData[rcpt]
+				s.mu.Unlock()
+				if refused {
+					reply(refusal)
+					continue
+				}
+				delivered.To = append(delivered.To, rcpt)
+				reply("250 2.0.0 delivered to " + rcpt)
+			}
+			if len(delivered.To) > 0 {
+				s.deliver(delivered)
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 Ok")
+		}
+	}
+}
+
+func (s *Server) deliver(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+}
+
+// argument returns the address in a MAIL FROM or RCPT TO command.
+func argument(line string) string {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	arg := strings.TrimSpace(parts[1])
+	if end := strings.IndexByte(arg, '>'); end >= 0 {
+		arg = arg[:end]
+	}
+	return strings.TrimPrefix(arg, "<")
+}
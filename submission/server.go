@@ -0,0 +1,501 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+// Package submission provides an SMTP submission server that accepts
+// mail from applications and writes it into the mailqueue folder, with
+// its envelope, for the dispatcher to send. It lets mqd act as a
+// smarthost for applications that can't write to the folder.
+package submission // import "jw4.us/mqd/submission"
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+	"jw4.us/mqd/logging"
+)
+
+// Limits of a session.
+const (
+	idleTimeout   = 5 * time.Minute
+	maxRecipients = 1000
+)
+
+// authFailures counts failed authentication attempts.
+var authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "mqd",
+	Subsystem: "submission",
+	Name:      "auth_failures_total",
+	Help:      "Failed AUTH attempts of submission clients.",
+})
+
+func init() {
+	prometheus.MustRegister(authFailures)
+}
+
+// Server is an SMTP submission server.
+type Server struct {
+	settings  mqd.SubmissionSettings
+	mailqueue string
+	tls       *tls.Config
+	networks  []*net.IPNet
+	log       *slog.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a Server for the submission settings of s, which
+// writes to the mailqueue of s and logs to log, or the default logger
+// when it is nil.
+func NewServer(s *mqd.Settings, log *slog.Logger) (*Server, error) {
+	if s.Submission == nil {
+		return nil, errors.New("no submission settings")
+	}
+	srv := &Server{
+		settings:  *s.Submission,
+		mailqueue: s.MailQueue,
+		log:       logging.Or(log).With("listener", "submission"),
+		conns:     map[net.Conn]bool{},
+	}
+	if srv.settings.Hostname == "" {
+		srv.settings.Hostname, _ = os.Hostname()
+	}
+	if srv.settings.MaxSize == 0 {
+		srv.settings.MaxSize = mqd.DefaultMaxSize
+	}
+	var err error
+	if srv.networks, err = srv.settings.Networks(); err != nil {
+		return nil, err
+	}
+	if srv.settings.Certificate != "" {
+		cert, err := tls.LoadX509KeyPair(s.Path(srv.settings.Certificate), s.Path(srv.settings.Key))
+		if err != nil {
+			return nil, err
+		}
+		srv.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return srv, nil
+}
+
+// ListenAndServe listens on the configured address and serves
+// clients until Close is called.
+func (srv *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", srv.settings.Listen)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve serves clients connecting to l until Close is called.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	srv.listener = l
+	srv.mu.Unlock()
+	srv.log.Info("listening", "addr", l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.listener == nil
+			srv.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		srv.mu.Lock()
+		srv.conns[conn] = true
+		srv.mu.Unlock()
+		srv.wg.Add(1)
+		go srv.handle(conn)
+	}
+}
+
+// Close stops the Server, dropping open connections.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	l := srv.listener
+	srv.listener = nil
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.mu.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	srv.wg.Wait()
+	return err
+}
+
+func (srv *Server) allowed(addr net.Addr) bool {
+	if len(srv.networks) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range srv.networks {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	defer srv.wg.Done()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	s := &session{srv: srv}
+	s.reset(conn)
+	if !srv.allowed(conn.RemoteAddr()) {
+		srv.log.Warn("refused connection", logging.Remote, conn.RemoteAddr().String())
+		s.reply("554 5.7.1 %s does not accept mail from you", srv.settings.Hostname)
+		return
+	}
+	s.reply("220 %s ESMTP mqd", srv.settings.Hostname)
+	for s.next() {
+	}
+}
+
+// session is the state of one client connection.
+type session struct {
+	srv   *Server
+	conn  net.Conn
+	text  *textproto.Conn
+	helo  string
+	tls   bool
+	user  string
+	from  *string
+	rcpts []string
+}
+
+func (s *session) reset(conn net.Conn) {
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+}
+
+func (s *session) reply(format string, args ...interface{}) {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+	_ = s.text.PrintfLine(format, args...)
+}
+
+func (s *session) authRequired() bool {
+	return len(s.srv.settings.Users) > 0
+}
+
+// canAuth reports whether AUTH is offered: only over TLS when the
+// server has a certificate.
+func (s *session) canAuth() bool {
+	return s.authRequired() && (s.tls || s.srv.tls == nil)
+}
+
+// next handles one command, reporting whether the session goes on.
+func (s *session) next() bool {
+	_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return false
+	}
+	verb, arg := line, ""
+	if ix := strings.IndexByte(line, ' '); ix >= 0 {
+		verb, arg = line[:ix], strings.TrimSpace(line[ix+1:])
+	}
+
+	switch strings.ToUpper(verb) {
+	case "EHLO":
+		s.helo = arg
+		s.resetTransaction()
+		lines := []string{s.srv.settings.Hostname, "8BITMIME", "SMTPUTF8", "ENHANCEDSTATUSCODES",
+			"SIZE " + strconv.FormatInt(s.srv.settings.MaxSize, 10)}
+		if s.srv.tls != nil && !s.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		if s.canAuth() && s.user == "" {
+			lines = append(lines, "AUTH PLAIN LOGIN")
+		}
+		for ix, l := range lines {
+			sep := "-"
+			if ix == len(lines)-1 {
+				sep = " "
+			}
+			s.reply("250%s%s", sep, l)
+		}
+	case "HELO":
+		s.helo = arg
+		s.resetTransaction()
+		s.reply("250 %s", s.srv.settings.Hostname)
+	case "STARTTLS":
+		if s.srv.tls == nil || s.tls {
+			s.reply("502 5.5.1 STARTTLS not available")
+			break
+		}
+		s.reply("220 2.0.0 Ready to start TLS")
+		conn := tls.Server(s.conn, s.srv.tls)
+		_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+		if err := conn.Handshake(); err != nil {
+			s.srv.log.Warn("TLS handshake failed", logging.Remote, s.conn.RemoteAddr().String(), logging.Err(err))
+			return false
+		}
+		s.reset(conn)
+		s.tls, s.helo = true, ""
+		s.resetTransaction()
+	case "AUTH":
+		s.auth(arg)
+	case "MAIL":
+		s.mail(arg)
+	case "RCPT":
+		s.rcpt(arg)
+	case "DATA":
+		return s.data()
+	case "RSET":
+		s.resetTransaction()
+		s.reply("250 2.0.0 Ok")
+	case "NOOP":
+		s.reply("250 2.0.0 Ok")
+	case "VRFY":
+		s.reply("252 2.5.0 Cannot verify")
+	case "QUIT":
+		s.reply("221 2.0.0 Bye")
+		return false
+	default:
+		s.reply("502 5.5.2 Command not recognized")
+	}
+	return true
+}
+
+func (s *session) resetTransaction() {
+	s.from, s.rcpts = nil, nil
+}
+
+func (s *session) auth(arg string) {
+	switch {
+	case !s.canAuth():
+		s.reply("502 5.5.1 AUTH not available")
+		return
+	case s.user != "":
+		s.reply("503 5.5.1 Already authenticated")
+		return
+	case s.from != nil:
+		s.reply("503 5.5.1 AUTH not allowed during a mail transaction")
+		return
+	}
+
+	mechanism, initial := arg, ""
+	if ix := strings.IndexByte(arg, ' '); ix >= 0 {
+		mechanism, initial = arg[:ix], arg[ix+1:]
+	}
+	var user, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		response, ok := s.challenge(initial, "")
+		if !ok {
+			return
+		}
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			s.reply("501 5.5.2 Malformed AUTH PLAIN response")
+			return
+		}
+		user, password = parts[1], parts[2]
+	case "LOGIN":
+		var ok bool
+		if user, ok = s.challenge(initial, "Username:"); !ok {
+			return
+		}
+		if password, ok = s.challenge("", "Password:"); !ok {
+			return
+		}
+	default:
+		s.reply("504 5.5.4 Unrecognized authentication mechanism")
+		return
+	}
+
+	expected, known := s.srv.settings.Users[user]
+	if !known || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		s.srv.log.Warn("failed authentication", "user", user, logging.Remote, s.conn.RemoteAddr().String())
+		authFailures.Inc()
+		s.reply("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.user = user
+	s.reply("235 2.7.0 Authentication successful")
+}
+
+// challenge returns the decoded initial response if there is one, or
+// else prompts for and reads the client's response.
+func (s *session) challenge(initial, prompt string) (string, bool) {
+	response := initial
+	if response == "" {
+		s.reply("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return "", false
+		}
+		response = line
+	}
+	if response == "*" {
+		s.reply("501 5.0.0 Authentication cancelled")
+		return "", false
+	}
+	if response == "=" {
+		return "", true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		s.reply("501 5.5.2 Invalid base64 data")
+		return "", false
+	}
+	return string(decoded), true
+}
+
+func (s *session) mail(arg string) {
+	switch {
+	case s.helo == "":
+		s.reply("503 5.5.1 Send EHLO first")
+		return
+	case s.authRequired() && s.user == "":
+		s.reply("530 5.7.0 Authentication required")
+		return
+	case s.from != nil:
+		s.reply("503 5.5.1 Nested MAIL command")
+		return
+	}
+	addr, params, ok := path(arg, "FROM:")
+	if !ok {
+		s.reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range strings.Fields(params) {
+		if strings.HasPrefix(strings.ToUpper(param), "SIZE=") {
+			size, err := strconv.ParseInt(param[5:], 10, 64)
+			if err == nil && size > s.srv.settings.MaxSize {
+				s.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+				return
+			}
+		}
+	}
+	s.from = &addr
+	s.reply("250 2.1.0 Ok")
+}
+
+func (s *session) rcpt(arg string) {
+	if s.from == nil {
+		s.reply("503 5.5.1 Need MAIL before RCPT")
+		return
+	}
+	addr, _, ok := path(arg, "TO:")
+	if !ok || addr == "" {
+		s.reply("501 5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(s.rcpts) >= maxRecipients {
+		s.reply("452 4.5.3 Too many recipients")
+		return
+	}
+	s.rcpts = append(s.rcpts, addr)
+	s.reply("250 2.1.5 Ok")
+}
+
+func (s *session) data() bool {
+	if s.from == nil || len(s.rcpts) == 0 {
+		s.reply("503 5.5.1 Need RCPT before DATA")
+		return true
+	}
+	s.reply("354 End data with <CR><LF>.<CR><LF>")
+
+	_ = s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	body, dot := &bytes.Buffer{}, s.text.DotReader()
+	n, err := io.Copy(body, io.LimitReader(dot, s.srv.settings.MaxSize+1))
+	if err == nil && n > s.srv.settings.MaxSize {
+		// read the rest of the message so the session can go on
+		_, err = io.Copy(ioutil.Discard, dot)
+		if err == nil {
+			s.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+			s.resetTransaction()
+			return true
+		}
+	}
+	if err != nil {
+		return false
+	}
+
+	message := append(s.received(), bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n"))...)
+	env := &dispatcher.Envelope{Sender: *s.from, Recipients: s.rcpts}
+	name, err := dispatcher.Enqueue(s.srv.mailqueue, env, message)
+	if err != nil {
+		s.srv.log.Error("queueing message", logging.Sender, *s.from, logging.Recipients, len(s.rcpts),
+			logging.Remote, s.conn.RemoteAddr().String(), logging.Err(err))
+		s.reply("451 4.3.0 Could not queue message")
+	} else {
+		s.srv.log.Info("queued", logging.File, name, logging.Sender, *s.from, logging.Recipients, len(s.rcpts),
+			logging.Remote, s.conn.RemoteAddr().String())
+		s.reply("250 2.0.0 Ok: queued as %s", name)
+	}
+	s.resetTransaction()
+	return true
+}
+
+// received returns the Received: header for a message in the session.
+func (s *session) received() []byte {
+	protocol := "ESMTP"
+	if s.tls {
+		protocol += "S"
+	}
+	if s.user != "" {
+		protocol += "A"
+	}
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return []byte(fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s (mqd) with %s;\r\n\t%s\r\n",
+		s.helo, host, s.srv.settings.Hostname, protocol, time.Now().Format(time.RFC1123Z)))
+}
+
+// path parses the reverse or forward path of a MAIL FROM: or RCPT TO:
+// argument, returning the address and the parameters after it.
+func path(arg, prefix string) (string, string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", "", false
+	}
+	return arg[1:end], strings.TrimSpace(arg[end+1:]), true
+}
@@ -0,0 +1,288 @@
+// Copyright 2015-2017 John Weldon. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE.md file.
+
+package submission
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jw4.us/mqd"
+	"jw4.us/mqd/dispatcher"
+)
+
+// start runs a Server for s on a free local port.
+func start(t *testing.T, s *mqd.Settings) (*Server, string) {
+	srv, err := NewServer(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(l) }()
+	return srv, l.Addr().String()
+}
+
+func testSettings(t *testing.T, sub *mqd.SubmissionSettings) (*mqd.Settings, func()) {
+	dir, err := ioutil.TempDir("", "submission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mqd.NewSettings(filepath.Join(dir, "mailqueue"), "")
+	if err = os.MkdirAll(s.MailQueue, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.Submission = sub
+	return s, func() { _ = os.RemoveAll(dir) }
+}
+
+// queued returns the messages and envelopes in the mailqueue.
+func queued(t *testing.T, mailqueue string) ([]string, []dispatcher.Envelope) {
+	infos, err := ioutil.ReadDir(mailqueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		messages  []string
+		envelopes []dispatcher.Envelope
+	)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), dispatcher.EnvelopeSuffix) {
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(mailqueue, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, string(raw))
+		var env dispatcher.Envelope
+		raw, err = ioutil.ReadFile(filepath.Join(mailqueue, info.Name()+dispatcher.EnvelopeSuffix))
+		if err == nil {
+			err = json.Unmarshal(raw, &env)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelopes = append(envelopes, env)
+	}
+	return messages, envelopes
+}
+
+func TestSubmit(t *testing.T) {
+	users := map[string]string{"app": "secret"}
+	tests := []struct {
+		auth      smtp.Auth
+		msg       string
+		maxSize   int64
+		allowed   []string
+		expectErr string
+	}{{
+		msg: "Subject: hi\r\n\r\nhello\r\n",
+	}, {
+		auth: smtp.PlainAuth("", "app", "secret", "127.0.0.1"),
+		msg:  "Subject: hi\n\nhello\n",
+	}, {
+		auth:      smtp.PlainAuth("", "app", "wrong", "127.0.0.1"),
+		msg:       "Subject: hi\r\n\r\nhello\r\n",
+		expectErr: "535",
+	}, {
+		auth:      smtp.PlainAuth("", "app", "secret", "127.0.0.1"),
+		msg:       "Subject: hi\r\n\r\n" + strings.Repeat("x", 200) + "\r\n",
+		maxSize:   100,
+		expectErr: "552",
+	}, {
+		auth:      smtp.PlainAuth("", "app", "secret", "127.0.0.1"),
+		msg:       "Subject: hi\r\n\r\nhello\r\n",
+		allowed:   []string{"10.0.0.0/8"},
+		expectErr: "554",
+	}}
+
+	for ix, test := range tests {
+		t.Logf("Test %d", ix)
+		sub := &mqd.SubmissionSettings{Listen: "127.0.0.1:0", Hostname: "mqd.test", MaxSize: test.maxSize, AllowedNetworks: test.allowed}
+		if ix > 0 {
+			sub.Users = users
+		}
+		s, cleanup := testSettings(t, sub)
+		srv, addr := start(t, s)
+
+		err := smtp.SendMail(addr, test.auth, "app@example.com", []string{"a@example.com", "b@example.com"}, []byte(test.msg))
+		_ = srv.Close()
+		messages, envelopes := queued(t, s.MailQueue)
+		cleanup()
+
+		if test.expectErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectErr) {
+				t.Errorf("expected %s error, got %v", test.expectErr, err)
+			}
+			if len(messages) != 0 {
+				t.Errorf("expected nothing queued, got %d messages", len(messages))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+			continue
+		}
+		if len(messages) != 1 {
+			t.Errorf("expected 1 queued message, got %d", len(messages))
+			continue
+		}
+		if !strings.HasPrefix(messages[0], "Received: from localhost ([127.0.0.1])\r\n\tby mqd.test") ||
+			!strings.HasSuffix(messages[0], "Subject: hi\r\n\r\nhello\r\n") {
+			t.Errorf("unexpected message %q", messages[0])
+		}
+		env := envelopes[0]
+		if env.Sender != "app@example.com" || strings.Join(env.Recipients, ",") != "a@example.com,b@example.com" {
+			t.Errorf("unexpected envelope %+v", env)
+		}
+	}
+}
+
+func TestSubmitAuthRequired(t *testing.T) {
+	s, cleanup := testSettings(t, &mqd.SubmissionSettings{Users: map[string]string{"app": "secret"}})
+	defer cleanup()
+	srv, addr := start(t, s)
+	defer func() { _ = srv.Close() }()
+
+	err := smtp.SendMail(addr, nil, "app@example.com", []string{"a@example.com"}, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "530") {
+		t.Errorf("expected 530 error, got %v", err)
+	}
+}
+
+// remoteConn is a connection that appears to come from addr.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestSubmitDefaultNetworks(t *testing.T) {
+	for ix, test := range []struct {
+		users    map[string]string
+		allowed  []string
+		expected string
+	}{
+		{expected: "554"},
+		{allowed: []string{"192.0.2.0/24"}, expected: "220"},
+		{users: map[string]string{"app": "secret"}, expected: "220"},
+	} {
+		t.Logf("Test %d", ix)
+		s, cleanup := testSettings(t, &mqd.SubmissionSettings{Hostname: "mqd.test", Users: test.users, AllowedNetworks: test.allowed})
+		srv, err := NewServer(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		srv.wg.Add(1)
+		go srv.handle(remoteConn{server, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}})
+		reply, err := textproto.NewConn(client).ReadLine()
+		_ = client.Close()
+		srv.wg.Wait()
+		cleanup()
+		if err != nil || !strings.HasPrefix(reply, test.expected) {
+			t.Errorf("expected %s reply, got %q (%v)", test.expected, reply, err)
+		}
+	}
+}
+
+func TestSubmitStartTLS(t *testing.T) {
+	s, cleanup := testSettings(t, &mqd.SubmissionSettings{Users: map[string]string{"app": "secret"}})
+	defer cleanup()
+	s.Submission.Certificate, s.Submission.Key = writeCertificate(t, filepath.Dir(s.MailQueue))
+	srv, addr := start(t, s)
+	defer func() { _ = srv.Close() }()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if err = c.Hello("client"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Errorf("expected no AUTH before STARTTLS")
+	}
+	if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Auth(smtp.PlainAuth("", "app", "secret", "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Mail("app@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Rcpt("a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Quit()
+
+	messages, _ := queued(t, s.MailQueue)
+	if len(messages) != 1 || !strings.Contains(messages[0], "with ESMTPSA;") {
+		t.Errorf("expected 1 message received with ESMTPSA, got %q", messages)
+	}
+}
+
+// writeCertificate writes a self signed certificate and its key into
+// dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mqd.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"mqd.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}